@@ -95,6 +95,11 @@ can be removed automatically by this program.`)
 	maxConnections = flag.Uint64("max_connections", 0,
 		`If provided, the maximum number of connections to establish before refusing
 new connections. Defaults to 0 (no limit)`,
+	)
+	maxConnectionsWarnThreshold = flag.Float64("max_connections_warn_threshold", 0,
+		`If provided with -max_connections, the fraction of the limit, such as 0.8,
+at which a warning is logged that it is approaching, and below which its
+recovery is logged. Defaults to 0 (no warning)`,
 	)
 	fdRlimit = flag.Uint64("fd_rlimit", limits.ExpectedFDs,
 		`Sets the rlimit on the number of open file descriptors for the proxy to
@@ -136,6 +141,25 @@ unavailable.`,
 	// Settings for healthcheck
 	useHTTPHealthCheck = flag.Bool("use_http_health_check", false, "When set, creates an HTTP server that checks and communicates the health of the proxy client.")
 	healthCheckPort    = flag.String("health_check_port", "8090", "When applicable, health checks take place on this port number. Defaults to 8090.")
+	healthCheckAddress = flag.String("health_check_address", "", "When applicable, the host, or host:port, the health check server binds to. A port overrides -health_check_port. Defaults to all interfaces.")
+	healthCheckTLSCert = flag.String("health_check_tls_cert", "", "When set along with -health_check_tls_key, the health check server is served over HTTPS with this PEM encoded certificate.")
+	healthCheckTLSKey  = flag.String("health_check_tls_key", "", "The PEM encoded private key of -health_check_tls_cert.")
+	healthCheckTLS     = flag.Bool("health_check_tls", false, "When set, the health check server is served over HTTPS, with a self-signed certificate unless -health_check_tls_cert is set.")
+	healthCheckSocket  = flag.String("health_check_unix_socket", "", "When set, the health check server listens on the Unix domain socket at this path instead of a TCP port.")
+	healthCheckGRPC    = flag.String("health_check_grpc_port", "", "When set along with -use_http_health_check, the gRPC Health Checking Protocol is also served on this port.")
+	healthCheckCertMin = flag.Duration("health_check_min_cert_validity", 0, "When set along with -use_http_health_check, readiness fails while the client certificate of any instance is valid for less than this duration, such as 2m, as its refresh may be failing.")
+	healthCheckConns   = flag.Float64("health_check_connections_threshold", 0, "When set along with -use_http_health_check and -max_connections, the fraction of the limit, such as 0.9, at which readiness fails so that load shifts before connections are refused.")
+	healthCheckLive    = flag.Duration("health_check_liveness_window", 0, "When set along with -use_http_health_check, liveness fails when the proxy makes no progress for this long, such as 10m, either while connections are open or while refreshing a certificate, so that a wedged proxy is restarted.")
+	healthCheckGrace   = flag.Duration("health_check_readiness_grace_period", 0, "When set along with -use_http_health_check, readiness keeps failing for this long after startup, such as 10s, or until an instance is dialed successfully, whichever comes first.")
+	healthCheckDial    = flag.Bool("health_check_dial_instances", false, "When set along with -use_http_health_check, readiness fails unless at least one configured instance can be dialed, naming those that cannot.")
+	healthCheckToken   = flag.String("health_check_token", "", "When set along with -use_http_health_check, every request to the health check server, including the probes, must carry this token in an \"Authorization: Bearer\" header.")
+	prometheus         = flag.Bool("prometheus", false, "When set along with -use_http_health_check, the proxy's metrics are served in the Prometheus text exposition format on /metrics on the health check port.")
+	debug              = flag.Bool("debug", false, "When set along with -use_http_health_check, net/http/pprof profiles are served under /debug/pprof/ on the health check port, only to local requests unless -health_check_token is set.")
+	quitQuitQuit       = flag.Bool("quitquitquit", false, "When set along with -use_http_health_check, a POST to /quitquitquit on the health check port shuts the proxy down as a TERM signal does.")
+	quitToken          = flag.String("quitquitquit_token", "", "When set along with -quitquitquit, requests to /quitquitquit must carry this token in an \"Authorization: Bearer\" header.")
+
+	appPort = flag.Int("app_port", 0, `If provided, the port the application running alongside the proxy listens on.
+The proxy fails to start if it is configured to listen on the same port.`)
 )
 
 const (
@@ -277,6 +301,10 @@ var versionString = "1.24.1-dev"
 // metadataString indiciates additional build or distribution metadata.
 var metadataString = ""
 
+// commitString is the git commit the proxy was built from, set at build time
+// with -ldflags "-X main.commitString=...".
+var commitString = ""
+
 // semanticVersion returns the version of the proxy in a semver format.
 func semanticVersion() string {
 	v := versionString
@@ -460,6 +488,7 @@ func Main(timeout time.Duration) {
 }
 
 func main() {
+	runSubcommand()
 	flag.Parse()
 
 	if *version {
@@ -552,6 +581,19 @@ func main() {
 		os.Exit(1)
 	}
 
+	hcHost, hcPort := "", ""
+	if *useHTTPHealthCheck && *healthCheckSocket == "" {
+		hcHost, hcPort, err = splitHealthCheckAddress(*healthCheckAddress, *healthCheckPort)
+		if err != nil {
+			logging.Errorf(err.Error())
+			os.Exit(1)
+		}
+	}
+	if err := checkPortCollisions(hcHost, hcPort, *appPort, cfgs); err != nil {
+		logging.Errorf(err.Error())
+		os.Exit(1)
+	}
+
 	// We only need to store connections in a ConnSet if FUSE is used; otherwise
 	// it is not efficient to do so.
 	var connset *proxy.ConnSet
@@ -564,14 +606,19 @@ func main() {
 	if refreshCfgThrottle < minimumRefreshCfgThrottle {
 		refreshCfgThrottle = minimumRefreshCfgThrottle
 	}
+	configured := make([]string, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		configured = append(configured, cfg.Instance)
+	}
 	refreshCfgBuffer := proxy.DefaultRefreshCfgBuffer
 	if *enableIAMLogin {
 		refreshCfgThrottle = proxy.IAMLoginRefreshThrottle
 		refreshCfgBuffer = proxy.IAMLoginRefreshCfgBuffer
 	}
 	proxyClient := &proxy.Client{
-		Port:           port,
-		MaxConnections: *maxConnections,
+		Port:                        port,
+		MaxConnections:              *maxConnections,
+		MaxConnectionsWarnThreshold: *maxConnectionsWarnThreshold,
 		Certs: certs.NewCertSourceOpts(client, certs.RemoteOpts{
 			APIBasePath:    *host,
 			IgnoreRegion:   !*checkRegion,
@@ -583,16 +630,77 @@ func main() {
 		Conns:              connset,
 		RefreshCfgThrottle: refreshCfgThrottle,
 		RefreshCfgBuffer:   refreshCfgBuffer,
+		Instances:          configured,
 	}
 
+	signals := make(chan os.Signal, 1)
+
 	var hc *healthcheck.Server
 	if *useHTTPHealthCheck {
-		hc, err = healthcheck.NewServer(proxyClient, *healthCheckPort)
+		hcOpts := []healthcheck.Option{
+			healthcheck.WithVersion(semanticVersion(), commitString),
+			healthcheck.WithHost(hcHost),
+		}
+		if *healthCheckSocket != "" {
+			hcPort = *healthCheckSocket
+			hcOpts = append(hcOpts, healthcheck.WithNetwork("unix"))
+		}
+		if *healthCheckTLSCert != "" || *healthCheckTLSKey != "" {
+			hcOpts = append(hcOpts, healthcheck.WithTLSFiles(*healthCheckTLSCert, *healthCheckTLSKey))
+		} else if *healthCheckTLS {
+			hcOpts = append(hcOpts, healthcheck.WithSelfSignedCert())
+		}
+		if *healthCheckGRPC != "" {
+			hcOpts = append(hcOpts, healthcheck.WithGRPC(*healthCheckGRPC))
+		}
+		if *healthCheckCertMin > 0 {
+			hcOpts = append(hcOpts, healthcheck.WithMinCertValidity(*healthCheckCertMin))
+		}
+		if *healthCheckConns > 0 {
+			hcOpts = append(hcOpts, healthcheck.WithConnectionsThreshold(*healthCheckConns))
+		}
+		if *healthCheckLive > 0 {
+			hcOpts = append(hcOpts, healthcheck.WithMaxInactivity(*healthCheckLive), healthcheck.WithMaxRefreshDuration(*healthCheckLive))
+		}
+		if *prometheus {
+			hcOpts = append(hcOpts, healthcheck.WithMetrics())
+		}
+		if *debug {
+			hcOpts = append(hcOpts, healthcheck.WithDebug())
+		}
+		if *healthCheckToken != "" {
+			hcOpts = append(hcOpts, healthcheck.WithToken(*healthCheckToken))
+		}
+		if *healthCheckGrace > 0 {
+			hcOpts = append(hcOpts, healthcheck.WithReadinessGracePeriod(*healthCheckGrace))
+		}
+		if *healthCheckDial {
+			hcOpts = append(hcOpts, healthcheck.WithDialProbe(configured...))
+		}
+		if *quitQuitQuit {
+			hcOpts = append(hcOpts, healthcheck.WithQuitHandler(func() {
+				select {
+				case signals <- syscall.SIGTERM:
+				default:
+				}
+			}))
+			if *quitToken != "" {
+				hcOpts = append(hcOpts, healthcheck.WithQuitToken(*quitToken))
+			}
+		}
+		hc, err = healthcheck.NewServer(proxyClient, hcPort, hcOpts...)
 		if err != nil {
 			logging.Errorf("Could not initialize health check server: %v", err)
 			os.Exit(1)
 		}
 		defer hc.Close(ctx)
+		go func() {
+			// Without the health check server, liveness probes fail and the
+			// proxy would be restarted anyway, so exit straight away.
+			err := <-hc.Err()
+			logging.Errorf("Health check server failed: %v", err)
+			os.Exit(1)
+		}()
 	}
 
 	// Initialize a source of new connections to Cloud SQL instances.
@@ -624,7 +732,11 @@ func main() {
 			}()
 		}
 
-		c, err := WatchInstances(*dir, cfgs, updates, client)
+		var onListen func(string)
+		if hc != nil {
+			onListen = hc.NotifyInstanceInitialized
+		}
+		c, err := WatchInstances(*dir, cfgs, updates, client, onListen)
 		if err != nil {
 			logging.Errorf(err.Error())
 			os.Exit(1)
@@ -638,12 +750,14 @@ func main() {
 		hc.NotifyStarted()
 	}
 
-	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 
 	go func() {
 		<-signals
 		logging.Infof("Received TERM signal. Waiting up to %s before terminating.", *termTimeout)
+		if hc != nil {
+			hc.NotifyDraining()
+		}
 		go func() {
 			if _, err := daemon.SdNotify(false, daemon.SdNotifyStopping); err != nil {
 				logging.Errorf("Failed to notify systemd of termination: %v", err)
@@ -0,0 +1,70 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file contains the health subcommand, which checks a health check
+// endpoint of a running proxy once, for exec probes in images without an
+// HTTP client such as curl.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+)
+
+const healthCmd = "health"
+
+// healthEndpoints maps the endpoints the health subcommand accepts to their
+// paths.
+var healthEndpoints = map[string]string{
+	"startup":   "/startup",
+	"liveness":  "/liveness",
+	"readiness": "/readiness",
+}
+
+// healthMain runs the health subcommand with args and returns its exit code:
+// 0 if the endpoint reported the proxy healthy, 1 if it did not and 2 if args
+// are invalid.
+func healthMain(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet(healthCmd, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	endpoint := fs.String("endpoint", "readiness", "The health check endpoint to request: startup, liveness or readiness.")
+	timeout := fs.Duration("timeout", 5*time.Second, "How long to wait for the health check server to respond.")
+	srv := addHealthServerFlags(fs)
+	token := fs.String("token", "", "The bearer token the proxy's health check server requires, as set with -health_check_token.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	path, ok := healthEndpoints[*endpoint]
+	if !ok {
+		fmt.Fprintf(stderr, "Invalid endpoint %q: must be startup, liveness or readiness\n", *endpoint)
+		return 2
+	}
+
+	client, url, err := srv.client(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid health check server flags: %v\n", err)
+		return 2
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if ok, reason := checkReady(ctx, client, url, *token); !ok {
+		fmt.Fprintf(stderr, "The proxy failed its %s check: %s\n", *endpoint, reason)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/liveness" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("error: proxy has not finished starting up"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	tcs := []struct {
+		endpoint   string
+		wantCode   int
+		wantStderr string
+	}{
+		{"liveness", 0, ""},
+		{"readiness", 1, "The proxy failed its readiness check: 503 Service Unavailable: error: proxy has not finished starting up"},
+		{"healthz", 2, `Invalid endpoint "healthz"`},
+	}
+	for _, tc := range tcs {
+		var stderr bytes.Buffer
+		code := healthMain([]string{"--health-addr", addr, "--endpoint", tc.endpoint}, &stderr)
+		if code != tc.wantCode {
+			t.Errorf("%s: got exit code %d, want %d (stderr %q)", tc.endpoint, code, tc.wantCode, stderr.String())
+		}
+		if !strings.Contains(stderr.String(), tc.wantStderr) {
+			t.Errorf("%s: got stderr %q, want it to contain %q", tc.endpoint, stderr.String(), tc.wantStderr)
+		}
+	}
+}
+
+func TestHealthTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	tcs := []struct {
+		desc     string
+		args     []string
+		wantCode int
+	}{
+		{"CA file", []string{"--ca-file", f.Name()}, 0},
+		{"insecure", []string{"--insecure-skip-verify"}, 0},
+		{"unverified", []string{"--tls"}, 1},
+		{"plain HTTP", nil, 1},
+		{"missing CA file", []string{"--ca-file", f.Name() + ".missing"}, 2},
+	}
+	for _, tc := range tcs {
+		var stderr bytes.Buffer
+		if code := healthMain(append([]string{"--health-addr", addr}, tc.args...), &stderr); code != tc.wantCode {
+			t.Errorf("%s: got exit code %d, want %d (stderr %q)", tc.desc, code, tc.wantCode, stderr.String())
+		}
+	}
+}
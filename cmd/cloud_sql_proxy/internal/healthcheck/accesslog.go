@@ -0,0 +1,78 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// statusRecorder records the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// isProbePath reports whether path is served to the startup, liveness or
+// readiness probes.
+func (s *Server) isProbePath(path string) bool {
+	if path == startupPath || path == s.livenessPath || path == s.readinessPath {
+		return true
+	}
+	for _, p := range s.healthzPaths {
+		if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// withAccessLog wraps h so that, if access logging is enabled, each request
+// is logged once it has been handled.
+func (s *Server) withAccessLog(h http.Handler) http.Handler {
+	if !s.accessLog {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		logf := logging.Infof
+		if s.isProbePath(r.URL.Path) {
+			logf = logging.Verbosef
+		}
+		logf("Health check request: %s %s from %s: %d in %v%s",
+			r.Method, r.URL.Path, r.RemoteAddr, rec.status, time.Since(start), requestIDSuffix(r.Context()))
+	})
+}
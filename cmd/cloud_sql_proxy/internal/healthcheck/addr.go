@@ -0,0 +1,46 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// listenAddr returns the address to bind for the port passed to NewServer,
+// which is either a port, bound on host (all interfaces if it is empty), or a
+// full "host:port" address. IPv6 hosts must be enclosed in brackets, as in
+// "[::1]:8090". A host in port cannot be combined with one set by WithHost.
+func listenAddr(host, port string) (string, error) {
+	if !strings.Contains(port, ":") {
+		return net.JoinHostPort(host, port), nil
+	}
+	h, p, err := net.SplitHostPort(port)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %v", port, err)
+	}
+	if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid address %q: invalid port %q", port, p)
+	}
+	if h != "" && host != "" {
+		return "", fmt.Errorf("invalid address %q: host cannot be set with WithHost", port)
+	}
+	if h == "" {
+		h = host
+	}
+	return net.JoinHostPort(h, p), nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// authRealm is the realm of the WWW-Authenticate challenge sent to requests
+// that fail basic authentication.
+const authRealm = `Basic realm="cloudsql-proxy health", charset="UTF-8"`
+
+// basicAuth holds the credentials required on the health check endpoints, as
+// SHA-256 hashes so that comparing them takes the same time whatever their
+// length.
+type basicAuth struct {
+	username [sha256.Size]byte
+	password [sha256.Size]byte
+}
+
+// newBasicAuth returns the basicAuth requiring username and password.
+func newBasicAuth(username, password string) *basicAuth {
+	return &basicAuth{
+		username: sha256.Sum256([]byte(username)),
+		password: sha256.Sum256([]byte(password)),
+	}
+}
+
+// hasBearerToken reports whether r is authorized with the bearer token.
+func hasBearerToken(r *http.Request, token string) bool {
+	want := "Bearer " + token
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) == 1
+}
+
+// authExempt reports whether path is served without authentication: the
+// probe endpoints, which Kubernetes cannot easily send credentials to, and
+// faultsPath and, with a token, quitPath, which are authorized with their own
+// tokens.
+func (s *Server) authExempt(path string) bool {
+	switch path {
+	case startupPath, s.livenessPath, s.readinessPath, faultsPath:
+		return true
+	case quitPath:
+		return s.quitToken != ""
+	}
+	for _, p := range s.healthzPaths {
+		if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenExempt reports whether path is served without the token set with
+// WithToken: faultsPath and, with a token of its own, quitPath, which are
+// authorized with their own tokens in the same header.
+func (s *Server) tokenExempt(path string) bool {
+	return path == faultsPath || (path == quitPath && s.quitToken != "")
+}
+
+// withTokenAuth wraps h so that requests to paths that are not exempt must
+// carry the bearer token set with WithToken, if any.
+func (s *Server) withTokenAuth(h http.Handler) http.Handler {
+	if s.token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.tokenExempt(r.URL.Path) && !hasBearerToken(r, s.token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withBasicAuth wraps h so that requests to paths that are not exempt must
+// carry the credentials set with WithBasicAuth, if any.
+func (s *Server) withBasicAuth(h http.Handler) http.Handler {
+	if s.auth == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authExempt(r.URL.Path) && !s.auth.valid(r) {
+			w.Header().Set("WWW-Authenticate", authRealm)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// valid reports whether r carries the required credentials. Both the username
+// and the password are always compared, in constant time.
+func (a *basicAuth) valid(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	u := sha256.Sum256([]byte(user))
+	p := sha256.Sum256([]byte(pass))
+	match := subtle.ConstantTimeCompare(u[:], a.username[:]) &
+		subtle.ConstantTimeCompare(p[:], a.password[:])
+	return ok && match == 1
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+)
+
+// certExpiry tracks the client certificates a warning about their upcoming
+// expiry has been logged for, keyed by instance, so that it is logged once
+// per certificate.
+type certExpiry struct {
+	mu     sync.Mutex
+	warned map[string]time.Time
+}
+
+// certExpiryReason returns why the client certificate of an instance makes
+// the proxy not ready, as it has expired or is valid for less than
+// s.minCertValidity, or an empty string if none is. It logs a warning the
+// first time a certificate is found to expire within s.certExpiryWarning.
+func (s *Server) certExpiryReason(c *proxy.Client) string {
+	exp := c.CertExpirations()
+	insts := make([]string, 0, len(exp))
+	for inst := range exp {
+		insts = append(insts, inst)
+	}
+	sort.Strings(insts)
+
+	now := s.now()
+	for _, inst := range insts {
+		if left := exp[inst].Sub(now); left <= 0 {
+			return fmt.Sprintf("client certificate for instance %q expired %v ago", inst, -left.Round(time.Second))
+		}
+	}
+	for _, inst := range insts {
+		if left := exp[inst].Sub(now); left < s.minCertValidity {
+			return fmt.Sprintf("client certificate for instance %q expires in %v, less than the minimum of %v; its refresh may be failing",
+				inst, left.Round(time.Second), s.minCertValidity)
+		}
+	}
+	for _, inst := range insts {
+		if left := exp[inst].Sub(now); left <= s.certExpiryWarning {
+			s.warnCertExpiry(inst, exp[inst], left)
+		}
+	}
+	return ""
+}
+
+// certsFresh reports whether none of the cached client certificates of c has
+// expired.
+func (s *Server) certsFresh(c *proxy.Client) bool {
+	now := s.now()
+	for _, exp := range c.CertExpirations() {
+		if !exp.After(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// warnCertExpiry logs that the client certificate of inst, expiring at
+// notAfter, is valid for only left, unless that was already logged.
+func (s *Server) warnCertExpiry(inst string, notAfter time.Time, left time.Duration) {
+	s.certExpiry.mu.Lock()
+	defer s.certExpiry.mu.Unlock()
+	if s.certExpiry.warned[inst].Equal(notAfter) {
+		return
+	}
+	if s.certExpiry.warned == nil {
+		s.certExpiry.warned = make(map[string]time.Time)
+	}
+	s.certExpiry.warned[inst] = notAfter
+	logging.Errorf("Client certificate for instance %q expires in %v; it may not be rotating", inst, left.Round(time.Second))
+}
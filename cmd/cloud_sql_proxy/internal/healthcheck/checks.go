@@ -0,0 +1,263 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+const checksPath = "/checks"
+
+const (
+	// DefaultMaxChecks is the number of custom checks that may be registered
+	// with a Server when WithMaxChecks is not used.
+	DefaultMaxChecks = 32
+	// defaultCheckTimeout bounds how long each custom check may run.
+	defaultCheckTimeout = 5 * time.Second
+)
+
+// CheckFunc is a custom check of the proxy's health. It returns an error if
+// the check fails.
+type CheckFunc func(ctx context.Context) error
+
+// Check calls f(ctx).
+func (f CheckFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// A Checker is a custom readiness condition, such as that the application
+// embedding the proxy has run its migrations. Check returns an error while
+// the condition does not hold. It should return once ctx is done.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// customCheck is a CheckFunc registered under a name.
+type customCheck struct {
+	name string
+	fn   CheckFunc
+}
+
+// checkResult is the outcome of the most recent run of a custom check.
+type checkResult struct {
+	err      error
+	duration time.Duration
+}
+
+// customChecks holds the custom readiness and liveness checks registered
+// with a Server and the result of the most recent run of each, keyed by name.
+type customChecks struct {
+	mu        sync.Mutex
+	readiness []customCheck
+	liveness  []customCheck
+	results   map[string]checkResult
+}
+
+// RegisterReadinessCheck makes the proxy not ready while fn fails. An error
+// is returned if name is empty or already registered, or if the maximum
+// number of custom checks has been reached.
+func (s *Server) RegisterReadinessCheck(name string, fn CheckFunc) error {
+	return s.registerCheck(&s.checks.readiness, name, fn)
+}
+
+// RegisterCheck makes the proxy not ready while c fails, as
+// RegisterReadinessCheck does. Its most recent result is reported by the
+// readiness and /checks endpoints under name.
+func (s *Server) RegisterCheck(name string, c Checker) error {
+	if c == nil {
+		return fmt.Errorf("invalid nil checker for check %q", name)
+	}
+	return s.RegisterReadinessCheck(name, c.Check)
+}
+
+// RegisterLivenessCheck makes the proxy not live while fn fails. An error is
+// returned if name is empty or already registered, or if the maximum number
+// of custom checks has been reached.
+func (s *Server) RegisterLivenessCheck(name string, fn CheckFunc) error {
+	return s.registerCheck(&s.checks.liveness, name, fn)
+}
+
+func (s *Server) registerCheck(list *[]customCheck, name string, fn CheckFunc) error {
+	if name == "" {
+		return errors.New("invalid empty check name")
+	}
+	s.checks.mu.Lock()
+	defer s.checks.mu.Unlock()
+	for _, c := range append(s.checks.readiness, s.checks.liveness...) {
+		if c.name == name {
+			return fmt.Errorf("check %q is already registered", name)
+		}
+	}
+	if n := len(s.checks.readiness) + len(s.checks.liveness); n >= s.maxChecks {
+		return fmt.Errorf("cannot register check %q: the maximum of %d checks are registered", name, s.maxChecks)
+	}
+	*list = append(*list, customCheck{name: name, fn: fn})
+	return nil
+}
+
+// runChecks runs each of checks, with s.checkTimeout, and records the
+// results. It returns the names of the checks that failed and why, or an empty
+// string if all passed.
+func (s *Server) runChecks(ctx context.Context, kind string, checks []customCheck) string {
+	var failed []string
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(ctx, s.checkTimeout)
+		start := time.Now()
+		err := runCheck(ctx, c.fn)
+		d := time.Since(start)
+		cancel()
+
+		s.checks.mu.Lock()
+		if s.checks.results == nil {
+			s.checks.results = make(map[string]checkResult)
+		}
+		s.checks.results[c.name] = checkResult{err: err, duration: d}
+		s.checks.mu.Unlock()
+
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%q (%v)", c.name, err))
+		}
+	}
+	if len(failed) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s checks failed: %s", kind, strings.Join(failed, ", "))
+}
+
+// runCheck runs fn, returning ctx's error if fn has not returned once ctx is
+// done, so that a check ignoring its context cannot block the caller.
+func runCheck(ctx context.Context, fn CheckFunc) error {
+	errc := make(chan error, 1)
+	go func() { errc <- fn(ctx) }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// readinessChecks returns a copy of the registered readiness checks.
+func (s *Server) readinessChecks() []customCheck {
+	s.checks.mu.Lock()
+	defer s.checks.mu.Unlock()
+	return append([]customCheck(nil), s.checks.readiness...)
+}
+
+// livenessChecks returns a copy of the registered liveness checks.
+func (s *Server) livenessChecks() []customCheck {
+	s.checks.mu.Lock()
+	defer s.checks.mu.Unlock()
+	return append([]customCheck(nil), s.checks.liveness...)
+}
+
+// notLiveReason returns why the proxy is not live, or an empty string if it
+// is.
+func (s *Server) notLiveReason() string {
+	if reason := s.injectedFault(livenessFault); reason != "" {
+		return reason
+	}
+	if !s.live() {
+		return "proxy is not live"
+	}
+	// Not live if connections are open but the proxy has made no progress
+	// for longer than the optional maximum inactivity, as it is likely
+	// wedged. An idle proxy without connections is still live.
+	if s.maxInactivity > 0 {
+		if open := atomic.LoadUint64(&s.client.ConnectionsCounter); open > 0 {
+			if idle := s.now().Sub(s.client.LastActivity()); idle > s.maxInactivity {
+				return fmt.Sprintf("no proxy activity for %v with %d open connections", idle.Round(time.Second), open)
+			}
+		}
+	}
+	// Not live if a certificate refresh is stuck, as it blocks all others.
+	if s.maxRefresh > 0 {
+		if started := s.client.RefreshStarted(); !started.IsZero() {
+			if d := s.now().Sub(started); d > s.maxRefresh {
+				return fmt.Sprintf("certificate refresh has been in progress for %v", d.Round(time.Second))
+			}
+		}
+	}
+	return s.runChecks(context.Background(), "liveness", s.livenessChecks())
+}
+
+// checkStatus describes a custom check and its most recent result, served as
+// JSON on /checks.
+type checkStatus struct {
+	Name string `json:"name"`
+	// Kind is "readiness" or "liveness".
+	Kind string `json:"kind"`
+	// Evaluated is whether the check has run. If not, the remaining fields
+	// are unset.
+	Evaluated       bool    `json:"evaluated"`
+	Passed          bool    `json:"passed"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// readinessCheckStatuses returns the status of each registered readiness
+// check, in the order they were registered.
+func (s *Server) readinessCheckStatuses() []checkStatus {
+	var statuses []checkStatus
+	for _, st := range s.checkStatuses() {
+		if st.Kind == "readiness" {
+			statuses = append(statuses, st)
+		}
+	}
+	return statuses
+}
+
+// checkStatuses returns the status of each registered check, readiness checks
+// first, in the order they were registered.
+func (s *Server) checkStatuses() []checkStatus {
+	s.checks.mu.Lock()
+	defer s.checks.mu.Unlock()
+	statuses := []checkStatus{}
+	add := func(kind string, checks []customCheck) {
+		for _, c := range checks {
+			st := checkStatus{Name: c.name, Kind: kind}
+			if r, ok := s.checks.results[c.name]; ok {
+				st.Evaluated = true
+				st.Passed = r.err == nil
+				if r.err != nil {
+					st.Error = r.err.Error()
+				}
+				st.DurationSeconds = r.duration.Seconds()
+			}
+			statuses = append(statuses, st)
+		}
+	}
+	add("readiness", s.checks.readiness)
+	add("liveness", s.checks.liveness)
+	return statuses
+}
+
+// checksHandler serves the status of each registered check as JSON.
+func (s *Server) checksHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.checkStatuses()); err != nil {
+		logging.Errorf("Failed to write check statuses: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+)
+
+const connectionsPath = "/connections"
+
+// connections reports how close the proxy is to its MaxConnections limit,
+// served as JSON on /connections.
+type connections struct {
+	OpenConnections uint64 `json:"openConnections"`
+	// MaxConnections is the limit on open connections, or 0 if there is
+	// none.
+	MaxConnections uint64 `json:"maxConnections"`
+	// Available is how many more connections can be opened before the limit
+	// is reached, or -1 if there is no limit.
+	Available int64 `json:"available"`
+	// TotalConnections and RefusedConnections are the number of connections
+	// admitted and refused because of a limit since the proxy started.
+	TotalConnections   uint64 `json:"totalConnections"`
+	RefusedConnections uint64 `json:"refusedConnections"`
+}
+
+// connectionsHandler serves the number of open connections and the headroom
+// left under MaxConnections as JSON.
+func connectionsHandler(c *proxy.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		open, max := atomic.LoadUint64(&c.ConnectionsCounter), c.MaxConnectionsLimit()
+		total, refused := c.ConnectionTotals()
+		conns := connections{
+			OpenConnections:    open,
+			MaxConnections:     max,
+			Available:          -1,
+			TotalConnections:   total,
+			RefusedConnections: refused,
+		}
+		if max > 0 {
+			conns.Available = 0
+			if open < max {
+				conns.Available = int64(max - open)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(conns); err != nil {
+			logging.Errorf("Failed to write connections: %v", err)
+		}
+	}
+}
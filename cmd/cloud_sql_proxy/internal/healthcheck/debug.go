@@ -0,0 +1,60 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// debugPath is the prefix of the pprof endpoints served with WithDebug.
+const debugPath = "/debug/pprof/"
+
+// handleDebug serves the pprof endpoints on mux, guarded by withDebugGuard.
+func (s *Server) handleDebug(mux *http.ServeMux) {
+	mux.Handle(debugPath, s.withDebugGuard(http.HandlerFunc(pprof.Index)))
+	mux.Handle(debugPath+"cmdline", s.withDebugGuard(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle(debugPath+"profile", s.withDebugGuard(http.HandlerFunc(pprof.Profile)))
+	mux.Handle(debugPath+"symbol", s.withDebugGuard(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle(debugPath+"trace", s.withDebugGuard(http.HandlerFunc(pprof.Trace)))
+}
+
+// withDebugGuard wraps h so that, unless requests must be authenticated with
+// WithToken or WithBasicAuth, only local requests are served, as profiles
+// reveal the proxy's internals and are costly to collect.
+func (s *Server) withDebugGuard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.token == "" && s.auth == nil && !s.isLocalRequest(r) {
+			http.Error(w, "forbidden: debug endpoints are only served to local requests unless authentication is required", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isLocalRequest reports whether r came from the local host, over a Unix
+// domain socket or from a loopback address.
+func (s *Server) isLocalRequest(r *http.Request) bool {
+	if s.network == "unix" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
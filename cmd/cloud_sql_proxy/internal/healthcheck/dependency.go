@@ -0,0 +1,127 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDependencyInterval = 10 * time.Second
+	defaultDependencyTimeout  = 5 * time.Second
+)
+
+// DependencyCheck configures a readiness check against an external HTTP
+// dependency. Only URL is required.
+type DependencyCheck struct {
+	// URL is requested with GET to determine whether the dependency is
+	// healthy.
+	URL string
+	// ExpectedStatus is the status code the dependency must respond with. If
+	// zero, any 2xx status code is accepted.
+	ExpectedStatus int
+	// Interval is how long a result is reused before the dependency is
+	// requested again. If not set, it defaults to 10 seconds.
+	Interval time.Duration
+	// Timeout bounds each request to the dependency. If not set, it defaults
+	// to 5 seconds.
+	Timeout time.Duration
+	// Client is used to make requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// dependencyChecker caches the result of requesting a DependencyCheck's URL.
+type dependencyChecker struct {
+	cfg DependencyCheck
+
+	// mu protects checked and err. It is not held while the dependency is
+	// requested.
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func newDependencyChecker(cfg DependencyCheck) (*dependencyChecker, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("dependency check requires a URL")
+	}
+	if cfg.Interval < 0 {
+		return nil, fmt.Errorf("invalid dependency check interval %v", cfg.Interval)
+	}
+	if cfg.Timeout < 0 {
+		return nil, fmt.Errorf("invalid dependency check timeout %v", cfg.Timeout)
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultDependencyInterval
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultDependencyTimeout
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	return &dependencyChecker{cfg: cfg}, nil
+}
+
+// check returns nil if the dependency was healthy when last requested,
+// requesting it again if the previous result is older than the interval. A
+// result is not cached if ctx ends before the request completes.
+func (d *dependencyChecker) check(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.checked.IsZero() && time.Since(d.checked) < d.cfg.Interval {
+		err := d.err
+		d.mu.Unlock()
+		return err
+	}
+	d.mu.Unlock()
+
+	err := d.request(ctx)
+	if ctx.Err() != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.err, d.checked = err, time.Now()
+	d.mu.Unlock()
+	return err
+}
+
+func (d *dependencyChecker) request(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.cfg.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if d.cfg.ExpectedStatus != 0 {
+		if resp.StatusCode != d.cfg.ExpectedStatus {
+			return fmt.Errorf("GET %s returned status %d, want %d", d.cfg.URL, resp.StatusCode, d.cfg.ExpectedStatus)
+		}
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("GET %s returned status %d", d.cfg.URL, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// Deregisterer removes the proxy's service entry from a service discovery
+// backend, such as Consul or etcd, so that clients stop being sent to it.
+type Deregisterer interface {
+	Deregister(ctx context.Context) error
+}
+
+// noopDeregisterer is the Deregisterer of a Server that is not registered
+// with a service discovery backend.
+type noopDeregisterer struct{}
+
+func (noopDeregisterer) Deregister(context.Context) error { return nil }
+
+// deregister deregisters the proxy the first time it is called, before the
+// Server drains. A failure is logged rather than returned so that it does not
+// hold up draining.
+func (s *Server) deregister(ctx context.Context) {
+	s.deregisterOnce.Do(func() {
+		if err := s.deregisterer.Deregister(ctx); err != nil {
+			logging.Errorf("Failed to deregister from service discovery: %v", err)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// AddShutdownStep appends a step to be run by s.Close. It is only available
+// to tests.
+func AddShutdownStep(s *Server, step func(context.Context) error) {
+	s.shutdown = append(s.shutdown, step)
+}
+
+// SetSampleSeed makes the readiness log sampling of s deterministic.
+func SetSampleSeed(s *Server, seed int64) {
+	s.sample = rand.New(rand.NewSource(seed)).Float64
+}
+
+// SetClock replaces the clock s uses to evaluate time-dependent checks.
+func SetClock(s *Server, now func() time.Time) {
+	s.now = now
+}
+
+// SetProcessStart replaces the time the proxy process is taken to have started
+// at and returns a function restoring the previous one. It must not be called
+// while a Server is running.
+func SetProcessStart(start time.Time) (restore func()) {
+	prev := processStart
+	processStart = start
+	return func() { processStart = prev }
+}
+
+// GzipHandler is gzipHandler, for testing responses the server would
+// otherwise rewrite.
+func GzipHandler(h http.HandlerFunc, threshold int) http.HandlerFunc {
+	return gzipHandler(h, threshold)
+}
+
+// SetProbe replaces the function s uses to probe instances.
+func SetProbe(s *Server, probe func(ctx context.Context, instance string) error) {
+	s.probe = probe
+}
+
+// SetLive replaces the function s uses to determine whether the proxy is live.
+func SetLive(s *Server, live func() bool) {
+	s.live = live
+}
+
+// SetEnv replaces the function s uses to read environment variables.
+func SetEnv(s *Server, getenv func(string) string) {
+	s.getenv = getenv
+}
+
+// SetDial replaces the function s uses to connect to instances for their
+// ConnChecks.
+func SetDial(s *Server, dial func(ctx context.Context, instance string) (net.Conn, error)) {
+	s.dial = dial
+}
+
+// SetResolver replaces the function s uses to resolve hostnames for its DNS
+// cache.
+func SetResolver(s *Server, resolve func(ctx context.Context, host string) ([]string, error)) {
+	s.resolve = resolve
+}
+
+// Serve serves the health check endpoints of s on ln. It is only available to
+// tests.
+func Serve(s *Server, ln net.Listener) {
+	s.serve(ln)
+}
+
+// SetCheckTimeout replaces how long each custom check of s may run.
+func SetCheckTimeout(s *Server, d time.Duration) {
+	s.checkTimeout = d
+}
+
+// Mux returns the handler s routes requests to its endpoints with, after
+// authentication. It is only available to tests.
+func Mux(s *Server) http.Handler {
+	return s.mux
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+const faultsPath = "/admin/faults"
+
+// Kinds of fault that can be injected on faultsPath.
+const (
+	readinessFault = "readiness"
+	livenessFault  = "liveness"
+	latencyFault   = "latency"
+)
+
+// faults holds the failures injected for chaos testing, each of which is in
+// effect until its expiry.
+type faults struct {
+	mu             sync.Mutex
+	readinessUntil time.Time
+	livenessUntil  time.Time
+	latencyUntil   time.Time
+	latency        time.Duration
+}
+
+// injectedFault returns why the proxy is made to fail a probe of kind, or an
+// empty string if no such fault is in effect.
+func (s *Server) injectedFault(kind string) string {
+	s.faults.mu.Lock()
+	defer s.faults.mu.Unlock()
+	until := s.faults.readinessUntil
+	if kind == livenessFault {
+		until = s.faults.livenessUntil
+	}
+	if s.now().Before(until) {
+		return fmt.Sprintf("injected %s failure", kind)
+	}
+	return ""
+}
+
+// injectedLatency returns how long probes are delayed by an injected fault.
+func (s *Server) injectedLatency() time.Duration {
+	s.faults.mu.Lock()
+	defer s.faults.mu.Unlock()
+	if s.now().Before(s.faults.latencyUntil) {
+		return s.faults.latency
+	}
+	return 0
+}
+
+// withInjectedLatency wraps h so that its response is delayed by any injected
+// latency, or until the request is canceled.
+func (s *Server) withInjectedLatency(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if d := s.injectedLatency(); d > 0 {
+			if err := sleepContext(r.Context(), d); err != nil {
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// sleepContext waits for d or until ctx is done, returning ctx's error in the
+// latter case.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// faultsHandler injects a fault, given by the form values "type", one of
+// "readiness", "liveness" or "latency", and "duration", for which it lasts.
+// Latency faults also take the "latency" to add to probes. Requests must be
+// POSTs authorized with the bearer token s.faultsToken.
+func (s *Server) faultsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hasBearerToken(r, s.faultsToken) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	kind := r.FormValue("type")
+	d, err := time.ParseDuration(r.FormValue("duration"))
+	if err != nil || d <= 0 {
+		http.Error(w, fmt.Sprintf("invalid duration %q", r.FormValue("duration")), http.StatusBadRequest)
+		return
+	}
+	until := s.now().Add(d)
+
+	s.faults.mu.Lock()
+	defer s.faults.mu.Unlock()
+	switch kind {
+	case readinessFault:
+		s.faults.readinessUntil = until
+	case livenessFault:
+		s.faults.livenessUntil = until
+	case latencyFault:
+		latency, err := time.ParseDuration(r.FormValue("latency"))
+		if err != nil || latency <= 0 {
+			http.Error(w, fmt.Sprintf("invalid latency %q", r.FormValue("latency")), http.StatusBadRequest)
+			return
+		}
+		s.faults.latencyUntil, s.faults.latency = until, latency
+	default:
+		http.Error(w, fmt.Sprintf("invalid fault type %q", kind), http.StatusBadRequest)
+		return
+	}
+	logging.Infof("Injected %s fault for %v", kind, d)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
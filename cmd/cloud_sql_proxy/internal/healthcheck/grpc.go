@@ -0,0 +1,145 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthgrpc "google.golang.org/grpc/health/grpc_health_v1"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// The services the gRPC health server reports on, besides the empty service
+// name, which is serving only if the proxy is both live and ready.
+const (
+	grpcLivenessService  = "liveness"
+	grpcReadinessService = "readiness"
+)
+
+// grpcWatchInterval is how often the status of a watched service is
+// re-evaluated.
+const grpcWatchInterval = time.Second
+
+// grpcHealth implements the gRPC Health Checking Protocol for the proxy.
+type grpcHealth struct {
+	healthgrpc.UnimplementedHealthServer
+	s *Server
+	c *proxy.Client
+}
+
+// servingStatus returns whether service is serving, or
+// HealthCheckResponse_SERVICE_UNKNOWN if there is no such service.
+func (h *grpcHealth) servingStatus(ctx context.Context, service string) healthgrpc.HealthCheckResponse_ServingStatus {
+	var reason string
+	switch service {
+	case "":
+		if reason = h.s.evaluateLiveness(); reason != "" {
+			h.s.logLivenessFailure(ctx, reason)
+		} else {
+			reason = notReadyBecause(ctx, h.c, h.s)
+		}
+	case grpcLivenessService:
+		if reason = h.s.evaluateLiveness(); reason != "" {
+			h.s.logLivenessFailure(ctx, reason)
+		}
+	case grpcReadinessService:
+		reason = notReadyBecause(ctx, h.c, h.s)
+	default:
+		return healthgrpc.HealthCheckResponse_SERVICE_UNKNOWN
+	}
+	if reason != "" {
+		return healthgrpc.HealthCheckResponse_NOT_SERVING
+	}
+	return healthgrpc.HealthCheckResponse_SERVING
+}
+
+// Check responds with the current status of the requested service.
+func (h *grpcHealth) Check(ctx context.Context, req *healthgrpc.HealthCheckRequest) (*healthgrpc.HealthCheckResponse, error) {
+	st := h.servingStatus(ctx, req.GetService())
+	if st == healthgrpc.HealthCheckResponse_SERVICE_UNKNOWN {
+		return nil, grpcstatus.Errorf(codes.NotFound, "unknown service %q", req.GetService())
+	}
+	return &healthgrpc.HealthCheckResponse{Status: st}, nil
+}
+
+// Watch streams the status of the requested service, sending it once and
+// again whenever it changes, until the client goes away or the Server is
+// closed.
+func (h *grpcHealth) Watch(req *healthgrpc.HealthCheckRequest, stream healthgrpc.Health_WatchServer) error {
+	ctx := stream.Context()
+	t := time.NewTicker(grpcWatchInterval)
+	defer t.Stop()
+	last := healthgrpc.HealthCheckResponse_ServingStatus(-1)
+	for {
+		if st := h.servingStatus(ctx, req.GetService()); st != last {
+			if err := stream.Send(&healthgrpc.HealthCheckResponse{Status: st}); err != nil {
+				return err
+			}
+			last = st
+		}
+		select {
+		case <-ctx.Done():
+			return grpcstatus.FromContextError(ctx.Err()).Err()
+		case <-h.s.closing:
+			return grpcstatus.Error(codes.Unavailable, "health check server is closing")
+		case <-t.C:
+		}
+	}
+}
+
+// listenGRPC serves the gRPC Health Checking Protocol on port from a new
+// goroutine, once BeginServing has been called, and arranges for Close to
+// stop it.
+func (s *Server) listenGRPC(c *proxy.Client, port string) error {
+	ln, err := net.Listen("tcp", net.JoinHostPort(s.host, port))
+	if err != nil {
+		return err
+	}
+	var opts []grpc.ServerOption
+	if s.tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.tlsConfig)))
+	}
+	srv := grpc.NewServer(opts...)
+	healthgrpc.RegisterHealthServer(srv, &grpcHealth{s: s, c: c})
+	go func() {
+		<-s.serving
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			logging.Errorf("Failed to start gRPC health check server: %v", err)
+		}
+	}()
+	s.drain = append(s.drain, func(ctx context.Context) error {
+		done := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			srv.Stop()
+			return ctx.Err()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// defaultGzipThreshold is the body size, in bytes, from which responses are
+// compressed when WithGzipThreshold is not used.
+const defaultGzipThreshold = 1024
+
+// bufferedResponse is an http.ResponseWriter holding the response in memory
+// until it is known whether it should be compressed.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// acceptsGzip reports whether r's Accept-Encoding header allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if i := strings.IndexByte(enc, ';'); i >= 0 {
+			if strings.TrimSpace(enc[i+1:]) == "q=0" {
+				continue
+			}
+			enc = strings.TrimSpace(enc[:i])
+		}
+		if enc == "gzip" || enc == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyAllowed reports whether a response with status may have a body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// gzipHandler wraps h so that response bodies of at least threshold bytes are
+// gzip compressed for clients that accept it. Responses that cannot have a
+// body, such as 304 Not Modified, are passed through unchanged.
+func gzipHandler(h http.HandlerFunc, threshold int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			h(w, r)
+			return
+		}
+
+		b := &bufferedResponse{header: w.Header()}
+		h(b, r)
+		if b.status == 0 {
+			b.status = http.StatusOK
+		}
+		if !bodyAllowed(b.status) {
+			w.WriteHeader(b.status)
+			return
+		}
+		body := b.body.Bytes()
+		if len(body) >= threshold {
+			if w.Header().Get("Content-Type") == "" {
+				w.Header().Set("Content-Type", http.DetectContentType(body))
+			}
+			var z bytes.Buffer
+			zw := gzip.NewWriter(&z)
+			zw.Write(body) // Writes to a bytes.Buffer cannot fail.
+			zw.Close()
+			body = z.Bytes()
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(b.status)
+		if _, err := w.Write(body); err != nil {
+			logging.Errorf("Failed to write response: %v", err)
+		}
+	}
+}
@@ -17,10 +17,20 @@ package healthcheck
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
@@ -30,91 +40,814 @@ const (
 	startupPath   = "/startup"
 	livenessPath  = "/liveness"
 	readinessPath = "/readiness"
+	eventsPath    = "/events"
+	healthzPath   = "/healthz"
+
+	// retryAfterSeconds is the Retry-After header value of failed readiness
+	// responses.
+	retryAfterSeconds = "1"
+
+	// defaultReadinessTimeout is how long evaluating readiness may take by
+	// default before the proxy is reported not ready.
+	defaultReadinessTimeout = 10 * time.Second
+
+	// cachedReadinessHeader, when set to "true" on a readiness request, makes
+	// the response reflect the most recent readiness evaluation instead of
+	// evaluating readiness again.
+	cachedReadinessHeader = "X-Readiness-Cached"
+
+	// maxCertChainErrorsListed is how many instances with an invalid client
+	// certificate the readiness failure reason names.
+	maxCertChainErrorsListed = 5
 )
 
+// processStart approximates when the proxy process started.
+var processStart = time.Now()
+
 // Server is a type used to implement health checks for the proxy.
 type Server struct {
+	// readinessFailures and livenessFailures count the failed readiness and
+	// liveness checks. They are accessed atomically, so they come first to
+	// keep them 64-bit aligned.
+	readinessFailures uint64
+	livenessFailures  uint64
+
+	// client is the proxy client whose health is reported.
+	client *proxy.Client
 	// started is used to indicate whether the proxy has finished starting up.
 	// If started is open, startup has not finished. If started is closed,
 	// startup is complete.
 	started chan struct{}
+	// startedAt is when started was closed. It is only read once started is
+	// closed.
+	startedAt time.Time
+	// startup is the progress of initializing instances before started is
+	// closed.
+	startup startupProgress
 	// once ensures that started can only be closed once.
 	once *sync.Once
-	// port designates the port number on which Server listens and serves.
-	port string
+	// drainingL protects draining, which is set by NotifyDraining once the
+	// proxy has been asked to shut down.
+	drainingL sync.Mutex
+	draining  bool
+	// mux routes requests to the health check endpoints. It is shared by
+	// every HTTP server the Server starts so that Restart preserves the
+	// endpoints and their state.
+	mux *http.ServeMux
+	// srvL protects srv and ln.
+	srvL sync.Mutex
 	// srv is a pointer to the HTTP server used to communicate proxy health.
 	srv *http.Server
+	// ln is the listener srv serves on.
+	ln net.Listener
+	// errc receives the first error an HTTP server fails to serve with.
+	errc chan error
+	// closing is closed, once, guarded by closingOnce, when Close is first
+	// called.
+	closing     chan struct{}
+	closingOnce sync.Once
+	// drain holds the steps run by Close to stop serving, in order.
+	drain []func(context.Context) error
+	// shutdown holds the steps run by Close to release resources once the
+	// Server has drained, in order. Every step is run even if an earlier one
+	// fails.
+	shutdown []func(context.Context) error
+	// deregisterer removes the proxy from service discovery once, guarded by
+	// deregisterOnce, when Close starts draining.
+	deregisterer   Deregisterer
+	deregisterOnce sync.Once
+	// hooksL protects hooks.
+	hooksL sync.Mutex
+	// hooks holds the registered shutdown hooks, indexed by phase.
+	hooks [numShutdownPhases][]func(context.Context) error
+	// backlog is the length of the listener's pending connection queue. If
+	// zero, the operating system default is used.
+	backlog int
+	// logSampleRate is the fraction of readiness failures for which detailed
+	// state is logged in addition to the failure reason.
+	logSampleRate float64
+	// sample returns a pseudo-random number in [0.0, 1.0) used to decide
+	// whether a readiness failure is logged in detail.
+	sample func() float64
+	// readinessLogInterval, if set, is the minimum time between logs of
+	// readiness failing for the same reason. readinessLogL protects
+	// loggedReason and loggedAt, the last logged reason and when, and
+	// suppressed, the number of failures not logged since.
+	readinessLogInterval time.Duration
+	readinessLogL        sync.Mutex
+	loggedReason         string
+	loggedAt             time.Time
+	suppressed           int
+	// dependencyCfg configures the optional readiness check against an
+	// external HTTP dependency.
+	dependencyCfg *DependencyCheck
+	// dependency checks the external HTTP dependency. It is nil unless
+	// dependencyCfg is set.
+	dependency *dependencyChecker
+	// tlsCfg is the TLS configuration provided with WithTLSConfig. If nil, the
+	// endpoints are served over plain HTTP, unless certFile and keyFile or
+	// selfSigned are set.
+	tlsCfg *tls.Config
+	// certFile and keyFile are the PEM encoded certificate and key provided
+	// with WithTLSFiles.
+	certFile, keyFile string
+	// selfSigned, if set, serves the endpoints over HTTPS with a generated
+	// self-signed certificate unless one is provided.
+	selfSigned bool
+	// clientCAs verifies client certificates, if set.
+	clientCAs *x509.CertPool
+	// requireClientCert is true if clients must present a certificate signed
+	// by clientCAs.
+	requireClientCert bool
+	// minTLSVersion and cipherSuites, if set, override the minimum TLS
+	// version and the cipher suites the endpoints are served with.
+	minTLSVersion uint16
+	cipherSuites  []uint16
+	// tlsConfig is the TLS configuration the endpoints are served with, built
+	// from tlsCfg, clientCAs and requireClientCert.
+	tlsConfig *tls.Config
+	// metrics is true if the metrics endpoint is served.
+	metrics bool
+	// debug is true if the pprof endpoints are served.
+	debug bool
+	// metricLabelsCfg holds the labels added to every exported metric, as
+	// configured.
+	metricLabelsCfg map[string]string
+	// metricLabels holds the validated metricLabelsCfg, sorted by name.
+	metricLabels []label
+	// maxChurnRate is the connection churn rate, per second, above which the
+	// proxy is not ready. If zero, churn does not affect readiness.
+	maxChurnRate float64
+	// maxRateLimited is the number of rate limited Cloud SQL Admin API calls
+	// in the last minute at which the proxy is not ready. If zero, API usage
+	// does not affect readiness.
+	maxRateLimited uint64
+	// minSuccessRatio is the connection success ratio below which the proxy
+	// is not ready. If zero, the success ratio does not affect readiness.
+	minSuccessRatio float64
+	// gzipThreshold is the size, in bytes, from which /status, /metrics and
+	// /events response bodies are compressed for clients accepting gzip.
+	gzipThreshold int
+	// maintenanceSpec is the schedule of maintenance windows, parsed into
+	// maintenance, during which the proxy is not ready.
+	maintenanceSpec string
+	maintenance     []maintenanceWindow
+	// statusVersion tracks when the status served on /status last changed.
+	statusVersion statusVersion
+	// now returns the current time. It is replaced in tests.
+	now func() time.Time
+	// created is when the Server was created.
+	created time.Time
+	// onStarted, if set, is called once startup finishes with how long it
+	// took since created.
+	onStarted func(startup time.Duration)
+	// readyConnsThreshold, if set, is the fraction of MaxConnections at which
+	// the proxy is no longer ready.
+	readyConnsThreshold float64
+	// softStart is how long after startup finishes the MaxConnections
+	// readiness check only logs rather than failing.
+	softStart time.Duration
+	// dnsTTL is how long the health checks' dialer reuses the addresses a
+	// hostname resolved to, with resolve, in dnsCache. If zero, hostnames
+	// are resolved by the default dialer on every connection.
+	dnsTTL   time.Duration
+	resolve  func(ctx context.Context, host string) ([]string, error)
+	dnsCache dnsCache
+	// minUptime is how long after processStart the proxy becomes ready, even
+	// if it has finished starting up.
+	minUptime time.Duration
+	// readinessGrace, if set, is how long after startup finishes the proxy
+	// stays not ready unless an instance is dialed successfully first.
+	// graceOver is set to 1, atomically, once the grace period has ended.
+	readinessGrace time.Duration
+	graceOver      int32
+	// probeTargets are the instances that must be reachable with probe for
+	// the proxy to be ready. They are probed probeConcurrency at a time, with
+	// probeTimeout to probe all of them.
+	probeTargets     []string
+	probe            probeFunc
+	probeConcurrency int
+	probeTimeout     time.Duration
+	// instancePolicy determines how many probeTargets must be reachable.
+	// probeResults holds the result of each target's most recent probe.
+	instancePolicy InstancePolicy
+	probeResults   probeResults
+	// readinessTimeout is how long evaluating readiness may take before the
+	// proxy is reported not ready.
+	readinessTimeout time.Duration
+	// connChecks are the checks each instance must pass, over connections
+	// made with dial, for the proxy to be ready. If batchChecks is true, the
+	// checks of an instance share a single connection per evaluation.
+	connChecks  map[string][]ConnCheck
+	batchChecks bool
+	dial        func(ctx context.Context, instance string) (net.Conn, error)
+	// live reports whether the proxy is live. It is replaced in tests.
+	live func() bool
+	// maxInactivity, if set, is how long the proxy may go without activity
+	// while connections are open before it is not live.
+	maxInactivity time.Duration
+	// maxRefresh, if set, is how long a certificate refresh may be in
+	// progress before the proxy is not live.
+	maxRefresh time.Duration
+	// requiredEnv are the environment variables that must be set and
+	// non-empty, as read with getenv, for the proxy to be ready.
+	requiredEnv []string
+	getenv      func(string) string
+	// logBuffer, if set, is the buffered log sink the proxy is not ready
+	// while saturated.
+	logBuffer *logging.BufferedWriter
+	// credentialsCheck is true if the proxy is not ready while its
+	// credentials fail proxy.Client.CheckCredentials.
+	credentialsCheck bool
+	// certChainCheck is true if the proxy is not ready while the client
+	// certificate of any instance fails proxy.Client.CertChainErrors.
+	certChainCheck bool
+	// certExpiryCheck is true if the proxy is not ready while the client
+	// certificate of any instance has expired. A warning is logged, once per
+	// certificate tracked in certExpiry, when one expires within
+	// certExpiryWarning.
+	certExpiryCheck   bool
+	certExpiryWarning time.Duration
+	certExpiry        certExpiry
+	// minCertValidity is how long the client certificate of each instance
+	// must remain valid for the proxy to be ready, if certExpiryCheck is set.
+	minCertValidity time.Duration
+	// quit, if set, is called once, guarded by quitOnce, when a POST request
+	// is made to quitPath.
+	quit     func()
+	quitOnce sync.Once
+	// quitToken, if set, is the bearer token requests to quitPath must carry.
+	quitToken string
+	// faultsToken, if set, enables injecting faults on faultsPath with
+	// requests bearing it. faults holds the injected faults.
+	faultsToken string
+	faults      faults
+	// authUser and authPassword, if authSet, are the credentials required on
+	// every endpoint but the probes, held hashed by auth.
+	authUser, authPassword string
+	authSet                bool
+	auth                   *basicAuth
+	// token, if set, is the bearer token required on every endpoint,
+	// including the probes.
+	token string
+	// version and commit identify the build of the proxy served on
+	// versionPath.
+	version, commit string
+	// accessLog, if set, logs every request to the health check endpoints.
+	accessLog bool
+	// checks are the custom checks registered with the Server, of which
+	// there may be at most maxChecks. Each may run for up to checkTimeout.
+	checks       customChecks
+	maxChecks    int
+	checkTimeout time.Duration
+	// healthzPaths are the paths of the combined liveness and readiness
+	// endpoint. If empty, it is not served.
+	healthzPaths []string
+	// healthzFailure is the status code healthzPaths respond with while the
+	// proxy is not healthy. healthzOKBody and healthzFailureBody, if set,
+	// replace the bodies they respond with.
+	healthzFailure                    int
+	healthzOKBody, healthzFailureBody string
+	// readinessFailure is the status code readinessPath responds with while
+	// the proxy, or the instance queried, is not ready.
+	readinessFailure int
+	// livenessPath and readinessPath are the paths of the liveness and
+	// readiness endpoints.
+	livenessPath  string
+	readinessPath string
+
+	// network is the network the health check endpoints are served on,
+	// "tcp" or "unix". For "unix", the port passed to NewServer is the path of
+	// the socket.
+	network string
+	// host is the interface the TCP endpoints are bound to, or empty for all
+	// of them.
+	host string
+
+	// pipePath is the Windows named pipe the health check endpoints are also
+	// served on, by pipeSrv, if set.
+	pipePath string
+
+	// grpcPort, if set, is the port the gRPC Health Checking Protocol is
+	// served on.
+	grpcPort string
+	pipeSrv  *http.Server
+
+	// serving is closed, by BeginServing, once the HTTP server may start
+	// serving requests on its bound listener.
+	serving     chan struct{}
+	servingOnce sync.Once
+	// deferServing is true if serving is only closed by BeginServing.
+	deferServing bool
+
+	// pushCfg configures pushing metrics, if set, done by pusher. If
+	// pushReadiness is true, the proxy is not ready while pushes fail.
+	pushCfg       *MetricsPush
+	pusher        *metricsPusher
+	pushReadiness bool
+
+	// reloading is the number of configuration reloads in progress, accessed
+	// atomically.
+	reloading int32
+
+	// lastReadyL protects evaluated, lastReason, liveEvaluated and
+	// lastNotLive.
+	lastReadyL sync.Mutex
+	// evaluated is whether readiness has been evaluated. lastReason is why
+	// the most recent evaluation failed, or empty if it passed.
+	evaluated  bool
+	lastReason string
+	// liveEvaluated and lastNotLive are the same for liveness.
+	liveEvaluated bool
+	lastNotLive   string
 }
 
 // NewServer initializes a Server and exposes HTTP endpoints used to
-// communicate proxy health.
-func NewServer(c *proxy.Client, port string) (*Server, error) {
+// communicate proxy health. port is either a port, which is bound on all
+// interfaces unless WithHost is used, or a full "host:port" address; IPv6 hosts
+// must be enclosed in brackets, as in "[::1]:8090". If WithNetwork("unix") is
+// used, port is instead the path of the Unix domain socket the endpoints are
+// served on.
+func NewServer(c *proxy.Client, port string, opts ...Option) (*Server, error) {
 	mux := http.NewServeMux()
 
-	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
-	}
-
 	hcServer := &Server{
-		started: make(chan struct{}),
-		once:    &sync.Once{},
-		port:    port,
-		srv:     srv,
+		client:        c,
+		started:       make(chan struct{}),
+		serving:       make(chan struct{}),
+		errc:          make(chan error, 1),
+		closing:       make(chan struct{}),
+		once:          &sync.Once{},
+		mux:           mux,
+		logSampleRate: 1,
+		sample:        rand.Float64,
+		gzipThreshold: defaultGzipThreshold,
+		now:           time.Now,
+		created:       time.Now(),
+
+		probeConcurrency: defaultProbeConcurrency,
+		probeTimeout:     defaultProbeTimeout,
+		readinessTimeout: defaultReadinessTimeout,
+		instancePolicy:   AnyInstancePolicy,
+		livenessPath:     livenessPath,
+		readinessPath:    readinessPath,
+		healthzFailure:   http.StatusServiceUnavailable,
+		readinessFailure: http.StatusServiceUnavailable,
+		live:             isLive,
+		getenv:           os.Getenv,
+		maxChecks:        DefaultMaxChecks,
+		checkTimeout:     defaultCheckTimeout,
+		network:          "tcp",
+		deregisterer:     noopDeregisterer{},
+		dial:             c.DialContext,
+		resolve:          net.DefaultResolver.LookupHost,
+	}
+	hcServer.probe = hcServer.checkInstance
+	hcServer.drain = append(hcServer.drain, func(ctx context.Context) error {
+		srv, ln := hcServer.httpServer()
+		err := shutdownHTTP(ctx, srv, ln)
+		// Release a serving goroutine still waiting for BeginServing; as the
+		// server is shut down, it returns straight away.
+		hcServer.BeginServing()
+		return err
+	})
+	for _, o := range opts {
+		o(hcServer)
+	}
+	if !hcServer.deferServing {
+		hcServer.BeginServing()
+	}
+	if hcServer.backlog < 0 {
+		return nil, fmt.Errorf("invalid listener backlog %d", hcServer.backlog)
+	}
+	if hcServer.readinessLogInterval < 0 {
+		return nil, fmt.Errorf("invalid readiness log interval %v", hcServer.readinessLogInterval)
+	}
+	if hcServer.logSampleRate < 0 || hcServer.logSampleRate > 1 {
+		return nil, fmt.Errorf("invalid readiness log sample rate %v: must be between 0 and 1", hcServer.logSampleRate)
+	}
+	if hcServer.dnsTTL < 0 {
+		return nil, fmt.Errorf("invalid DNS cache TTL %v", hcServer.dnsTTL)
+	}
+	if hcServer.dependencyCfg != nil {
+		cfg := *hcServer.dependencyCfg
+		if cfg.Client == nil && hcServer.dnsTTL > 0 {
+			cfg.Client = hcServer.cachedDNSClient()
+		}
+		d, err := newDependencyChecker(cfg)
+		if err != nil {
+			return nil, err
+		}
+		hcServer.dependency = d
+	}
+	labels, err := newLabels(hcServer.metricLabelsCfg)
+	if err != nil {
+		return nil, err
+	}
+	hcServer.metricLabels = labels
+	if hcServer.pushCfg != nil {
+		collect := func() []metric { return hcServer.collectMetrics(c) }
+		p, err := newMetricsPusher(*hcServer.pushCfg, collect, labels)
+		if err != nil {
+			return nil, err
+		}
+		hcServer.pusher = p
+	} else if hcServer.pushReadiness {
+		return nil, errors.New("metrics export readiness requires metrics push to be enabled")
+	}
+	tlsConfig, err := hcServer.serverTLSConfig()
+	if err != nil {
+		return nil, err
 	}
+	hcServer.tlsConfig = tlsConfig
+	if hcServer.maxChurnRate < 0 {
+		return nil, fmt.Errorf("invalid maximum churn rate %v", hcServer.maxChurnRate)
+	}
+	if hcServer.readyConnsThreshold < 0 || hcServer.readyConnsThreshold > 1 {
+		return nil, fmt.Errorf("invalid connections readiness threshold %v: must be between 0 and 1", hcServer.readyConnsThreshold)
+	}
+	if hcServer.minSuccessRatio < 0 || hcServer.minSuccessRatio > 1 {
+		return nil, fmt.Errorf("invalid minimum success ratio %v: must be between 0 and 1", hcServer.minSuccessRatio)
+	}
+	if hcServer.maxChecks < 0 {
+		return nil, fmt.Errorf("invalid maximum number of checks %d", hcServer.maxChecks)
+	}
+	if hcServer.softStart < 0 {
+		return nil, fmt.Errorf("invalid soft start window %v", hcServer.softStart)
+	}
+	if hcServer.maxInactivity < 0 {
+		return nil, fmt.Errorf("invalid maximum inactivity %v", hcServer.maxInactivity)
+	}
+	if hcServer.maxRefresh < 0 {
+		return nil, fmt.Errorf("invalid maximum refresh duration %v", hcServer.maxRefresh)
+	}
+	if hcServer.certExpiryWarning < 0 {
+		return nil, fmt.Errorf("invalid certificate expiry warning threshold %v", hcServer.certExpiryWarning)
+	}
+	if hcServer.minCertValidity < 0 {
+		return nil, fmt.Errorf("invalid minimum certificate validity %v", hcServer.minCertValidity)
+	}
+	if hcServer.minUptime < 0 {
+		return nil, fmt.Errorf("invalid minimum uptime %v", hcServer.minUptime)
+	}
+	if hcServer.readinessGrace < 0 {
+		return nil, fmt.Errorf("invalid readiness grace period %v", hcServer.readinessGrace)
+	}
+	if hcServer.authSet {
+		if hcServer.authPassword == "" {
+			return nil, errors.New("invalid basic auth credentials: password must not be empty")
+		}
+		hcServer.auth = newBasicAuth(hcServer.authUser, hcServer.authPassword)
+	}
+	if hcServer.token != "" && hcServer.authSet {
+		return nil, errors.New("a bearer token and basic auth cannot both be required")
+	}
+	if hcServer.quitToken != "" && hcServer.quit == nil {
+		return nil, errors.New("a quit token requires the quit handler to be enabled")
+	}
+	if hcServer.network != "tcp" && hcServer.network != "unix" {
+		return nil, fmt.Errorf("invalid network %q: must be tcp or unix", hcServer.network)
+	}
+	if hcServer.network == "unix" && hcServer.host != "" {
+		return nil, fmt.Errorf("invalid host %q: cannot be set with network unix", hcServer.host)
+	}
+	addr := port
+	if hcServer.network == "tcp" {
+		if addr, err = listenAddr(hcServer.host, port); err != nil {
+			return nil, err
+		}
+	}
+	if hcServer.gzipThreshold < 0 {
+		return nil, fmt.Errorf("invalid gzip threshold %d", hcServer.gzipThreshold)
+	}
+	if hcServer.probeConcurrency < 1 {
+		return nil, fmt.Errorf("invalid probe concurrency %d", hcServer.probeConcurrency)
+	}
+	if hcServer.probeTimeout <= 0 {
+		return nil, fmt.Errorf("invalid probe timeout %v", hcServer.probeTimeout)
+	}
+	if hcServer.instancePolicy != AllInstancesPolicy && hcServer.instancePolicy != AnyInstancePolicy {
+		return nil, fmt.Errorf("invalid instance policy %q: must be %q or %q", hcServer.instancePolicy, AllInstancesPolicy, AnyInstancePolicy)
+	}
+	if hcServer.readinessTimeout <= 0 {
+		return nil, fmt.Errorf("invalid readiness timeout %v", hcServer.readinessTimeout)
+	}
+	for _, name := range hcServer.requiredEnv {
+		if name == "" {
+			return nil, errors.New("invalid empty required environment variable name")
+		}
+	}
+	if hcServer.healthzFailure < 400 || hcServer.healthzFailure > 599 {
+		return nil, fmt.Errorf("invalid healthz failure status code %d: must be 4xx or 5xx", hcServer.healthzFailure)
+	}
+	if hcServer.readinessFailure < 400 || hcServer.readinessFailure > 599 {
+		return nil, fmt.Errorf("invalid readiness failure status code %d: must be 4xx or 5xx", hcServer.readinessFailure)
+	}
+	if err := hcServer.validatePaths(); err != nil {
+		return nil, err
+	}
+	hcServer.probeTargets = withCheckedInstances(hcServer.probeTargets, hcServer.connChecks)
+	windows, err := parseMaintenanceSchedule(hcServer.maintenanceSpec)
+	if err != nil {
+		return nil, err
+	}
+	hcServer.maintenance = windows
 
-	mux.HandleFunc(startupPath, func(w http.ResponseWriter, _ *http.Request) {
-		if !hcServer.proxyStarted() {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("error"))
+	mux.HandleFunc(startupPath, hcServer.startupHandler)
+
+	mux.HandleFunc(hcServer.readinessPath, hcServer.withInjectedLatency(func(w http.ResponseWriter, r *http.Request) {
+		if inst := r.URL.Query().Get("instance"); inst != "" {
+			hcServer.writeInstanceReadiness(w, r, c, inst)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ok"))
-	})
+		reason, ok := "", false
+		if r.Header.Get(cachedReadinessHeader) == "true" {
+			reason, ok = hcServer.cachedReadiness()
+		}
+		if !ok {
+			reason = notReadyBecause(r.Context(), c, hcServer)
+		}
+		hcServer.writeReadiness(w, r, c, reason)
+	}))
 
-	mux.HandleFunc(readinessPath, func(w http.ResponseWriter, _ *http.Request) {
-		if !isReady(c, hcServer) {
+	mux.HandleFunc(hcServer.livenessPath, hcServer.withInjectedLatency(func(w http.ResponseWriter, r *http.Request) {
+		if reason := hcServer.evaluateLiveness(); reason != "" {
+			hcServer.logLivenessFailure(r.Context(), reason)
 			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("error"))
+			w.Write([]byte("error: " + reason))
 			return
 		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ok"))
-	})
+	}))
 
-	mux.HandleFunc(livenessPath, func(w http.ResponseWriter, _ *http.Request) {
-		if !isLive() { // Because isLive() always returns true, this case should not be reached.
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("error"))
-			return
+	for _, p := range hcServer.healthzPaths {
+		mux.HandleFunc(p, hcServer.withInjectedLatency(hcServer.healthzHandler(c)))
+	}
+
+	if hcServer.faultsToken != "" {
+		mux.HandleFunc(faultsPath, hcServer.faultsHandler)
+	}
+
+	if hcServer.quit != nil {
+		mux.HandleFunc(quitPath, hcServer.quitHandler)
+	}
+
+	mux.HandleFunc(eventsPath, gzipHandler(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.ConnEvents()); err != nil {
+			logging.Errorf("Failed to write connection events: %v", err)
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ok"))
-	})
+	}, hcServer.gzipThreshold))
+
+	mux.HandleFunc(statusPath, gzipHandler(hcServer.statusHandler(c), hcServer.gzipThreshold))
 
-	ln, err := net.Listen("tcp", srv.Addr)
+	mux.HandleFunc(checksPath, hcServer.checksHandler)
+
+	mux.HandleFunc(connectionsPath, connectionsHandler(c))
+
+	mux.HandleFunc(versionPath, hcServer.versionHandler)
+
+	if hcServer.metrics {
+		mux.HandleFunc(metricsPath, gzipHandler(hcServer.metricsHandler(c), hcServer.gzipThreshold))
+	}
+
+	if hcServer.debug {
+		hcServer.handleDebug(mux)
+	}
+
+	mux.HandleFunc("/", notFoundHandler)
+
+	srv, ln, err := hcServer.listenAndServe(addr)
 	if err != nil {
 		return nil, err
 	}
+	hcServer.srv, hcServer.ln = srv, ln
 
+	if hcServer.pipePath != "" {
+		pln, err := listenPipe(hcServer.pipePath)
+		if err != nil {
+			shutdownHTTP(context.Background(), srv, ln)
+			// Release the serving goroutine, as Close does.
+			hcServer.BeginServing()
+			return nil, err
+		}
+		hcServer.pipeSrv = hcServer.serve(pln)
+		hcServer.drain = append(hcServer.drain, func(ctx context.Context) error {
+			return shutdownHTTP(ctx, hcServer.pipeSrv, pln)
+		})
+	}
+
+	if hcServer.grpcPort != "" {
+		if err := hcServer.listenGRPC(c, hcServer.grpcPort); err != nil {
+			for _, step := range hcServer.drain {
+				step(context.Background())
+			}
+			return nil, err
+		}
+	}
+
+	if hcServer.pusher != nil {
+		hcServer.pusher.start(hcServer)
+	}
+
+	return hcServer, nil
+}
+
+// NewServerWithContext is like NewServer, but the Server is also closed once
+// ctx is done, unless Close has been called first, so that its lifetime can
+// be tied to the rest of the program's.
+func NewServerWithContext(ctx context.Context, c *proxy.Client, port string, opts ...Option) (*Server, error) {
+	s, err := NewServer(c, port, opts...)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := s.Close(context.Background()); err != nil {
+				logging.Errorf("Failed to close health check server: %v", err)
+			}
+		case <-s.closing:
+		}
+	}()
+	return s, nil
+}
+
+// validatePaths returns an error unless the probe endpoints' paths are
+// absolute and distinct from each other and the other endpoints.
+func (s *Server) validatePaths() error {
+	seen := map[string]bool{}
+	for _, p := range []string{eventsPath, statusPath, checksPath, connectionsPath, versionPath, metricsPath, faultsPath, quitPath, debugPath} {
+		seen[p] = true
+	}
+	paths := append([]string{startupPath, s.livenessPath, s.readinessPath}, s.healthzPaths...)
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("invalid endpoint path %q: must start with /", p)
+		}
+		if seen[p] {
+			return fmt.Errorf("invalid endpoint path %q: used by more than one endpoint", p)
+		}
+		seen[p] = true
+	}
+	return nil
+}
+
+// listenAndServe binds addr on s.network and serves the health check endpoints
+// on it from a new goroutine, once BeginServing has been called. A stale Unix
+// domain socket at addr is removed first. The socket is removed again when the
+// listener is closed.
+func (s *Server) listenAndServe(addr string) (*http.Server, net.Listener, error) {
+	if s.network == "unix" {
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, nil, err
+		}
+	}
+	ln, err := net.Listen(s.network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.backlog > 0 {
+		if err := setBacklog(ln, s.backlog); err != nil {
+			ln.Close()
+			return nil, nil, err
+		}
+	}
+	if s.tlsConfig != nil {
+		ln = tls.NewListener(ln, s.tlsConfig)
+	}
+	return s.serve(ln), ln, nil
+}
+
+// serve serves the health check endpoints on ln from a new goroutine, once
+// BeginServing has been called.
+func (s *Server) serve(ln net.Listener) *http.Server {
+	srv := &http.Server{
+		Addr:    ln.Addr().String(),
+		Handler: requestIDHandler(s.withAccessLog(s.withTokenAuth(s.withBasicAuth(s.mux)))),
+	}
 	go func() {
+		<-s.serving
 		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logging.Errorf("Failed to start health check HTTP server: %v", err)
+			select {
+			case s.errc <- err:
+			default:
+			}
 		}
 	}()
+	return srv
+}
 
-	return hcServer, nil
+// shutdownHTTP gracefully shuts down srv, which serves on ln.
+func shutdownHTTP(ctx context.Context, srv *http.Server, ln net.Listener) error {
+	err := srv.Shutdown(ctx)
+	// Shutdown only closes the listener if the serving goroutine has started
+	// using it, so close it here to make sure the address is released.
+	if cerr := ln.Close(); err == nil && cerr != nil && !errors.Is(cerr, net.ErrClosed) {
+		err = cerr
+	}
+	return err
+}
+
+// httpServer returns the HTTP server currently serving the health check
+// endpoints and its listener.
+func (s *Server) httpServer() (*http.Server, net.Listener) {
+	s.srvL.Lock()
+	defer s.srvL.Unlock()
+	return s.srv, s.ln
+}
+
+// Addr returns the address the health check endpoints are served on. If the
+// Server was created with port "0", it has the port chosen by the operating
+// system.
+func (s *Server) Addr() net.Addr {
+	_, ln := s.httpServer()
+	return ln.Addr()
 }
 
-// Close gracefully shuts down the HTTP server belonging to the Server.
-func (s *Server) Close(ctx context.Context) error {
-	return s.srv.Shutdown(ctx)
+// Restart moves the health check endpoints to newAddr, keeping all other
+// state of the Server. The new address is bound before the current HTTP server
+// is shut down, so if newAddr cannot be bound an error is returned and the
+// Server continues serving on its current address. As a consequence, newAddr
+// must not be the address currently in use.
+func (s *Server) Restart(newAddr string) error {
+	srv, ln, err := s.listenAndServe(newAddr)
+	if err != nil {
+		return err
+	}
+
+	s.srvL.Lock()
+	oldSrv, oldLn := s.srv, s.ln
+	s.srv, s.ln = srv, ln
+	s.srvL.Unlock()
+
+	return shutdownHTTP(context.Background(), oldSrv, oldLn)
 }
 
-// NotifyStarted tells the Server that the proxy has finished startup.
+// Err returns a channel that receives the error an HTTP server serving the
+// health check endpoints failed with, if any. Only the first such error is
+// sent. Errors from shutting the server down with Close or Restart are not
+// sent.
+func (s *Server) Err() <-chan error {
+	return s.errc
+}
+
+// BeginServing starts serving the health check endpoints if the Server was
+// created with WithDeferredServing. Otherwise, it has no effect.
+func (s *Server) BeginServing() {
+	s.servingOnce.Do(func() { close(s.serving) })
+}
+
+// NotifyStarted tells the Server that the proxy has finished startup. The
+// first call logs a ReadyEvent.
 func (s *Server) NotifyStarted() {
-	s.once.Do(func() { close(s.started) })
+	s.once.Do(func() {
+		s.startedAt = s.now()
+		close(s.started)
+		s.logReadyEvent()
+		if s.onStarted != nil {
+			s.onStarted(s.startedAt.Sub(s.created))
+		}
+	})
+}
+
+// NotifyDraining tells the Server that the proxy is shutting down, so that it
+// reports itself as not ready and load balancers stop sending it new
+// connections while in-flight ones complete.
+func (s *Server) NotifyDraining() {
+	s.drainingL.Lock()
+	defer s.drainingL.Unlock()
+	if !s.draining {
+		logging.Infof("Proxy is draining; reporting not ready")
+	}
+	s.draining = true
+}
+
+// proxyDraining returns true if NotifyDraining has been called.
+func (s *Server) proxyDraining() bool {
+	s.drainingL.Lock()
+	defer s.drainingL.Unlock()
+	return s.draining
+}
+
+// proxyClosing reports whether Close has been called.
+func (s *Server) proxyClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reload runs reload, reporting the proxy as not ready until it returns. It
+// returns the error from reload.
+func (s *Server) Reload(reload func() error) error {
+	atomic.AddInt32(&s.reloading, 1)
+	defer atomic.AddInt32(&s.reloading, -1)
+	return reload()
 }
 
 // proxyStarted returns true if started is closed, false otherwise.
@@ -132,22 +865,431 @@ func isLive() bool {
 	return true
 }
 
-// isReady will check the following criteria before determining whether the
-// proxy is ready for new connections.
-// 1. Finished starting up / been sent the 'Ready for Connections' log.
-// 2. Not yet hit the MaxConnections limit, if applicable.
-func isReady(c *proxy.Client, s *Server) bool {
+// healthzHandler responds with http.StatusOK only if the proxy is both live
+// and ready, and otherwise with s.healthzFailure and the reason it is not.
+func (s *Server) healthzHandler(c *proxy.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reason := s.evaluateLiveness()
+		if reason != "" {
+			s.logLivenessFailure(r.Context(), reason)
+		} else if reason = s.evaluateReadiness(r.Context(), c); reason != "" {
+			s.logReadinessFailure(r.Context(), c, reason)
+		}
+		if reason != "" {
+			body := s.healthzFailureBody
+			if body == "" {
+				body = "error: " + reason
+			}
+			w.WriteHeader(s.healthzFailure)
+			w.Write([]byte(body))
+			return
+		}
+		body := s.healthzOKBody
+		if body == "" {
+			body = "ok"
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(body))
+	}
+}
+
+// notFoundHandler responds to requests for unknown paths, typically from
+// scanners probing for /favicon.ico and the like, with a minimal
+// http.StatusNotFound. They are only logged verbosely.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	logging.Verbosef("Health check request for unknown path %q%s", r.URL.Path, requestIDSuffix(r.Context()))
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte("not found"))
+}
+
+// notReadyBecause returns why the proxy is not ready for new connections,
+// logging it, or an empty string if it is ready.
+func notReadyBecause(ctx context.Context, c *proxy.Client, s *Server) string {
+	reason := s.evaluateReadiness(ctx, c)
+	if reason != "" {
+		s.logReadinessFailure(ctx, c, reason)
+	}
+	return reason
+}
+
+// evaluateReadiness returns why the proxy is not ready, or an empty string if
+// it is, and caches the result for cachedReadiness. If readiness cannot be
+// evaluated within readinessTimeout, or before ctx is done, the proxy is
+// reported not ready without waiting for the checks still running.
+func (s *Server) evaluateReadiness(ctx context.Context, c *proxy.Client) string {
+	reason := s.withReadinessTimeout(ctx, func(ctx context.Context) string {
+		return notReadyReason(ctx, c, s)
+	})
+	s.lastReadyL.Lock()
+	s.evaluated, s.lastReason = true, reason
+	s.lastReadyL.Unlock()
+	return reason
+}
+
+// withReadinessTimeout returns the result of eval, which is given a context
+// ending after readinessTimeout, or why it did not return in time or before
+// ctx was done.
+func (s *Server) withReadinessTimeout(ctx context.Context, eval func(context.Context) string) string {
+	ctx, cancel := context.WithTimeout(ctx, s.readinessTimeout)
+	defer cancel()
+	reasonc := make(chan string, 1)
+	go func() { reasonc <- eval(ctx) }()
+	select {
+	case reason := <-reasonc:
+		return reason
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Sprintf("readiness checks timed out after %v", s.readinessTimeout)
+		}
+		return fmt.Sprintf("readiness checks canceled: %v", ctx.Err())
+	}
+}
+
+// certChainReason describes the cert chain errors of insts, sorted instances
+// with an entry in errs, naming at most maxCertChainErrorsListed of them.
+func certChainReason(insts []string, errs map[string]error) string {
+	listed := insts
+	if len(listed) > maxCertChainErrorsListed {
+		listed = listed[:maxCertChainErrorsListed]
+	}
+	descs := make([]string, len(listed))
+	for i, inst := range listed {
+		descs[i] = fmt.Sprintf("%q: %v", inst, errs[inst])
+	}
+	reason := "invalid cert chain for instance " + strings.Join(descs, "; ")
+	if len(insts) > 1 {
+		reason = "invalid cert chain for instances " + strings.Join(descs, "; ")
+	}
+	if more := len(insts) - len(listed); more > 0 {
+		reason += fmt.Sprintf(" and %d more", more)
+	}
+	return reason
+}
+
+// cachedReadiness returns why the most recent readiness evaluation failed, or
+// an empty string if it passed. ok is false if readiness has not been
+// evaluated yet.
+func (s *Server) cachedReadiness() (reason string, ok bool) {
+	s.lastReadyL.Lock()
+	defer s.lastReadyL.Unlock()
+	return s.lastReason, s.evaluated
+}
+
+// evaluateLiveness returns why the proxy is not live, or an empty string if it
+// is, and caches the result for cachedLiveness.
+func (s *Server) evaluateLiveness() string {
+	reason := s.notLiveReason()
+	s.lastReadyL.Lock()
+	s.liveEvaluated, s.lastNotLive = true, reason
+	s.lastReadyL.Unlock()
+	return reason
+}
+
+// cachedLiveness returns why the most recent liveness evaluation failed, or an
+// empty string if it passed. ok is false if liveness has not been evaluated
+// yet.
+func (s *Server) cachedLiveness() (reason string, ok bool) {
+	s.lastReadyL.Lock()
+	defer s.lastReadyL.Unlock()
+	return s.lastNotLive, s.liveEvaluated
+}
+
+// connLimitReason returns which connection limit c has reached, or the
+// readiness threshold below MaxConnections, or an empty string if none.
+func (s *Server) connLimitReason(c *proxy.Client) string {
+	if !c.AvailableConn() {
+		return fmt.Sprintf("proxy has reached the maximum connections limit (%d)", c.MaxConnectionsLimit())
+	}
+	if max := c.MaxConnectionsLimit(); max > 0 && s.readyConnsThreshold > 0 {
+		open := atomic.LoadUint64(&c.ConnectionsCounter)
+		if float64(open) >= s.readyConnsThreshold*float64(max) {
+			return fmt.Sprintf("proxy has %d open connections, at or above %.4g%% of the maximum connections limit (%d)",
+				open, s.readyConnsThreshold*100, max)
+		}
+	}
+	insts := make([]string, 0, len(c.MaxConnectionsPerInstance))
+	for inst := range c.MaxConnectionsPerInstance {
+		insts = append(insts, inst)
+	}
+	sort.Strings(insts)
+	for _, inst := range insts {
+		if !c.AvailableConnFor(inst) {
+			return fmt.Sprintf("instance %q has reached its maximum connections limit (%d)", inst, c.MaxConnectionsPerInstance[inst])
+		}
+	}
+	return ""
+}
+
+// lifecycleReason returns why the proxy is not ready whatever the state of its
+// instances, as a readiness failure is injected or it has not finished
+// starting up or is shutting down or draining, or an empty string if none of
+// these hold.
+func (s *Server) lifecycleReason() string {
+	// Not ready while a readiness failure is injected for chaos testing.
+	if reason := s.injectedFault(readinessFault); reason != "" {
+		return reason
+	}
+
 	// Not ready until we reach the 'Ready for Connections' log
 	if !s.proxyStarted() {
-		logging.Errorf("Readiness failed because proxy has not finished starting up.")
-		return false
+		return "proxy has not finished starting up"
 	}
 
-	// Not ready if the proxy is at the optional MaxConnections limit.
-	if !c.AvailableConn() {
-		logging.Errorf("Readiness failed because proxy has reached the maximum connections limit (%d).", c.MaxConnections)
-		return false
+	// Not ready once Close has been called, so that probes made until the
+	// endpoints stop being served get an explicit failure.
+	if s.proxyClosing() {
+		return "proxy is shutting down"
 	}
 
-	return true
+	// Not ready once draining, so that new connections go elsewhere while
+	// in-flight ones complete.
+	if s.proxyDraining() {
+		return "proxy is draining"
+	}
+	return ""
+}
+
+// proxyReason returns why the proxy as a whole is not ready, checking the
+// conditions of lifecycleReason, then the minimum uptime, the grace period
+// after startup, the required environment variables, scheduled maintenance and
+// configuration reloads, or an empty string if none of these hold. Both
+// notReadyReason and instanceNotReadyReason check it first.
+func (s *Server) proxyReason(c *proxy.Client) string {
+	if reason := s.lifecycleReason(); reason != "" {
+		return reason
+	}
+
+	// Not ready until the process has been up for the optional minimum
+	// uptime, so that crash-looping pods are not briefly added to rotation.
+	if s.minUptime > 0 {
+		if up := s.now().Sub(processStart); up < s.minUptime {
+			return fmt.Sprintf("uptime (%v) is below the minimum (%v)", up.Round(time.Second), s.minUptime)
+		}
+	}
+
+	// Not ready within the optional grace period after startup until an
+	// instance has been dialed, as listeners are open before certificates
+	// have been fetched.
+	if reason := s.graceReason(c); reason != "" {
+		return reason
+	}
+
+	// Not ready if the deployment lacks any of the optional required
+	// environment variables.
+	for _, name := range s.requiredEnv {
+		if s.getenv(name) == "" {
+			return fmt.Sprintf("missing env var: %s", name)
+		}
+	}
+
+	// Not ready during scheduled maintenance.
+	if w, ok := s.inMaintenance(s.now()); ok {
+		return fmt.Sprintf("maintenance window %v is in progress", w)
+	}
+
+	// Not ready while a configuration reload is half applied.
+	if atomic.LoadInt32(&s.reloading) > 0 {
+		return "reloading"
+	}
+	return ""
+}
+
+// notReadyReason will check the following criteria before determining whether
+// the proxy is ready for new connections, returning why it is not or an empty
+// string if it is.
+// 1. No readiness failure is injected, if fault injection is enabled.
+// 2. Finished starting up / been sent the 'Ready for Connections' log.
+// 3. Not shutting down or draining.
+// 4. The process has been up for the minimum uptime, and the grace period after
+// startup has ended, if configured.
+// 5. The required environment variables are set, if configured.
+// 6. No scheduled maintenance window is in progress.
+// 7. No configuration reload is in progress.
+// 8. Not yet hit the MaxConnections limit, or the readiness threshold below
+// it, or any instance's limit in MaxConnectionsPerInstance, if applicable and
+// outside the soft start window.
+// 9. The external HTTP dependency is healthy, if configured.
+// 10. The connection churn rate is below the maximum, if configured.
+// 11. The Cloud SQL Admin API quota is not exhausted, if configured.
+// 12. The connection success ratio is above the minimum, if configured.
+// 13. The probed instances are reachable and pass their checks, if configured:
+// at least one of them, or all of them under AllInstancesPolicy.
+// 14. The most recent metrics push succeeded, if configured.
+// 15. The log buffer is not full, if configured.
+// 16. A valid access token can be obtained, if configured.
+// 17. The client certificates chain to their instance's CA, if configured.
+// 18. The client certificates have not expired, and remain valid for the
+// minimum validity, if configured.
+// 19. The registered readiness checks pass.
+// The first seven are checked by proxyReason. The probes and checks are given
+// ctx, which bounds how long they may run.
+func notReadyReason(ctx context.Context, c *proxy.Client, s *Server) string {
+	if reason := s.proxyReason(c); reason != "" {
+		return reason
+	}
+
+	// Not ready if the proxy is at the optional MaxConnections limit, or the
+	// readiness threshold below it, or any instance is at its own, unless
+	// startup finished within the soft start window, when bursts of
+	// connections are expected.
+	if reason := s.connLimitReason(c); reason != "" {
+		if s.softStart == 0 || s.now().Sub(s.startedAt) >= s.softStart {
+			return reason
+		}
+		logging.Infof("Ignoring during soft start that %s.", reason)
+	}
+
+	// Not ready if the optional external dependency is unhealthy.
+	if s.dependency != nil {
+		if err := s.dependency.check(ctx); err != nil {
+			return fmt.Sprintf("dependency unhealthy: %v", err)
+		}
+	}
+
+	// Not ready if connections are being closed shortly after being opened
+	// at a rate above the optional maximum.
+	if s.maxChurnRate > 0 {
+		if r := c.ChurnRate(); r > s.maxChurnRate {
+			return fmt.Sprintf("connection churn rate (%.2f/s) is above the maximum (%.2f/s)", r, s.maxChurnRate)
+		}
+	}
+
+	// Not ready if too many recent Admin API calls were rate limited, as
+	// certificate refreshes are likely to fail.
+	if s.maxRateLimited > 0 {
+		if calls, limited, ok := c.APIUsage(); ok && limited >= s.maxRateLimited {
+			return fmt.Sprintf("api quota low: %d of %d Cloud SQL Admin API calls in the last minute were rate limited", limited, calls)
+		}
+	}
+
+	// Not ready if too many recent connections failed to reach their
+	// instance.
+	if s.minSuccessRatio > 0 {
+		if r, attempts := c.SuccessRatio(); r < s.minSuccessRatio {
+			return fmt.Sprintf("connection success ratio (%.2f over %d attempts) is below the minimum (%.2f)", r, attempts, s.minSuccessRatio)
+		}
+	}
+
+	// Not ready if all of the probed instances, or any of them under
+	// AllInstancesPolicy, cannot be reached, naming each that failed.
+	if len(s.probeTargets) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, s.probeTimeout)
+		defer cancel()
+		errs := probeInstances(ctx, s.probeTargets, s.probeConcurrency, s.recordingProbe(s.probe))
+		var failed []string
+		for _, inst := range s.probeTargets {
+			if err, ok := errs[inst]; ok {
+				failed = append(failed, fmt.Sprintf("%q (%v)", inst, err))
+			}
+		}
+		if len(failed) > 0 && (s.instancePolicy == AllInstancesPolicy || len(failed) == len(s.probeTargets)) {
+			return "unreachable instances: " + strings.Join(failed, ", ")
+		}
+	}
+
+	// Not ready if metrics cannot be exported, for deployments that require
+	// the proxy to be observable.
+	if s.pushReadiness {
+		if err := s.pusher.lastErr(); err != nil {
+			return fmt.Sprintf("metrics export failing: %v", err)
+		}
+	}
+
+	// Not ready while logs are being dropped, for deployments that rely on
+	// them for auditing.
+	if s.logBuffer != nil && s.logBuffer.Saturated() {
+		return "log buffer full"
+	}
+
+	// Not ready if no access token can be obtained, as certificates cannot
+	// be refreshed once the current ones expire. Cert sources that cannot
+	// check their credentials are assumed to have them.
+	if s.credentialsCheck {
+		if err := c.CheckCredentials(ctx); err != nil && !errors.Is(err, proxy.ErrCredentialsCheckUnsupported) {
+			return fmt.Sprintf("credentials unavailable: %v", err)
+		}
+	}
+
+	// Not ready if the client certificate of any instance is invalid, such
+	// as one not signed by the instance's CA or revoked.
+	if s.certChainCheck {
+		if errs := c.CertChainErrors(); len(errs) > 0 {
+			insts := make([]string, 0, len(errs))
+			for inst := range errs {
+				insts = append(insts, inst)
+			}
+			sort.Strings(insts)
+			return certChainReason(insts, errs)
+		}
+	}
+
+	// Not ready if the client certificate of any instance has expired, as
+	// connections to it fail until it is rotated, or is about to expire.
+	if s.certExpiryCheck {
+		if reason := s.certExpiryReason(c); reason != "" {
+			return reason
+		}
+	}
+
+	// Not ready if any of the custom readiness checks fails.
+	if reason := s.runChecks(ctx, "readiness", s.readinessChecks()); reason != "" {
+		return reason
+	}
+
+	return ""
+}
+
+// logLivenessFailure logs why liveness failed, tagged with the ID of the
+// request in ctx, if any.
+func (s *Server) logLivenessFailure(ctx context.Context, reason string) {
+	atomic.AddUint64(&s.livenessFailures, 1)
+	logging.Errorf("Liveness failed because %s.%s", reason, requestIDSuffix(ctx))
+}
+
+// throttleReadinessLog reports whether a readiness failure because of reason
+// should be logged: always if it differs from the last logged reason, and
+// otherwise at most once per readinessLogInterval. If it should, prev is the
+// last logged reason and suppressed is how many failures since were not
+// logged.
+func (s *Server) throttleReadinessLog(reason string) (log bool, prev string, suppressed int) {
+	if s.readinessLogInterval == 0 {
+		return true, "", 0
+	}
+	s.readinessLogL.Lock()
+	defer s.readinessLogL.Unlock()
+	now := s.now()
+	if reason == s.loggedReason && now.Sub(s.loggedAt) < s.readinessLogInterval {
+		s.suppressed++
+		return false, "", 0
+	}
+	prev, suppressed = s.loggedReason, s.suppressed
+	s.loggedReason, s.loggedAt, s.suppressed = reason, now, 0
+	return true, prev, suppressed
+}
+
+// logReadinessFailure logs why readiness failed, tagged with the ID of the
+// request in ctx, throttled by throttleReadinessLog. For a sampled fraction
+// of logged failures, the state that readiness was evaluated against is
+// logged as well.
+func (s *Server) logReadinessFailure(ctx context.Context, c *proxy.Client, reason string) {
+	atomic.AddUint64(&s.readinessFailures, 1)
+	log, prev, suppressed := s.throttleReadinessLog(reason)
+	if !log {
+		return
+	}
+	id := requestIDSuffix(ctx)
+	switch {
+	case suppressed == 0:
+		logging.Errorf("Readiness failed because %s.%s", reason, id)
+	case prev == reason:
+		logging.Errorf("Readiness failed because %s (%d more times since last logged).%s", reason, suppressed, id)
+	default:
+		logging.Errorf("Readiness failed %d more times because %s.", suppressed, prev)
+		logging.Errorf("Readiness failed because %s.%s", reason, id)
+	}
+	if s.sample() >= s.logSampleRate {
+		return
+	}
+	logging.Verbosef("Readiness state: started=%t, open connections=%d, max connections=%d%s",
+		s.proxyStarted(), atomic.LoadUint64(&c.ConnectionsCounter), c.MaxConnectionsLimit(), id)
 }
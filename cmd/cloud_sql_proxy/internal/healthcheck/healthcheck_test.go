@@ -15,18 +15,54 @@
 package healthcheck_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/cmd/cloud_sql_proxy/internal/healthcheck"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/cmd/cloud_sql_proxy/internal/healthcheck/healthpb"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthgrpc "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
 	startupPath   = "/startup"
 	livenessPath  = "/liveness"
 	readinessPath = "/readiness"
+	eventsPath    = "/events"
+	metricsPath   = "/metrics"
+	statusPath    = "/status"
+	healthzPath   = "/healthz"
 	testPort      = "8090"
 )
 
@@ -71,6 +107,40 @@ func TestStartupFail(t *testing.T) {
 	if resp.StatusCode != http.StatusServiceUnavailable {
 		t.Errorf("%v returned status code %v instead of %v", readinessPath, resp.StatusCode, http.StatusServiceUnavailable)
 	}
+	if got := resp.Header.Get("Retry-After"); got != "1" {
+		t.Errorf("%v returned Retry-After %q instead of %q", readinessPath, got, "1")
+	}
+}
+
+// Test to verify that the startup endpoint reports which instances are still
+// being initialized, and keeps passing once the proxy has started even while
+// it is not ready.
+func TestStartupProgress(t *testing.T) {
+	c := &proxy.Client{Instances: []string{"proj:region:a", "proj:region:b"}}
+	s, err := healthcheck.NewServer(c, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	want := "error: proxy has not finished starting up (0 of 2 instances initialized, waiting for proj:region:a, proj:region:b)"
+	if got := getBody(t, startupPath); got != want {
+		t.Errorf("Got startup body %q, want %q", got, want)
+	}
+	s.NotifyInstanceInitialized("proj:region:a")
+	want = "error: proxy has not finished starting up (1 of 2 instances initialized, waiting for proj:region:b)"
+	if got := getBody(t, startupPath); got != want {
+		t.Errorf("Got startup body %q, want %q", got, want)
+	}
+
+	s.NotifyStarted()
+	s.NotifyDraining()
+	if got := getBody(t, startupPath); got != "ok" {
+		t.Errorf("Got startup body %q while draining, want %q", got, "ok")
+	}
+	if got := getBody(t, readinessPath); got == "ok" {
+		t.Errorf("Got readiness body %q while draining, want an error", got)
+	}
 }
 
 // Test to verify that when startup HAS finished (and MaxConnections limit not specified),
@@ -126,6 +196,65 @@ func TestMaxConnectionsReached(t *testing.T) {
 	}
 }
 
+// Test to verify that readiness reflects MaxConnections changed while the
+// proxy is running.
+func TestSetMaxConnections(t *testing.T) {
+	c := &proxy.Client{MaxConnections: 2}
+	s, err := healthcheck.NewServer(c, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+	atomic.StoreUint64(&c.ConnectionsCounter, 2)
+
+	tests := []struct {
+		max  uint64
+		want int
+	}{
+		{2, http.StatusServiceUnavailable},
+		{3, http.StatusOK},
+		{1, http.StatusServiceUnavailable},
+		{0, http.StatusOK},
+	}
+	for _, tc := range tests {
+		c.SetMaxConnections(tc.max)
+		resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("Got status code %v with 2 open connections and a limit of %d, want %v", resp.StatusCode, tc.max, tc.want)
+		}
+	}
+}
+
+// Test to verify that the startup endpoint only reflects startup, and passes
+// even when MaxConnections has been reached.
+func TestStartupIgnoresMaxConnections(t *testing.T) {
+	c := &proxy.Client{
+		MaxConnections: 1,
+	}
+	s, err := healthcheck.NewServer(c, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	s.NotifyStarted()
+	c.ConnectionsCounter = c.MaxConnections // Simulate reaching the limit for maximum number of connections
+
+	resp, err := http.Get("http://localhost:" + testPort + startupPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("%v returned status code %v instead of %v", startupPath, resp.StatusCode, http.StatusOK)
+	}
+}
+
 // Test to verify that after closing a healthcheck, its liveness endpoint serves
 // an error.
 func TestCloseHealthCheck(t *testing.T) {
@@ -153,3 +282,4259 @@ func TestCloseHealthCheck(t *testing.T) {
 		t.Fatalf("HTTP GET did not return error after closing health check server.")
 	}
 }
+
+// Test to verify that a Server created with a context is closed once the
+// context is canceled.
+func TestNewServerWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := healthcheck.NewServerWithContext(ctx, &proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	resp, err := http.Get("http://localhost:" + testPort + livenessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	resp.Body.Close()
+
+	cancel()
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+	for deadline := time.Now().Add(time.Second); ; {
+		resp, err := client.Get("http://localhost:" + testPort + livenessPath)
+		if err != nil {
+			break
+		}
+		resp.Body.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("HTTP GET did not return error after canceling the health check's context.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test to verify that readiness fails with an explicit reason once Close has
+// been called, while the endpoints are still being served.
+func TestReadinessWhileClosing(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	s.NotifyStarted()
+
+	var (
+		status int
+		reason string
+	)
+	err = s.RegisterShutdownHook(healthcheck.PreDrain, func(context.Context) error {
+		client := &http.Client{Transport: &http.Transport{}}
+		defer client.CloseIdleConnections()
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:"+testPort+readinessPath, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		var got struct {
+			Reason string `json:"reason"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&got)
+		status, reason = resp.StatusCode, got.Reason
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatalf("Failed to close health check: %v", err)
+	}
+
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("%v returned status code %v while closing instead of %v", readinessPath, status, http.StatusServiceUnavailable)
+	}
+	if want := "proxy is shutting down"; reason != want {
+		t.Errorf("Got reason %q, want %q", reason, want)
+	}
+}
+
+// Test to verify that with port "0" the Server listens on a port chosen by the
+// operating system, which Addr reports.
+func TestAddrChosenPort(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, "0")
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	addr, ok := s.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("Addr() = %v, want a TCP address with a chosen port", s.Addr())
+	}
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d%s", addr.Port, livenessPath))
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusOK)
+	}
+}
+
+// Test to verify that WithHost binds the server to the given interface only,
+// and cannot be combined with a Unix domain socket.
+func TestHost(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithHost("127.0.0.1"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	addr, ok := s.Addr().(*net.TCPAddr)
+	if !ok || !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Addr() = %v, want 127.0.0.1:%s", s.Addr(), testPort)
+	}
+	resp, err := http.Get("http://127.0.0.1:" + testPort + livenessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusOK)
+	}
+
+	if _, err := healthcheck.NewServer(&proxy.Client{}, "hc.sock", healthcheck.WithNetwork("unix"), healthcheck.WithHost("127.0.0.1")); err == nil {
+		t.Error("NewServer with a host and network unix succeeded, want error")
+	}
+	if _, err := healthcheck.NewServer(&proxy.Client{}, "127.0.0.1:"+testPort, healthcheck.WithHost("127.0.0.1")); err == nil {
+		t.Error("NewServer with a host in both the address and WithHost succeeded, want error")
+	}
+}
+
+// Test to verify that Close runs every shutdown step and returns an error
+// containing each step's failure.
+func TestCloseAggregatesErrors(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	errA := errors.New("step A failed")
+	errB := errors.New("step B failed")
+	errC := &stepError{step: "C"}
+	healthcheck.AddShutdownStep(s, func(context.Context) error { return errA })
+	healthcheck.AddShutdownStep(s, func(context.Context) error { return errB })
+	healthcheck.AddShutdownStep(s, func(context.Context) error { return errC })
+
+	err = s.Close(context.Background())
+	if !errors.Is(err, errA) || !errors.Is(err, errB) {
+		t.Fatalf("Close returned %v, want an error containing both %v and %v", err, errA, errB)
+	}
+	var got *stepError
+	if !errors.As(err, &got) || got != errC {
+		t.Fatalf("Close returned %v, want an error containing %v", err, errC)
+	}
+}
+
+// stepError is an error type returned by a shutdown step.
+type stepError struct {
+	step string
+}
+
+func (e *stepError) Error() string {
+	return "step " + e.step + " failed"
+}
+
+// handleConns sends a connection for each instance through c, waiting for c
+// to finish with each before sending the next. Each connection is closed by
+// the client as soon as it has been sent.
+func handleConns(t *testing.T, c *proxy.Client, instances ...string) {
+	t.Helper()
+	src := make(chan proxy.Conn)
+	done := make(chan struct{})
+	go func() {
+		c.Run(src)
+		close(done)
+	}()
+	for _, inst := range instances {
+		local, remote := net.Pipe()
+		src <- proxy.Conn{Instance: inst, Conn: local}
+		remote.Close()
+
+		deadline := time.Now().Add(time.Second)
+		for {
+			ev := c.ConnEvents()
+			if n := len(ev); n > 0 && ev[n-1].Instance == inst && ev[n-1].Type != proxy.ConnAccepted {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Connection to %q was not handled", inst)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	close(src)
+	<-done
+}
+
+// failingCerts is a proxy.CertSource that fails to provide certificates, so
+// connections through a proxy.Client using it close immediately.
+type failingCerts struct{}
+
+func (failingCerts) Local(string) (tls.Certificate, error) {
+	return tls.Certificate{}, errors.New("no certificate available")
+}
+
+func (failingCerts) Remote(string) (*x509.Certificate, string, string, string, error) {
+	return nil, "", "", "", errors.New("no certificate available")
+}
+
+// Test to verify that the events endpoint reports connection events oldest
+// first, evicting the oldest once over capacity.
+func TestEvents(t *testing.T) {
+	c := &proxy.Client{
+		MaxConnections: 1,
+		ConnEventsSize: 2,
+	}
+	c.ConnectionsCounter = c.MaxConnections
+	s, err := healthcheck.NewServer(c, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	handleConns(t, c, "proj:region:a", "proj:region:b", "proj:region:c")
+
+	resp, err := http.Get("http://localhost:" + testPort + eventsPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var events []proxy.ConnEvent
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		t.Fatalf("Failed to decode events: %v", err)
+	}
+	want := []string{"proj:region:b", "proj:region:c"}
+	if len(events) != len(want) {
+		t.Fatalf("Got %d events, want %d", len(events), len(want))
+	}
+	for i, e := range events {
+		if e.Instance != want[i] || e.Type != proxy.ConnRejected {
+			t.Errorf("events[%d] = %v %q, want %v %q", i, e.Type, e.Instance, proxy.ConnRejected, want[i])
+		}
+	}
+}
+
+// Test to verify that the health check server can be created with a custom
+// listener backlog.
+func TestListenBacklog(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("setting the listener backlog is only supported on Linux")
+	}
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithListenBacklog(16))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	resp, err := http.Get("http://localhost:" + testPort + livenessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusOK)
+	}
+}
+
+// Test to verify that the proxy state is logged for approximately the
+// configured fraction of readiness failures, while the failure reason is
+// always logged.
+func TestReadinessLogSampling(t *testing.T) {
+	var reasons, details int64
+	errorf, verbosef := logging.Errorf, logging.Verbosef
+	defer func() { logging.Errorf, logging.Verbosef = errorf, verbosef }()
+	logging.Errorf = func(string, ...interface{}) { atomic.AddInt64(&reasons, 1) }
+	logging.Verbosef = func(string, ...interface{}) { atomic.AddInt64(&details, 1) }
+
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithReadinessLogSampling(0.25))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	healthcheck.SetSampleSeed(s, 1)
+
+	const probes = 400
+	for i := 0; i < probes; i++ {
+		resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if got := atomic.LoadInt64(&reasons); got != probes {
+		t.Errorf("Readiness failure reason was logged %d times, want %d", got, probes)
+	}
+	if got := float64(atomic.LoadInt64(&details)) / probes; got < 0.15 || got > 0.35 {
+		t.Errorf("Readiness state was logged for %v of failures, want approximately 0.25", got)
+	}
+}
+
+// Test to verify that after a restart onto a new port, the old port stops
+// responding while the new port serves the same state.
+func TestRestart(t *testing.T) {
+	const newPort = "8091"
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	if err := s.Restart(":" + newPort); err != nil {
+		t.Fatalf("Failed to restart health check: %v", err)
+	}
+
+	resp, err := http.Get("http://localhost:" + newPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusOK)
+	}
+
+	if _, err := http.Get("http://localhost:" + testPort + readinessPath); err == nil {
+		t.Errorf("HTTP GET on the old port did not return an error after restarting.")
+	}
+}
+
+// Test to verify that readiness fails when the configured external dependency
+// is unhealthy.
+func TestDependencyUnhealthy(t *testing.T) {
+	dep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer dep.Close()
+
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithDependencyCheck(healthcheck.DependencyCheck{
+		URL:    dep.URL,
+		Client: dep.Client(),
+	}))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+// Test to verify that a request to a slow dependency is canceled once the
+// readiness timeout expires.
+func TestDependencyTimeout(t *testing.T) {
+	canceled := make(chan struct{})
+	dep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	defer dep.Close()
+
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort,
+		healthcheck.WithReadinessTimeout(50*time.Millisecond),
+		healthcheck.WithDependencyCheck(healthcheck.DependencyCheck{
+			URL:     dep.URL,
+			Client:  dep.Client(),
+			Timeout: time.Minute,
+		}))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("Dependency request not canceled after the readiness timeout")
+	}
+}
+
+// Test to verify that NewServer rejects a dependency check with a negative
+// interval or timeout.
+func TestDependencyInvalid(t *testing.T) {
+	for _, cfg := range []healthcheck.DependencyCheck{
+		{URL: "http://localhost", Interval: -time.Second},
+		{URL: "http://localhost", Timeout: -time.Second},
+	} {
+		if _, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithDependencyCheck(cfg)); err == nil {
+			t.Errorf("NewServer with dependency check %+v succeeded, want error", cfg)
+		}
+	}
+}
+
+// Test to verify that short-lived connections raise the churn metric and
+// fail readiness once above the configured maximum.
+func TestChurnRate(t *testing.T) {
+	c, stop := newInstance(t)
+	defer stop()
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithMetrics(), healthcheck.WithMaxChurnRate(0.02))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %v instead of %v before any churn", resp.StatusCode, http.StatusOK)
+	}
+
+	handleConns(t, c, "proj:region:a", "proj:region:b", "proj:region:c")
+
+	body := getBody(t, metricsPath)
+	if want := "cloudsql_proxy_connection_churn_rate 0.05\n"; !strings.Contains(body, want) {
+		t.Errorf("Metrics did not contain %q:\n%s", want, body)
+	}
+
+	resp, err = http.Get("http://localhost:" + testPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Got status code %v instead of %v after churn", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+// Test to verify that shutdown hooks run in phase order during Close.
+func TestShutdownHooks(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	var got []string
+	hook := func(name string) func(context.Context) error {
+		return func(context.Context) error {
+			got = append(got, name)
+			return nil
+		}
+	}
+	for _, h := range []struct {
+		phase healthcheck.ShutdownPhase
+		name  string
+	}{
+		{healthcheck.PreClose, "pre-close"},
+		{healthcheck.PostDrain, "post-drain"},
+		{healthcheck.PreDrain, "pre-drain 1"},
+		{healthcheck.PreDrain, "pre-drain 2"},
+	} {
+		if err := s.RegisterShutdownHook(h.phase, hook(h.name)); err != nil {
+			t.Fatalf("Failed to register shutdown hook: %v", err)
+		}
+	}
+
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatalf("Failed to close health check: %v", err)
+	}
+	want := []string{"pre-drain 1", "pre-drain 2", "post-drain", "pre-close"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Shutdown hooks ran in order %v, want %v", got, want)
+	}
+}
+
+// rateLimitedCerts is a proxy.CertSource whose Admin API calls are all
+// rejected for exceeding quota.
+type rateLimitedCerts struct {
+	failingCerts
+	calls uint64
+}
+
+func (r *rateLimitedCerts) APIUsage() (calls, rateLimited uint64) {
+	n := atomic.LoadUint64(&r.calls)
+	return n, n
+}
+
+// Test to verify that readiness fails once enough Admin API calls have been
+// rate limited.
+func TestAPIQuotaLow(t *testing.T) {
+	certs := &rateLimitedCerts{}
+	s, err := healthcheck.NewServer(&proxy.Client{Certs: certs}, testPort, healthcheck.WithAPIQuotaCheck(3))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	for _, tc := range []struct {
+		calls uint64
+		want  int
+	}{
+		{calls: 2, want: http.StatusOK},
+		{calls: 3, want: http.StatusServiceUnavailable},
+	} {
+		atomic.StoreUint64(&certs.calls, tc.calls)
+		resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		if resp.StatusCode != tc.want {
+			t.Errorf("With %d rate limited calls, got status code %v instead of %v", tc.calls, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+// credentialsCerts is a proxy.CertSource whose credentials fail to be checked
+// with err, if set.
+type credentialsCerts struct {
+	failingCerts
+	mu  sync.Mutex
+	err error
+}
+
+func (c *credentialsCerts) CheckCredentials(context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Test to verify that readiness fails, with a reason naming the credentials,
+// while no access token can be obtained.
+func TestCredentialsCheck(t *testing.T) {
+	certs := &credentialsCerts{}
+	s, err := healthcheck.NewServer(&proxy.Client{Certs: certs}, testPort, healthcheck.WithCredentialsCheck())
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	if got := getBody(t, readinessPath); got != "ok" {
+		t.Errorf("Got readiness body %q with valid credentials, want %q", got, "ok")
+	}
+	certs.mu.Lock()
+	certs.err = errors.New("metadata server unreachable")
+	certs.mu.Unlock()
+	want := "credentials unavailable: metadata server unreachable"
+	if got := getReason(t, readinessPath); got != want {
+		t.Errorf("Got readiness reason %q, want %q", got, want)
+	}
+
+	// Cert sources that cannot check their credentials do not fail.
+	s.Close(context.Background())
+	s, err = healthcheck.NewServer(&proxy.Client{Certs: failingCerts{}}, testPort, healthcheck.WithCredentialsCheck())
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+	if got := getBody(t, readinessPath); got != "ok" {
+		t.Errorf("Got readiness body %q without a credentials check, want %q", got, "ok")
+	}
+}
+
+// Test to verify that WithAccessLog logs probe requests verbosely and other
+// requests at info level, with their status codes.
+func TestAccessLog(t *testing.T) {
+	var (
+		mu             sync.Mutex
+		infos, verbose []string
+	)
+	infof, verbosef := logging.Infof, logging.Verbosef
+	defer func() { logging.Infof, logging.Verbosef = infof, verbosef }()
+	record := func(logs *[]string) func(string, ...interface{}) {
+		return func(format string, args ...interface{}) {
+			if msg := fmt.Sprintf(format, args...); strings.HasPrefix(msg, "Health check request: ") {
+				mu.Lock()
+				*logs = append(*logs, msg)
+				mu.Unlock()
+			}
+		}
+	}
+	logging.Infof, logging.Verbosef = record(&infos), record(&verbose)
+
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithAccessLog())
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	getBody(t, readinessPath)
+	getBody(t, "/unknown")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(verbose) != 1 || !strings.HasPrefix(verbose[0], "Health check request: GET "+readinessPath+" from 127.0.0.1:") ||
+		!strings.Contains(verbose[0], ": 503 in ") {
+		t.Errorf("Got verbose access logs %q, want one for a 503 from %s", verbose, readinessPath)
+	}
+	if len(infos) != 1 || !strings.Contains(infos[0], "GET /unknown from ") || !strings.Contains(infos[0], ": 404 in ") {
+		t.Errorf("Got info access logs %q, want one for a 404 from /unknown", infos)
+	}
+}
+
+// Test to verify that /version serves the version and commit set with
+// WithVersion, along with the Go runtime version.
+func TestVersion(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithVersion("1.24.1+container", "abc123"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	var got struct {
+		Version   string `json:"version"`
+		Commit    string `json:"commit"`
+		GoVersion string `json:"goVersion"`
+	}
+	if err := json.Unmarshal([]byte(getBody(t, "/version")), &got); err != nil {
+		t.Fatalf("Failed to decode version: %v", err)
+	}
+	if got.Version != "1.24.1+container" || got.Commit != "abc123" || got.GoVersion != runtime.Version() {
+		t.Errorf("Got version %+v, want 1.24.1+container, abc123 and %s", got, runtime.Version())
+	}
+}
+
+// Test to verify that the gRPC health service reports the proxy serving once
+// it is ready, for the overall, liveness and readiness services, and streams
+// changes to watchers.
+func TestGRPCHealth(t *testing.T) {
+	const grpcPort = "8091"
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithGRPC(grpcPort))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "localhost:"+grpcPort, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatalf("gRPC dial failed: %v", err)
+	}
+	defer conn.Close()
+	client := healthgrpc.NewHealthClient(conn)
+
+	check := func(service string, want healthgrpc.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		resp, err := client.Check(ctx, &healthgrpc.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatalf("Check(%q) failed: %v", service, err)
+		}
+		if resp.GetStatus() != want {
+			t.Errorf("Check(%q) = %v, want %v", service, resp.GetStatus(), want)
+		}
+	}
+	check("", healthgrpc.HealthCheckResponse_NOT_SERVING)
+	check("liveness", healthgrpc.HealthCheckResponse_SERVING)
+	check("readiness", healthgrpc.HealthCheckResponse_NOT_SERVING)
+	if _, err := client.Check(ctx, &healthgrpc.HealthCheckRequest{Service: "unknown"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Check(%q) returned error %v, want code %v", "unknown", err, codes.NotFound)
+	}
+
+	stream, err := client.Watch(ctx, &healthgrpc.HealthCheckRequest{Service: "readiness"})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	recv := func(want healthgrpc.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Watch stream failed: %v", err)
+		}
+		if resp.GetStatus() != want {
+			t.Errorf("Watch sent %v, want %v", resp.GetStatus(), want)
+		}
+	}
+	recv(healthgrpc.HealthCheckResponse_NOT_SERVING)
+	s.NotifyStarted()
+	recv(healthgrpc.HealthCheckResponse_SERVING)
+	check("", healthgrpc.HealthCheckResponse_SERVING)
+
+	// Closing the Server ends the stream.
+	if err := s.Close(context.Background()); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if _, err := stream.Recv(); err == nil {
+		t.Error("Watch stream still open after Close")
+	}
+}
+
+// getBody returns the body of the response to a GET request for path on the
+// health check server.
+func getBody(t *testing.T, path string) string {
+	t.Helper()
+	resp, err := http.Get("http://localhost:" + testPort + path)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response body: %v", err)
+	}
+	return string(body)
+}
+
+// getReason requests path as JSON and returns the reason it reports the proxy,
+// or the instance, is not ready.
+func getReason(t *testing.T, path string) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:"+testPort+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var got struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode readiness: %v", err)
+	}
+	return got.Reason
+}
+
+// Test to verify that the configured labels are added to exported metrics.
+func TestMetricLabels(t *testing.T) {
+	c := &proxy.Client{}
+	c.ConnectionsCounter = 2
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithMetrics(), healthcheck.WithMetricLabels(map[string]string{
+		"region": "us-central1",
+		"env":    "prod",
+	}))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	body := getBody(t, metricsPath)
+	if want := `cloudsql_proxy_open_connections{env="prod",region="us-central1"} 2` + "\n"; !strings.Contains(body, want) {
+		t.Errorf("Metrics did not contain %q:\n%s", want, body)
+	}
+}
+
+// newCA returns a self-signed CA certificate and its key.
+func newCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %v", err)
+	}
+	return cert, key
+}
+
+// newLeaf returns a certificate for localhost signed by ca, valid for usage.
+func newLeaf(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// Test to verify that when client certificates are required, a client with a
+// certificate signed by the client CA is served and one with an untrusted
+// certificate is rejected.
+func TestRequireClientCert(t *testing.T) {
+	ca, caKey := newCA(t, "test CA")
+	untrustedCA, untrustedKey := newCA(t, "untrusted CA")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort,
+		healthcheck.WithTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{newLeaf(t, ca, caKey, x509.ExtKeyUsageServerAuth)},
+		}),
+		healthcheck.WithClientCA(pool),
+		healthcheck.WithRequireClientCert(),
+	)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	get := func(clientCert tls.Certificate) (*http.Response, error) {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{clientCert},
+		}}}
+		return c.Get("https://localhost:" + testPort + livenessPath)
+	}
+
+	resp, err := get(newLeaf(t, ca, caKey, x509.ExtKeyUsageClientAuth))
+	if err != nil {
+		t.Fatalf("HTTPS GET with a trusted client certificate failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusOK)
+	}
+
+	if _, err := get(newLeaf(t, untrustedCA, untrustedKey, x509.ExtKeyUsageClientAuth)); err == nil {
+		t.Errorf("HTTPS GET with an untrusted client certificate did not return an error")
+	}
+}
+
+// instanceCerts is a proxy.CertSource for instances served by a local TLS
+// listener, failing for the instances in fail.
+type instanceCerts struct {
+	ca   *x509.Certificate
+	cert tls.Certificate
+	fail map[string]bool
+}
+
+func (i *instanceCerts) Local(string) (tls.Certificate, error) {
+	return i.cert, nil
+}
+
+func (i *instanceCerts) Remote(instance string) (*x509.Certificate, string, string, string, error) {
+	if i.fail[instance] {
+		return nil, "", "", "", errors.New("instance unavailable")
+	}
+	return i.ca, "127.0.0.1", "localhost", "", nil
+}
+
+// newInstance starts a TLS listener standing in for a Cloud SQL instance,
+// which closes each connection once the handshake completes. It returns a
+// proxy.Client connecting to it, failing for the instances in fail, and a
+// func to stop the listener.
+func newInstance(t *testing.T, fail ...string) (*proxy.Client, func()) {
+	t.Helper()
+	ca, caKey := newCA(t, "instance CA")
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{newLeaf(t, ca, caKey, x509.ExtKeyUsageServerAuth)},
+	})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Hold the connection open until the client closes it.
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	certs := &instanceCerts{
+		ca:   ca,
+		cert: newLeaf(t, ca, caKey, x509.ExtKeyUsageClientAuth),
+		fail: map[string]bool{},
+	}
+	for _, inst := range fail {
+		certs.fail[inst] = true
+	}
+	return &proxy.Client{Certs: certs, Port: ln.Addr().(*net.TCPAddr).Port}, func() { ln.Close() }
+}
+
+// Test to verify that the connection success ratio is reported on /metrics
+// and /status, and fails readiness once below the configured minimum.
+func TestSuccessRatio(t *testing.T) {
+	c, stop := newInstance(t, "proj:region:d1", "proj:region:d2", "proj:region:d3", "proj:region:d4")
+	defer stop()
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithMetrics(), healthcheck.WithMinSuccessRatio(0.5))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	handleConns(t, c, "proj:region:u1", "proj:region:u2", "proj:region:u3", "proj:region:d1")
+
+	body := getBody(t, metricsPath)
+	if want := "cloudsql_proxy_connection_success_ratio 0.75\n"; !strings.Contains(body, want) {
+		t.Errorf("Metrics did not contain %q:\n%s", want, body)
+	}
+
+	var st struct {
+		SuccessRatio       float64 `json:"successRatio"`
+		ConnectionAttempts uint64  `json:"connectionAttempts"`
+	}
+	if err := json.Unmarshal([]byte(getBody(t, statusPath)), &st); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	if st.SuccessRatio != 0.75 || st.ConnectionAttempts != 4 {
+		t.Errorf("Got success ratio %v over %d attempts, want 0.75 over 4", st.SuccessRatio, st.ConnectionAttempts)
+	}
+
+	resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %v instead of %v above the minimum ratio", resp.StatusCode, http.StatusOK)
+	}
+
+	handleConns(t, c, "proj:region:d2", "proj:region:d3", "proj:region:d4")
+
+	resp, err = http.Get("http://localhost:" + testPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Got status code %v instead of %v below the minimum ratio", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+// Test to verify that responses over the gzip threshold are compressed for
+// clients accepting gzip, and decompress to the uncompressed response, while
+// responses that cannot have a body get no encoding headers.
+func TestGzip(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithGzipThreshold(1))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	want := getBody(t, statusPath)
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:"+testPort+statusPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	// Setting Accept-Encoding explicitly stops the transport from
+	// transparently decompressing the response.
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Got Content-Encoding %q, want %q", got, "gzip")
+	}
+	compressed, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("Response is not gzip compressed: %v", err)
+	}
+	got, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("Failed to decompress body: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("Decompressed body = %q, want %q", got, want)
+	}
+
+	for _, code := range []int{http.StatusNoContent, http.StatusNotModified} {
+		h := healthcheck.GzipHandler(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(code)
+		}, 0)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != code {
+			t.Errorf("Got status code %v instead of %v", rec.Code, code)
+		}
+		for _, name := range []string{"Content-Encoding", "Content-Length"} {
+			if got := rec.Header().Get(name); got != "" {
+				t.Errorf("Got %s %q on a %d response, want none", name, got, code)
+			}
+		}
+	}
+}
+
+// Test to verify that the proxy is not ready during a maintenance window and
+// ready outside of it.
+func TestMaintenanceSchedule(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort,
+		healthcheck.WithMaintenanceSchedule("2021-06-01T22:00:00Z/2021-06-02T02:00:00Z, 12:00-13:00"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+	var now int64
+	healthcheck.SetClock(s, func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) })
+
+	tcs := []struct {
+		now  string
+		want int
+	}{
+		{"2021-06-01T23:00:00Z", http.StatusServiceUnavailable},
+		{"2021-06-02T02:00:00Z", http.StatusOK},
+		{"2021-06-03T12:30:00Z", http.StatusServiceUnavailable},
+		{"2021-06-03T13:30:00Z", http.StatusOK},
+	}
+	for _, tc := range tcs {
+		tm, err := time.Parse(time.RFC3339, tc.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		atomic.StoreInt64(&now, tm.UnixNano())
+
+		resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		if resp.StatusCode != tc.want {
+			t.Errorf("At %v, got status code %v instead of %v", tc.now, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+// Test to verify that an invalid maintenance schedule is rejected.
+func TestMaintenanceScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{"12:00", "12:00-12:00", "2021-06-02T00:00:00Z/2021-06-01T00:00:00Z", "noon-1pm"} {
+		if _, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithMaintenanceSchedule(spec)); err == nil {
+			t.Errorf("NewServer with schedule %q did not return an error", spec)
+		}
+	}
+}
+
+// Test to verify that under the degrade policy, connections over the limit
+// are accepted but the proxy is no longer ready.
+func TestDegradePolicy(t *testing.T) {
+	c, stop := newInstance(t)
+	defer stop()
+	c.MaxConnections = 1
+	c.MaxConnectionsPolicy = proxy.DegradePolicy
+	c.ConnectionsCounter = c.MaxConnections
+	s, err := healthcheck.NewServer(c, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	handleConns(t, c, "proj:region:a")
+	for _, e := range c.ConnEvents() {
+		if e.Type == proxy.ConnRejected {
+			t.Errorf("Connection to %q was rejected over the limit", e.Instance)
+		}
+	}
+
+	resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+// Test to verify that the first NotifyStarted logs a structured ready event,
+// and later calls do not log it again.
+func TestReadyEvent(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	infof := logging.Infof
+	defer func() { logging.Infof = infof }()
+	logging.Infof = func(format string, args ...interface{}) {
+		if msg := fmt.Sprintf(format, args...); strings.HasPrefix(msg, healthcheck.ReadyEventPrefix+" ") {
+			mu.Lock()
+			events = append(events, strings.TrimPrefix(msg, healthcheck.ReadyEventPrefix+" "))
+			mu.Unlock()
+		}
+	}
+
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+	s.NotifyStarted()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 {
+		t.Fatalf("Got %d ready events, want 1: %q", len(events), events)
+	}
+	var e healthcheck.ReadyEvent
+	if err := json.Unmarshal([]byte(events[0]), &e); err != nil {
+		t.Fatalf("Failed to decode ready event %q: %v", events[0], err)
+	}
+	if e.Event != healthcheck.ReadyEventName {
+		t.Errorf("Got event %q, want %q", e.Event, healthcheck.ReadyEventName)
+	}
+	if e.Time.IsZero() || e.StartupSeconds < 0 {
+		t.Errorf("Got time %v and startup duration %vs, want a set time and non-negative duration", e.Time, e.StartupSeconds)
+	}
+	if !strings.HasSuffix(e.HealthCheckAddr, ":"+testPort) {
+		t.Errorf("Got health check address %q, want port %s", e.HealthCheckAddr, testPort)
+	}
+}
+
+// Test to verify that the started callback is called exactly once, however
+// many times NotifyStarted is called and from however many goroutines.
+func TestStartedCallback(t *testing.T) {
+	var (
+		calls   int32
+		startup int64
+	)
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithStartedCallback(func(d time.Duration) {
+		atomic.AddInt32(&calls, 1)
+		atomic.StoreInt64(&startup, int64(d))
+	}))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	time.Sleep(10 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.NotifyStarted()
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("Started callback called %d times, want 1", got)
+	}
+	if d := time.Duration(atomic.LoadInt64(&startup)); d < 10*time.Millisecond {
+		t.Errorf("Started callback got startup duration %v, want at least 10ms", d)
+	}
+}
+
+// Test to verify that instances are probed concurrently, never more than the
+// configured concurrency at a time, within the probe timeout.
+func TestProbeConcurrency(t *testing.T) {
+	const (
+		instances   = 20
+		concurrency = 4
+		probeTime   = 50 * time.Millisecond
+	)
+	var targets []string
+	for i := 0; i < instances; i++ {
+		targets = append(targets, fmt.Sprintf("proj:region:db%d", i))
+	}
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort,
+		healthcheck.WithDialProbe(targets...),
+		healthcheck.WithProbeConcurrency(concurrency),
+		healthcheck.WithProbeTimeout(time.Second),
+	)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	var active, maxActive, probed int64
+	healthcheck.SetProbe(s, func(context.Context, string) error {
+		n := atomic.AddInt64(&active, 1)
+		defer atomic.AddInt64(&active, -1)
+		for {
+			m := atomic.LoadInt64(&maxActive)
+			if n <= m || atomic.CompareAndSwapInt64(&maxActive, m, n) {
+				break
+			}
+		}
+		atomic.AddInt64(&probed, 1)
+		time.Sleep(probeTime)
+		return nil
+	})
+
+	start := time.Now()
+	resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	elapsed := time.Since(start)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusOK)
+	}
+	if got := atomic.LoadInt64(&probed); got != instances {
+		t.Errorf("Probed %d instances, want %d", got, instances)
+	}
+	if got := atomic.LoadInt64(&maxActive); got > concurrency {
+		t.Errorf("Probed %d instances at once, want at most %d", got, concurrency)
+	}
+	if serial := instances * probeTime; elapsed >= serial/2 {
+		t.Errorf("Probing took %v, want well under the %v it takes serially", elapsed, serial)
+	}
+}
+
+// Test to verify that the proxy is not ready if a probed instance cannot be
+// reached under AllInstancesPolicy, with a plain text body of "error" and a
+// JSON reason naming the unreachable instance, and that it stays ready by
+// default while another probed instance is reachable.
+func TestProbeFailure(t *testing.T) {
+	c, stop := newInstance(t, "proj:region:down")
+	defer stop()
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithDialProbe("proj:region:up", "proj:region:down"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	s.NotifyStarted()
+	if body := getBody(t, readinessPath); body != "ok" {
+		t.Errorf("Got readiness body %q with the default instance policy, want ok", body)
+	}
+	s.Close(context.Background())
+
+	s, err = healthcheck.NewServer(c, testPort,
+		healthcheck.WithDialProbe("proj:region:up", "proj:region:down"),
+		healthcheck.WithInstancePolicy(healthcheck.AllInstancesPolicy))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Reading the response failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "error" {
+		t.Errorf("Got %v %q, want %v %q", resp.StatusCode, body, http.StatusServiceUnavailable, "error")
+	}
+	if reason := getReason(t, readinessPath); !strings.Contains(reason, `"proj:region:down"`) || strings.Contains(reason, `"proj:region:up"`) {
+		t.Errorf("Reason %q should name the unreachable instance only", reason)
+	}
+}
+
+// Test to verify that /healthz and its aliases fail until the proxy is ready,
+// and fail again once it is no longer live.
+func TestHealthz(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithHealthz("/health"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	check := func(when string, want int) {
+		t.Helper()
+		for _, path := range []string{healthzPath, "/health"} {
+			resp, err := http.Get("http://localhost:" + testPort + path)
+			if err != nil {
+				t.Fatalf("HTTP GET failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != want {
+				t.Errorf("Got status code %v from %s %s, want %v", resp.StatusCode, path, when, want)
+			}
+		}
+	}
+
+	check("before NotifyStarted", http.StatusServiceUnavailable)
+	s.NotifyStarted()
+	check("after NotifyStarted", http.StatusOK)
+
+	var live int32
+	healthcheck.SetLive(s, func() bool { return atomic.LoadInt32(&live) == 1 })
+	check("when not live", http.StatusServiceUnavailable)
+}
+
+// Test to verify that /healthz responds with the configured failure status
+// code and bodies, reflecting both liveness and readiness, while the split
+// endpoints keep their defaults.
+func TestHealthzCustomResponse(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithHealthz(),
+		healthcheck.WithHealthzFailureStatus(http.StatusInternalServerError), healthcheck.WithHealthzBody("UP", "DOWN"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	check := func(when, path string, wantCode int, wantBody string) {
+		t.Helper()
+		resp, err := http.Get("http://localhost:" + testPort + path)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read response body: %v", err)
+		}
+		if resp.StatusCode != wantCode || string(body) != wantBody {
+			t.Errorf("Got %v %q from %s %s, want %v %q", resp.StatusCode, body, path, when, wantCode, wantBody)
+		}
+	}
+
+	check("when not ready", healthzPath, http.StatusInternalServerError, "DOWN")
+	check("when not ready", readinessPath, http.StatusServiceUnavailable, "error")
+	check("when not ready", livenessPath, http.StatusOK, "ok")
+
+	s.NotifyStarted()
+	check("when healthy", healthzPath, http.StatusOK, "UP")
+	check("when healthy", readinessPath, http.StatusOK, "ok")
+
+	var live int32
+	healthcheck.SetLive(s, func() bool { return atomic.LoadInt32(&live) == 1 })
+	check("when not live", healthzPath, http.StatusInternalServerError, "DOWN")
+	check("when not live", readinessPath, http.StatusOK, "ok")
+	atomic.StoreInt32(&live, 1)
+	check("when live again", healthzPath, http.StatusOK, "UP")
+}
+
+// Test to verify that a /healthz failure status code other than 4xx or 5xx is
+// rejected.
+func TestInvalidHealthzFailureStatus(t *testing.T) {
+	for _, code := range []int{0, http.StatusContinue, http.StatusOK, http.StatusNoContent, http.StatusFound, 600} {
+		if _, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithHealthz(), healthcheck.WithHealthzFailureStatus(code)); err == nil {
+			t.Errorf("NewServer with healthz failure status %d succeeded, want error", code)
+		}
+	}
+}
+
+// Test to verify that the readiness endpoint responds with the configured
+// failure status code while the proxy is not ready, and that codes other than
+// 4xx and 5xx are rejected.
+func TestReadinessFailureStatus(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithReadinessFailureStatus(http.StatusInternalServerError))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	status := func() int {
+		t.Helper()
+		resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := status(); got != http.StatusInternalServerError {
+		t.Errorf("Got status code %v when not ready instead of %v", got, http.StatusInternalServerError)
+	}
+	s.NotifyStarted()
+	if got := status(); got != http.StatusOK {
+		t.Errorf("Got status code %v when ready instead of %v", got, http.StatusOK)
+	}
+
+	for _, code := range []int{0, http.StatusContinue, http.StatusOK, http.StatusNoContent, http.StatusFound, 600} {
+		if _, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithReadinessFailureStatus(code)); err == nil {
+			t.Errorf("NewServer with readiness failure status %d succeeded, want error", code)
+		}
+	}
+}
+
+// Test to verify that the liveness and readiness endpoints can be served at
+// other paths, which differ between Servers.
+func TestCustomProbePaths(t *testing.T) {
+	const otherPort = "8091"
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort,
+		healthcheck.WithLivenessPath("/livez"), healthcheck.WithReadinessPath("/readyz"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+	other, err := healthcheck.NewServer(&proxy.Client{}, otherPort)
+	if err != nil {
+		t.Fatalf("Could not initialize second health check: %v", err)
+	}
+	defer other.Close(context.Background())
+	other.NotifyStarted()
+
+	tests := []struct {
+		port, path string
+		want       int
+	}{
+		{testPort, "/livez", http.StatusOK},
+		{testPort, "/readyz", http.StatusOK},
+		{testPort, livenessPath, http.StatusNotFound},
+		{testPort, readinessPath, http.StatusNotFound},
+		{otherPort, livenessPath, http.StatusOK},
+		{otherPort, readinessPath, http.StatusOK},
+		{otherPort, "/readyz", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		resp, err := http.Get("http://localhost:" + tc.port + tc.path)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("Got status code %v from %s on port %s, want %v", resp.StatusCode, tc.path, tc.port, tc.want)
+		}
+	}
+}
+
+// Test to verify that invalid or conflicting endpoint paths are rejected.
+func TestInvalidProbePaths(t *testing.T) {
+	tests := [][]healthcheck.Option{
+		{healthcheck.WithLivenessPath("livez")},
+		{healthcheck.WithReadinessPath("")},
+		{healthcheck.WithReadinessPath(livenessPath)},
+		{healthcheck.WithLivenessPath(statusPath)},
+		{healthcheck.WithHealthz(), healthcheck.WithReadinessPath(healthzPath)},
+	}
+	for _, opts := range tests {
+		if s, err := healthcheck.NewServer(&proxy.Client{}, testPort, opts...); err == nil {
+			s.Close(context.Background())
+			t.Errorf("NewServer succeeded with options %d, want error", len(opts))
+		}
+	}
+}
+
+// Test to verify that readiness requests asking for the cached result get the
+// most recent evaluation without the checks being run again.
+func TestCachedReadiness(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithDialProbe("proj:region:a"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	var probes, failing int32
+	healthcheck.SetProbe(s, func(context.Context, string) error {
+		atomic.AddInt32(&probes, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			return errors.New("unreachable")
+		}
+		return nil
+	})
+
+	get := func(cached bool) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:"+testPort+readinessPath, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		if cached {
+			req.Header.Set("X-Readiness-Cached", "true")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := get(false); got != http.StatusOK {
+		t.Fatalf("Got status code %v instead of %v", got, http.StatusOK)
+	}
+	atomic.StoreInt32(&failing, 1)
+	if got := get(true); got != http.StatusOK {
+		t.Errorf("Got cached status code %v instead of %v", got, http.StatusOK)
+	}
+	if got := atomic.LoadInt32(&probes); got != 1 {
+		t.Errorf("Checks ran %d times, want 1", got)
+	}
+	if got := get(false); got != http.StatusServiceUnavailable {
+		t.Errorf("Got status code %v instead of %v after the probe failed", got, http.StatusServiceUnavailable)
+	}
+}
+
+// Test to verify that the health state marshals into a protobuf message
+// reflecting the proxy's state.
+func TestHealthState(t *testing.T) {
+	c := &proxy.Client{MaxConnections: 10}
+	c.ConnectionsCounter = 3
+	s, err := healthcheck.NewServer(c, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	b, err := proto.Marshal(s.HealthState())
+	if err != nil {
+		t.Fatalf("Failed to marshal health state: %v", err)
+	}
+	var got healthpb.HealthState
+	if err := proto.Unmarshal(b, &got); err != nil {
+		t.Fatalf("Failed to unmarshal health state: %v", err)
+	}
+	if got.Started || got.Ready || got.NotReadyReason != "proxy has not finished starting up" {
+		t.Errorf("Got started=%t ready=%t reason=%q before NotifyStarted", got.Started, got.Ready, got.NotReadyReason)
+	}
+	if got.OpenConnections != 3 || got.MaxConnections != 10 {
+		t.Errorf("Got %d of %d connections, want 3 of 10", got.OpenConnections, got.MaxConnections)
+	}
+	if got.ConnectionSuccessRatio != 1 || got.ConnectionAttempts != 0 {
+		t.Errorf("Got success ratio %v over %d attempts, want 1 over 0", got.ConnectionSuccessRatio, got.ConnectionAttempts)
+	}
+	if _, ok := got.Goroutines["conn_handler"]; !ok {
+		t.Errorf("Got goroutines %v, want a conn_handler count", got.Goroutines)
+	}
+
+	s.NotifyStarted()
+	if st := s.HealthState(); !st.Started || !st.Ready || st.NotReadyReason != "" {
+		t.Errorf("Got started=%t ready=%t reason=%q after NotifyStarted", st.Started, st.Ready, st.NotReadyReason)
+	}
+}
+
+// Test to verify that the health state reports whether the proxy is draining,
+// and the probe results of each instance.
+func TestHealthStateInstances(t *testing.T) {
+	c := &proxy.Client{Instances: []string{"proj:region:a"}}
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithDialProbe("proj:region:a", "proj:region:b"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	healthcheck.SetProbe(s, func(_ context.Context, inst string) error {
+		if inst == "proj:region:b" {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	s.NotifyStarted()
+
+	if st := s.HealthState(); st.Draining {
+		t.Error("Got draining before NotifyDraining")
+	}
+	s.NotifyDraining()
+	st := s.HealthState()
+	if !st.Draining || st.Ready {
+		t.Errorf("Got draining=%t ready=%t after NotifyDraining, want draining and not ready", st.Draining, st.Ready)
+	}
+	if len(st.Instances) != 2 {
+		t.Fatalf("Got instances %v, want proj:region:a and proj:region:b", st.Instances)
+	}
+	a, b := st.Instances[0], st.Instances[1]
+	if a.Name != "proj:region:a" || !a.Probed || a.LastProbe == nil || !a.LastProbe.Reachable ||
+		a.LastProbe.Time == nil || a.LastProbe.Latency == nil || a.LastProbe.UnreachableSince != nil {
+		t.Errorf("Got instance %v, want proj:region:a probed and reachable", a)
+	}
+	if b.Name != "proj:region:b" || !b.Probed || b.LastProbe == nil || b.LastProbe.Reachable ||
+		b.LastProbe.Error != "connection refused" || b.LastProbe.UnreachableSince == nil {
+		t.Errorf("Got instance %v, want proj:region:b probed and unreachable", b)
+	}
+
+	const otherPort = "8091"
+	dialed, stop := newInstance(t)
+	defer stop()
+	conn, err := dialed.Dial("proj:region:c")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	conn.Close()
+	s2, err := healthcheck.NewServer(dialed, otherPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s2.Close(context.Background())
+	st = s2.HealthState()
+	if len(st.Instances) != 1 || st.Instances[0].Name != "proj:region:c" || st.Instances[0].CertExpiry == nil || st.Instances[0].Probed {
+		t.Errorf("Got instances %v, want proj:region:c unprobed with a cert expiry", st.Instances)
+	}
+}
+
+// Test to verify that the proxy is not ready while a reload is in progress,
+// and ready again once it completes, even if it failed.
+func TestReload(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	readiness := func() int {
+		t.Helper()
+		resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	reloadErr := errors.New("bad config")
+	err = s.Reload(func() error {
+		if got := readiness(); got != http.StatusServiceUnavailable {
+			t.Errorf("Got status code %v instead of %v while reloading", got, http.StatusServiceUnavailable)
+		}
+		return reloadErr
+	})
+	if err != reloadErr {
+		t.Errorf("Reload returned %v, want %v", err, reloadErr)
+	}
+	if got := readiness(); got != http.StatusOK {
+		t.Errorf("Got status code %v instead of %v after reloading", got, http.StatusOK)
+	}
+}
+
+// Test to verify that a request's ID is echoed in the response and included
+// in the log lines for the request, and that one is generated if missing or
+// invalid.
+func TestRequestID(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		logs []string
+	)
+	errorf := logging.Errorf
+	defer func() { logging.Errorf = errorf }()
+	logging.Errorf = func(format string, args ...interface{}) {
+		mu.Lock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+		mu.Unlock()
+	}
+
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:"+testPort+readinessPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("X-Request-ID", "probe-123")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("X-Request-ID"); got != "probe-123" {
+		t.Errorf("Got X-Request-ID %q, want %q", got, "probe-123")
+	}
+	mu.Lock()
+	if len(logs) != 1 || !strings.Contains(logs[0], "probe-123") {
+		t.Errorf("Got log lines %q, want one containing the request ID", logs)
+	}
+	mu.Unlock()
+
+	resp, err = http.Get("http://localhost:" + testPort + livenessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("X-Request-ID") == "" {
+		t.Errorf("Got no X-Request-ID for a request without one")
+	}
+
+	for _, id := range []string{strings.Repeat("a", 129), "probe\t123", "probe-\xff"} {
+		req.Header.Set("X-Request-ID", id)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Request-ID"); got == "" || got == id {
+			t.Errorf("Got X-Request-ID %q for invalid ID %q, want a generated one", got, id)
+		}
+	}
+}
+
+// Test to verify that clients below the minimum TLS version are rejected.
+func TestMinTLSVersion(t *testing.T) {
+	ca, caKey := newCA(t, "test CA")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort,
+		healthcheck.WithTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{newLeaf(t, ca, caKey, x509.ExtKeyUsageServerAuth)},
+		}),
+		healthcheck.WithMinTLSVersion(tls.VersionTLS13),
+	)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	get := func(maxVersion uint16) (*http.Response, error) {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:    pool,
+			MaxVersion: maxVersion,
+		}}}
+		return c.Get("https://localhost:" + testPort + livenessPath)
+	}
+
+	if _, err := get(tls.VersionTLS12); err == nil {
+		t.Errorf("HTTPS GET with a TLS 1.2 client did not return an error")
+	}
+	resp, err := get(tls.VersionTLS13)
+	if err != nil {
+		t.Fatalf("HTTPS GET with a TLS 1.3 client failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusOK)
+	}
+}
+
+// Test to verify that invalid TLS versions and cipher suites are rejected.
+func TestInvalidTLSOptions(t *testing.T) {
+	cfg := &tls.Config{}
+	tcs := []struct {
+		desc string
+		opts []healthcheck.Option
+	}{
+		{"unknown version", []healthcheck.Option{healthcheck.WithTLSConfig(cfg), healthcheck.WithMinTLSVersion(0x0200)}},
+		{"insecure cipher suite", []healthcheck.Option{healthcheck.WithTLSConfig(cfg), healthcheck.WithCipherSuites(tls.TLS_RSA_WITH_RC4_128_SHA)}},
+		{"version without TLS", []healthcheck.Option{healthcheck.WithMinTLSVersion(tls.VersionTLS13)}},
+	}
+	for _, tc := range tcs {
+		if _, err := healthcheck.NewServer(&proxy.Client{}, testPort, tc.opts...); err == nil {
+			t.Errorf("NewServer with %s did not return an error", tc.desc)
+		}
+	}
+}
+
+// waitForStatus polls path until it responds with want, failing the test if
+// it does not within a second.
+func waitForStatus(t *testing.T, path string, want int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err := http.Get("http://localhost:" + testPort + path)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Got status code %v from %s instead of %v", resp.StatusCode, path, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test to verify that metrics are pushed, and that readiness fails while
+// pushes fail when metrics export readiness is enabled.
+func TestMetricsExportReadiness(t *testing.T) {
+	status := int32(http.StatusInternalServerError)
+	var pushed atomic.Value
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		pushed.Store(string(b))
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer gateway.Close()
+
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort,
+		healthcheck.WithMetricsPush(healthcheck.MetricsPush{
+			URL:      gateway.URL + "/metrics/job/cloudsql-proxy",
+			Interval: 10 * time.Millisecond,
+		}),
+		healthcheck.WithMetricsExportReadiness(),
+	)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	waitForStatus(t, readinessPath, http.StatusServiceUnavailable)
+	if body, _ := pushed.Load().(string); !strings.Contains(body, "cloudsql_proxy_open_connections 0") {
+		t.Errorf("Pushed metrics did not contain the open connections:\n%s", body)
+	}
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	waitForStatus(t, readinessPath, http.StatusOK)
+}
+
+// Test to verify that a negative metrics push interval is rejected.
+func TestMetricsPushInvalidInterval(t *testing.T) {
+	_, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithMetricsPush(healthcheck.MetricsPush{
+		URL:      "http://localhost:9091/metrics/job/cloudsql-proxy",
+		Interval: -time.Second,
+	}))
+	if err == nil {
+		t.Fatal("NewServer with a negative metrics push interval succeeded, want error")
+	}
+}
+
+// Test to verify that with deferred serving, the port is bound but requests
+// are not served until BeginServing is called.
+func TestDeferredServing(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithDeferredServing())
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	if ln, err := net.Listen("tcp", ":"+testPort); err == nil {
+		ln.Close()
+		t.Fatalf("Port %s was not bound before BeginServing", testPort)
+	}
+	c := &http.Client{Timeout: 100 * time.Millisecond}
+	if resp, err := c.Get("http://localhost:" + testPort + livenessPath); err == nil {
+		resp.Body.Close()
+		t.Fatalf("HTTP GET before BeginServing succeeded with status code %v", resp.StatusCode)
+	}
+
+	s.BeginServing()
+	resp, err := http.Get("http://localhost:" + testPort + livenessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET after BeginServing failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusOK)
+	}
+}
+
+// Test to verify that a Server closed before BeginServing shuts down cleanly.
+func TestDeferredServingClose(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithDeferredServing())
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	ln, err := net.Listen("tcp", ":"+testPort)
+	if err != nil {
+		t.Fatalf("Port %s was not released by Close: %v", testPort, err)
+	}
+	ln.Close()
+}
+
+// Test to verify that the proxy is not ready while a required environment
+// variable is missing, and that the variable is named in the logs.
+func TestRequiredEnv(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		logs []string
+	)
+	errorf := logging.Errorf
+	defer func() { logging.Errorf = errorf }()
+	logging.Errorf = func(format string, args ...interface{}) {
+		mu.Lock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+		mu.Unlock()
+	}
+
+	var env sync.Map
+	env.Store("PROJECT", "my-project")
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithRequiredEnv("PROJECT", "CREDENTIALS"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	healthcheck.SetEnv(s, func(name string) string {
+		v, _ := env.Load(name)
+		value, _ := v.(string)
+		return value
+	})
+	s.NotifyStarted()
+
+	resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	mu.Lock()
+	got := strings.Join(logs, "\n")
+	mu.Unlock()
+	if want := "missing env var: CREDENTIALS"; !strings.Contains(got, want) {
+		t.Errorf("Logs %q do not contain %q", got, want)
+	}
+
+	env.Store("CREDENTIALS", "/creds.json")
+	resp, err = http.Get("http://localhost:" + testPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %v instead of %v once the variable was set", resp.StatusCode, http.StatusOK)
+	}
+}
+
+// Test to verify that unknown paths get a clean 404 without evaluating
+// readiness or logging errors.
+func TestNotFound(t *testing.T) {
+	var errorLogs int32
+	errorf := logging.Errorf
+	defer func() { logging.Errorf = errorf }()
+	logging.Errorf = func(string, ...interface{}) {
+		atomic.AddInt32(&errorLogs, 1)
+	}
+
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	for _, path := range []string{"/favicon.ico", "/wp-login.php", "/readiness/extra"} {
+		resp, err := http.Get("http://localhost:" + testPort + path)
+		if err != nil {
+			t.Fatalf("HTTP GET %s failed: %v", path, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Reading the response to %s failed: %v", path, err)
+		}
+		if resp.StatusCode != http.StatusNotFound || string(body) != "not found" {
+			t.Errorf("GET %s = %v %q, want %v %q", path, resp.StatusCode, body, http.StatusNotFound, "not found")
+		}
+	}
+	// The proxy has not started, so evaluating readiness would log an error.
+	if n := atomic.LoadInt32(&errorLogs); n != 0 {
+		t.Errorf("Unknown paths logged %d errors, want none", n)
+	}
+}
+
+// Test to verify that batched checks share a single connection to their
+// instance per evaluation, while unbatched checks each dial their own.
+func TestBatchedChecks(t *testing.T) {
+	const inst = "proj:region:db"
+	tcs := []struct {
+		desc  string
+		opts  []healthcheck.Option
+		dials int32
+		// checkConns is the number of connections the checks run over.
+		checkConns int
+	}{
+		{desc: "unbatched", dials: 3, checkConns: 2},
+		{desc: "batched", opts: []healthcheck.Option{healthcheck.WithBatchedChecks()}, dials: 1, checkConns: 1},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.desc, func(t *testing.T) {
+			var (
+				mu    sync.Mutex
+				conns = make(map[net.Conn]bool)
+			)
+			check := func(_ context.Context, conn net.Conn) error {
+				mu.Lock()
+				conns[conn] = true
+				mu.Unlock()
+				return nil
+			}
+			opts := append([]healthcheck.Option{
+				healthcheck.WithDialProbe(inst),
+				healthcheck.WithConnCheck(inst, check),
+				healthcheck.WithConnCheck(inst, check),
+			}, tc.opts...)
+			s, err := healthcheck.NewServer(&proxy.Client{}, testPort, opts...)
+			if err != nil {
+				t.Fatalf("Could not initialize health check: %v", err)
+			}
+			defer s.Close(context.Background())
+			s.NotifyStarted()
+
+			var dials int32
+			healthcheck.SetDial(s, func(_ context.Context, instance string) (net.Conn, error) {
+				if instance != inst {
+					t.Errorf("Dialed %q, want %q", instance, inst)
+				}
+				atomic.AddInt32(&dials, 1)
+				local, remote := net.Pipe()
+				remote.Close()
+				return local, nil
+			})
+
+			resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+			if err != nil {
+				t.Fatalf("HTTP GET failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusOK)
+			}
+			if got := atomic.LoadInt32(&dials); got != tc.dials {
+				t.Errorf("Got %d dials per evaluation, want %d", got, tc.dials)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(conns) != tc.checkConns {
+				t.Errorf("Checks ran over %d connections, want %d", len(conns), tc.checkConns)
+			}
+		})
+	}
+}
+
+// Test to verify that an instance failing a ConnCheck makes the proxy not
+// ready, even without a dial probe.
+func TestConnCheckFailure(t *testing.T) {
+	checkErr := errors.New("ping failed")
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort,
+		healthcheck.WithConnCheck("proj:region:db", func(context.Context, net.Conn) error { return checkErr }))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+	healthcheck.SetDial(s, func(context.Context, string) (net.Conn, error) {
+		local, remote := net.Pipe()
+		remote.Close()
+		return local, nil
+	})
+
+	resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+// Test to verify that adding the instances with a ConnCheck to the dial probe
+// targets does not write to the slice passed to WithDialProbe.
+func TestConnCheckDialProbeTargets(t *testing.T) {
+	insts := []string{"proj:region:a", "proj:region:b"}
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort,
+		healthcheck.WithDialProbe(insts[:1]...),
+		healthcheck.WithConnCheck("proj:region:c", func(context.Context, net.Conn) error { return nil }))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	if insts[1] != "proj:region:b" {
+		t.Errorf("Got %q after the dial probe targets, want %q", insts[1], "proj:region:b")
+	}
+}
+
+// Test to verify that the proxy is not ready once its open connections reach
+// the threshold below MaxConnections.
+func TestConnectionsThreshold(t *testing.T) {
+	c := &proxy.Client{MaxConnections: 10}
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithConnectionsThreshold(0.9))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	atomic.StoreUint64(&c.ConnectionsCounter, 8)
+	if body := getBody(t, readinessPath); body != "ok" {
+		t.Errorf("Got readiness body %q with 8 of 10 connections open, want ok", body)
+	}
+	atomic.StoreUint64(&c.ConnectionsCounter, 9)
+	want := "proxy has 9 open connections, at or above 90% of the maximum connections limit (10)"
+	if got := getReason(t, readinessPath); got != want {
+		t.Errorf("Got readiness reason %q with 9 of 10 connections open, want %q", got, want)
+	}
+
+	for _, threshold := range []float64{-0.1, 1.5} {
+		if _, err := healthcheck.NewServer(c, testPort, healthcheck.WithConnectionsThreshold(threshold)); err == nil {
+			t.Errorf("NewServer with connections threshold %v succeeded, want error", threshold)
+		}
+	}
+}
+
+// Test to verify that the proxy and its instances are not ready within the
+// grace period after startup, until it ends or an instance is dialed
+// successfully, and that it does not resume once ended.
+func TestReadinessGracePeriod(t *testing.T) {
+	newServer := func(c *proxy.Client) (*healthcheck.Server, *int64) {
+		t.Helper()
+		s, err := healthcheck.NewServer(c, testPort, healthcheck.WithReadinessGracePeriod(time.Minute))
+		if err != nil {
+			t.Fatalf("Could not initialize health check: %v", err)
+		}
+		now := time.Now().UnixNano()
+		healthcheck.SetClock(s, func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) })
+		healthcheck.SetProbe(s, func(context.Context, string) error { return nil })
+		s.NotifyStarted()
+		return s, &now
+	}
+	status := func(path string) int {
+		t.Helper()
+		resp, err := http.Get("http://localhost:" + testPort + path)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	s, now := newServer(&proxy.Client{Instances: []string{"proj:region:a"}})
+	want := "readiness grace period after startup has 1m0s left and no instance has been dialed successfully yet"
+	if got := getReason(t, readinessPath); got != want {
+		t.Errorf("Got readiness reason %q at startup, want %q", got, want)
+	}
+	atomic.AddInt64(now, int64(2*time.Minute))
+	if got := status(readinessPath); got != http.StatusOK {
+		t.Errorf("Got status code %v after the grace period instead of %v", got, http.StatusOK)
+	}
+	s.Close(context.Background())
+
+	c, stop := newInstance(t)
+	defer stop()
+	c.Instances = []string{"proj:region:a"}
+	s, _ = newServer(c)
+	defer s.Close(context.Background())
+	for _, path := range []string{readinessPath, readinessPath + "?instance=proj:region:a"} {
+		if got := status(path); got != http.StatusServiceUnavailable {
+			t.Errorf("Got status code %v from %s within the grace period instead of %v", got, path, http.StatusServiceUnavailable)
+		}
+	}
+	handleConns(t, c, "proj:region:a")
+	for _, path := range []string{readinessPath, readinessPath + "?instance=proj:region:a"} {
+		if got := status(path); got != http.StatusOK {
+			t.Errorf("Got status code %v from %s after dialing an instance instead of %v", got, path, http.StatusOK)
+		}
+	}
+
+	if _, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithReadinessGracePeriod(-time.Second)); err == nil {
+		t.Error("NewServer with a negative readiness grace period succeeded, want error")
+	}
+}
+
+// Test to verify that the proxy and its instances are not ready until the
+// minimum uptime has passed, even after startup has finished.
+func TestMinUptime(t *testing.T) {
+	start := time.Now()
+	defer healthcheck.SetProcessStart(start)()
+	c := &proxy.Client{Instances: []string{"proj:region:a"}}
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithMinUptime(time.Hour))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	now := start.UnixNano()
+	healthcheck.SetClock(s, func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) })
+	healthcheck.SetProbe(s, func(context.Context, string) error { return nil })
+	s.NotifyStarted()
+
+	tcs := []struct {
+		after time.Duration
+		want  int
+	}{
+		{0, http.StatusServiceUnavailable},
+		{59 * time.Minute, http.StatusServiceUnavailable},
+		{61 * time.Minute, http.StatusOK},
+	}
+	for _, tc := range tcs {
+		atomic.StoreInt64(&now, start.Add(tc.after).UnixNano())
+		for _, path := range []string{readinessPath, readinessPath + "?instance=proj:region:a"} {
+			resp, err := http.Get("http://localhost:" + testPort + path)
+			if err != nil {
+				t.Fatalf("HTTP GET failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Errorf("After %v, got status code %v from %s instead of %v", tc.after, resp.StatusCode, path, tc.want)
+			}
+		}
+	}
+}
+
+// Test to verify that the readiness gauge follows the most recent readiness
+// evaluation and the liveness gauge the liveness of the proxy.
+func TestStateGauges(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithMetrics())
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	check := func(when string, want ...string) {
+		t.Helper()
+		for _, path := range []string{readinessPath, livenessPath} {
+			resp, err := http.Get("http://localhost:" + testPort + path)
+			if err != nil {
+				t.Fatalf("HTTP GET failed: %v", err)
+			}
+			resp.Body.Close()
+		}
+		body := getBody(t, metricsPath)
+		for _, w := range want {
+			if !strings.Contains(body, w+"\n") {
+				t.Errorf("Metrics %s did not contain %q:\n%s", when, w, body)
+			}
+		}
+	}
+
+	if body := getBody(t, metricsPath); !strings.Contains(body, "cloudsql_proxy_live 0\n") {
+		t.Errorf("Metrics before any liveness evaluation did not contain %q:\n%s", "cloudsql_proxy_live 0", body)
+	}
+	check("before NotifyStarted", "cloudsql_proxy_ready 0", "cloudsql_proxy_live 1")
+	s.NotifyStarted()
+	check("after NotifyStarted", "cloudsql_proxy_ready 1", "cloudsql_proxy_live 1")
+	healthcheck.SetLive(s, func() bool { return false })
+	if body := getBody(t, metricsPath); !strings.Contains(body, "cloudsql_proxy_live 1\n") {
+		t.Errorf("Metrics did not report the cached liveness result:\n%s", body)
+	}
+	check("after liveness failed", "cloudsql_proxy_live 0")
+}
+
+// Test to verify that checks can be registered up to the configured limit,
+// and that registered checks gate readiness and liveness.
+func TestMaxChecks(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithMaxChecks(2))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	var failing int32
+	check := func(context.Context) error {
+		if atomic.LoadInt32(&failing) == 1 {
+			return errors.New("failing")
+		}
+		return nil
+	}
+	if err := s.RegisterReadinessCheck("cache", check); err != nil {
+		t.Fatalf("RegisterReadinessCheck under the limit failed: %v", err)
+	}
+	if err := s.RegisterLivenessCheck("loop", check); err != nil {
+		t.Fatalf("RegisterLivenessCheck under the limit failed: %v", err)
+	}
+	if err := s.RegisterReadinessCheck("flags", check); err == nil {
+		t.Error("RegisterReadinessCheck beyond the limit succeeded, want an error")
+	}
+	if err := s.RegisterLivenessCheck("flags", check); err == nil {
+		t.Error("RegisterLivenessCheck beyond the limit succeeded, want an error")
+	}
+
+	for _, tc := range []struct {
+		failing int32
+		want    int
+	}{
+		{0, http.StatusOK},
+		{1, http.StatusServiceUnavailable},
+	} {
+		atomic.StoreInt32(&failing, tc.failing)
+		for _, path := range []string{readinessPath, livenessPath} {
+			resp, err := http.Get("http://localhost:" + testPort + path)
+			if err != nil {
+				t.Fatalf("HTTP GET failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Errorf("Got status code %v from %s instead of %v (failing=%d)", resp.StatusCode, path, tc.want, tc.failing)
+			}
+		}
+	}
+}
+
+// Test to verify that Servers do not share handler registrations, so several
+// can exist in one process.
+func TestMultipleServers(t *testing.T) {
+	const otherPort = "8091"
+	for _, port := range []string{testPort, otherPort} {
+		s, err := healthcheck.NewServer(&proxy.Client{}, port)
+		if err != nil {
+			t.Fatalf("Could not initialize health check on port %s: %v", port, err)
+		}
+		defer s.Close(context.Background())
+	}
+
+	for _, port := range []string{testPort, otherPort} {
+		resp, err := http.Get("http://localhost:" + port + livenessPath)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Got status code %v from port %s instead of %v", resp.StatusCode, port, http.StatusOK)
+		}
+	}
+}
+
+// fakeDeregisterer counts its calls and fails with err.
+type fakeDeregisterer struct {
+	calls int32
+	err   error
+	// served is whether the health check endpoints were still served when
+	// Deregister was called.
+	served bool
+}
+
+func (d *fakeDeregisterer) Deregister(context.Context) error {
+	atomic.AddInt32(&d.calls, 1)
+	if resp, err := http.Get("http://localhost:" + testPort + livenessPath); err == nil {
+		resp.Body.Close()
+		d.served = true
+	}
+	return d.err
+}
+
+// Test to verify that Close deregisters the proxy exactly once when it
+// starts draining, and that a failure to deregister is logged but does not
+// stop draining.
+func TestDeregisterer(t *testing.T) {
+	var logged int32
+	errorf := logging.Errorf
+	defer func() { logging.Errorf = errorf }()
+	logging.Errorf = func(format string, args ...interface{}) {
+		if strings.Contains(fmt.Sprintf(format, args...), "consul unavailable") {
+			atomic.AddInt32(&logged, 1)
+		}
+	}
+
+	d := &fakeDeregisterer{err: errors.New("consul unavailable")}
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithDeregisterer(d))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Close(context.Background()); err != nil {
+			t.Fatalf("Close #%d failed: %v", i, err)
+		}
+	}
+
+	if got := atomic.LoadInt32(&d.calls); got != 1 {
+		t.Errorf("Deregister was called %d times, want 1", got)
+	}
+	if !d.served {
+		t.Error("Deregister was called after the health check server stopped, want at drain start")
+	}
+	if got := atomic.LoadInt32(&logged); got != 1 {
+		t.Errorf("Deregistration failure was logged %d times, want 1", got)
+	}
+	if _, err := http.Get("http://localhost:" + testPort + livenessPath); err == nil {
+		t.Error("Health check server still serving after Close")
+	}
+}
+
+// Test to verify that NewServer binds a full "host:port" address, including a
+// bracketed IPv6 host, and rejects an invalid one.
+func TestBindAddress(t *testing.T) {
+	addrs := []string{"127.0.0.1:" + testPort}
+	if ln, err := net.Listen("tcp", "[::1]:0"); err == nil {
+		ln.Close()
+		addrs = append(addrs, "[::1]:"+testPort)
+	} else {
+		t.Logf("Skipping IPv6 address: %v", err)
+	}
+	for _, addr := range addrs {
+		s, err := healthcheck.NewServer(&proxy.Client{}, addr)
+		if err != nil {
+			t.Fatalf("NewServer(%q): %v", addr, err)
+		}
+		resp, err := http.Get("http://" + addr + livenessPath)
+		if err != nil {
+			t.Errorf("HTTP GET on %v failed: %v", addr, err)
+		} else if resp.StatusCode != http.StatusOK {
+			t.Errorf("%v: got status code %v instead of %v", addr, resp.StatusCode, http.StatusOK)
+		}
+		if err := s.Close(context.Background()); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+
+	for _, addr := range []string{"::1:" + testPort, "[::1:" + testPort, "localhost:", "1.2.3.4:" + testPort + ":1", "localhost:http"} {
+		if s, err := healthcheck.NewServer(&proxy.Client{}, addr); err == nil {
+			s.Close(context.Background())
+			t.Errorf("NewServer(%q) succeeded, want error", addr)
+		}
+	}
+}
+
+// Test to verify that the proxy is not ready once the client certificate of
+// an instance does not chain to the instance's CA.
+func TestCertChainCheck(t *testing.T) {
+	c, stop := newInstance(t)
+	defer stop()
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithCertChainCheck())
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	readiness := func(inst string) (int, string) {
+		t.Helper()
+		conn, err := c.Dial(inst)
+		if err != nil {
+			t.Fatalf("Dial(%q) failed: %v", inst, err)
+		}
+		conn.Close()
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:"+testPort+readinessPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var got struct {
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatalf("Failed to decode readiness: %v", err)
+		}
+		return resp.StatusCode, got.Reason
+	}
+
+	if code, reason := readiness("proj:region:good"); code != http.StatusOK {
+		t.Errorf("Got status code %v instead of %v with a valid chain: %s", code, http.StatusOK, reason)
+	}
+
+	other, otherKey := newCA(t, "other CA")
+	c.Certs.(*instanceCerts).cert = newLeaf(t, other, otherKey, x509.ExtKeyUsageClientAuth)
+	code, reason := readiness("proj:region:bad")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Got status code %v instead of %v with an invalid chain", code, http.StatusServiceUnavailable)
+	}
+	if want := `invalid cert chain for instance "proj:region:bad"`; !strings.Contains(reason, want) {
+		t.Errorf("Reason %q does not contain %q", reason, want)
+	}
+
+	for i := 2; i <= 7; i++ {
+		_, reason = readiness(fmt.Sprintf("proj:region:bad%d", i))
+	}
+	for _, want := range []string{`invalid cert chain for instances "proj:region:bad": `, `; "proj:region:bad5": `, " and 2 more"} {
+		if !strings.Contains(reason, want) {
+			t.Errorf("Reason %q does not contain %q", reason, want)
+		}
+	}
+	if strings.Contains(reason, "bad6") {
+		t.Errorf("Reason %q names more than 5 instances", reason)
+	}
+}
+
+// Test to verify that /metrics reports the connection limit and totals, and
+// counts failed readiness and liveness checks.
+func TestProbeFailureMetrics(t *testing.T) {
+	c := &proxy.Client{MaxConnections: 10, TotalConnections: 7, RefusedConnections: 2}
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithMetrics())
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	var live int32
+	healthcheck.SetLive(s, func() bool { return atomic.LoadInt32(&live) == 1 })
+
+	for _, path := range []string{readinessPath, readinessPath, livenessPath} {
+		resp, err := http.Get("http://localhost:" + testPort + path)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	body := getBody(t, metricsPath)
+	for _, want := range []string{
+		"cloudsql_proxy_max_connections 10\n",
+		"cloudsql_proxy_connections_total 7\n",
+		"cloudsql_proxy_refused_connections_total 2\n",
+		`cloudsql_proxy_probe_failures_total{probe="readiness"} 2` + "\n",
+		`cloudsql_proxy_probe_failures_total{probe="liveness"} 1` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Metrics did not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+// Test to verify that /metrics reports the dial latency histogram and the
+// certificate refreshes attempted and failed.
+func TestDialMetrics(t *testing.T) {
+	c := &proxy.Client{Certs: failingCerts{}}
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithMetrics())
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	handleConns(t, c, "proj:region:a", "proj:region:b")
+
+	body := getBody(t, metricsPath)
+	for _, want := range []string{
+		"# TYPE cloudsql_proxy_dial_latency_seconds histogram\n",
+		`cloudsql_proxy_dial_latency_seconds_bucket{le="10"} 2` + "\n",
+		`cloudsql_proxy_dial_latency_seconds_bucket{le="+Inf"} 2` + "\n",
+		"cloudsql_proxy_dial_latency_seconds_count 2\n",
+		"cloudsql_proxy_certificate_refreshes_total 2\n",
+		"cloudsql_proxy_certificate_refresh_errors_total 2\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Metrics did not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+// Test to verify that reaching MaxConnections does not fail readiness within
+// the soft start window, but does after it.
+func TestSoftStart(t *testing.T) {
+	c := &proxy.Client{MaxConnections: 1}
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithSoftStart(time.Minute))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	start := time.Now()
+	now := start.UnixNano()
+	healthcheck.SetClock(s, func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) })
+	s.NotifyStarted()
+	c.ConnectionsCounter = c.MaxConnections // Simulate reaching the limit for maximum number of connections
+
+	for _, tc := range []struct {
+		after time.Duration
+		want  int
+	}{
+		{30 * time.Second, http.StatusOK},
+		{2 * time.Minute, http.StatusServiceUnavailable},
+	} {
+		atomic.StoreInt64(&now, start.Add(tc.after).UnixNano())
+		resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%v after startup, got status code %v instead of %v", tc.after, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+// migrationChecker is a healthcheck.Checker that fails until done is set.
+type migrationChecker struct {
+	done int32
+}
+
+func (m *migrationChecker) Check(context.Context) error {
+	if atomic.LoadInt32(&m.done) == 0 {
+		return errors.New("migrations pending")
+	}
+	return nil
+}
+
+// Test to verify that a Checker registered with RegisterCheck makes the proxy
+// not ready while it fails, and that its result is part of the JSON readiness
+// response.
+func TestRegisterCheck(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	m := &migrationChecker{}
+	if err := s.RegisterCheck("migrations", m); err != nil {
+		t.Fatalf("RegisterCheck failed: %v", err)
+	}
+	if err := s.RegisterCheck("nil", nil); err == nil {
+		t.Error("RegisterCheck with a nil Checker succeeded, want an error")
+	}
+
+	want := `readiness checks failed: "migrations" (migrations pending)`
+	if got := getReason(t, readinessPath); got != want {
+		t.Errorf("Got readiness reason %q, want %q", got, want)
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:"+testPort+readinessPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var got struct {
+		CustomChecks []struct {
+			Name   string `json:"name"`
+			Passed bool   `json:"passed"`
+			Error  string `json:"error"`
+		} `json:"customChecks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode readiness: %v", err)
+	}
+	if len(got.CustomChecks) != 1 || got.CustomChecks[0].Name != "migrations" || got.CustomChecks[0].Passed || got.CustomChecks[0].Error != "migrations pending" {
+		t.Errorf("Got custom checks %+v, want the failed migrations check", got.CustomChecks)
+	}
+
+	atomic.StoreInt32(&m.done, 1)
+	if got := getBody(t, readinessPath); got != "ok" {
+		t.Errorf("Got readiness body %q once migrations ran, want ok", got)
+	}
+}
+
+// Test to verify that /checks reports the most recent result of each
+// registered check.
+func TestChecksEndpoint(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	if err := s.RegisterReadinessCheck("cache", func(context.Context) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterReadinessCheck("flags", func(context.Context) error { return errors.New("flag service unreachable") }); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterLivenessCheck("loop", func(context.Context) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	resp.Body.Close()
+
+	type check struct {
+		Name      string `json:"name"`
+		Kind      string `json:"kind"`
+		Evaluated bool   `json:"evaluated"`
+		Passed    bool   `json:"passed"`
+		Error     string `json:"error"`
+	}
+	var got []check
+	if err := json.Unmarshal([]byte(getBody(t, "/checks")), &got); err != nil {
+		t.Fatalf("Failed to decode checks: %v", err)
+	}
+	want := []check{
+		{Name: "cache", Kind: "readiness", Evaluated: true, Passed: true},
+		{Name: "flags", Kind: "readiness", Evaluated: true, Error: "flag service unreachable"},
+		{Name: "loop", Kind: "liveness"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got checks %+v, want %+v", got, want)
+	}
+}
+
+// Test to verify that the proxy is not ready once draining, even though it
+// has started and has connections available.
+func TestDraining(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	s.NotifyStarted()
+	resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("%v returned status code %v before draining instead of %v", readinessPath, resp.StatusCode, http.StatusOK)
+	}
+
+	s.NotifyDraining()
+	resp, err = http.Get("http://localhost:" + testPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("%v returned status code %v while draining instead of %v", readinessPath, resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if string(body) != "error" {
+		t.Errorf("Got body %q, want %q", body, "error")
+	}
+	if got, want := getReason(t, readinessPath), "proxy is draining"; got != want {
+		t.Errorf("Got reason %q, want %q", got, want)
+	}
+
+	resp, err = http.Get("http://localhost:" + testPort + livenessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("%v returned status code %v while draining instead of %v", livenessPath, resp.StatusCode, http.StatusOK)
+	}
+}
+
+// Test to verify that the dependency check resolves its host once per DNS
+// cache TTL.
+func TestDNSCache(t *testing.T) {
+	dep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		// Close each connection so that every check dials again.
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer dep.Close()
+	_, port, err := net.SplitHostPort(dep.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort,
+		healthcheck.WithDNSCache(time.Minute),
+		healthcheck.WithDependencyCheck(healthcheck.DependencyCheck{
+			URL:      "http://dependency.test:" + port,
+			Interval: time.Nanosecond,
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	var now int64
+	healthcheck.SetClock(s, func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) })
+	var lookups int32
+	healthcheck.SetResolver(s, func(_ context.Context, host string) ([]string, error) {
+		if host != "dependency.test" {
+			return nil, fmt.Errorf("unexpected host %q", host)
+		}
+		atomic.AddInt32(&lookups, 1)
+		return []string{"127.0.0.1"}, nil
+	})
+	s.NotifyStarted()
+
+	ready := func() {
+		t.Helper()
+		resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Got status code %v instead of %v", resp.StatusCode, http.StatusOK)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		// The dependency check runs at most once per Interval.
+		time.Sleep(time.Millisecond)
+		ready()
+	}
+	if got := atomic.LoadInt32(&lookups); got != 1 {
+		t.Errorf("Got %d lookups within the TTL, want 1", got)
+	}
+
+	atomic.StoreInt64(&now, int64(2*time.Minute))
+	time.Sleep(time.Millisecond)
+	ready()
+	if got := atomic.LoadInt32(&lookups); got != 2 {
+		t.Errorf("Got %d lookups after the TTL expired, want 2", got)
+	}
+}
+
+// failingListener is a net.Listener whose Accept fails with err.
+type failingListener struct {
+	net.Listener
+	err error
+}
+
+func (l failingListener) Accept() (net.Conn, error) {
+	return nil, l.err
+}
+
+// Test to verify that an error serving the health check endpoints is sent on
+// Err.
+func TestServeError(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	wantErr := errors.New("accept failed")
+	healthcheck.Serve(s, failingListener{Listener: ln, err: wantErr})
+
+	select {
+	case err := <-s.Err():
+		if !errors.Is(err, wantErr) {
+			t.Errorf("Got error %v, want %v", err, wantErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the serve error")
+	}
+}
+
+// Test to verify that closing the Server does not send an error on Err.
+func TestServeErrorClose(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatalf("Failed to close health check: %v", err)
+	}
+	select {
+	case err := <-s.Err():
+		t.Errorf("Got error %v after Close, want none", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// blockingWriter is an io.Writer whose writes block until release is closed.
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (w blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+// Test to verify that the proxy is not ready while its log buffer is full.
+func TestLogBufferFull(t *testing.T) {
+	const size = 2
+	w := blockingWriter{release: make(chan struct{})}
+	b := logging.NewBufferedWriter(w, size)
+	defer b.Close()
+	defer close(w.release)
+
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithLogBufferCheck(b))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %v with an empty log buffer instead of %v", resp.StatusCode, http.StatusOK)
+	}
+
+	// One more write than the buffer holds fills it even if the first one is
+	// already being written.
+	for i := 0; i <= size; i++ {
+		fmt.Fprintf(b, "log line %d\n", i)
+	}
+	if got, want := getReason(t, readinessPath), "log buffer full"; got != want {
+		t.Errorf("Got readiness reason %q, want %q", got, want)
+	}
+}
+
+// Test to verify that the readiness body names every failed check, and that a
+// check ignoring its deadline fails rather than blocking the probe.
+func TestReadinessChecksFailed(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	healthcheck.SetCheckTimeout(s, 50*time.Millisecond)
+	s.NotifyStarted()
+
+	block := make(chan struct{})
+	defer close(block)
+	checks := []struct {
+		name string
+		fn   healthcheck.CheckFunc
+	}{
+		{"cache", func(context.Context) error { return errors.New("cache cold") }},
+		{"db", func(context.Context) error { return nil }},
+		{"flags", func(context.Context) error {
+			<-block
+			return nil
+		}},
+	}
+	for _, c := range checks {
+		if err := s.RegisterReadinessCheck(c.name, c.fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := `readiness checks failed: "cache" (cache cold), "flags" (context deadline exceeded)`
+	if got := getReason(t, readinessPath); got != want {
+		t.Errorf("Got readiness reason %q, want %q", got, want)
+	}
+}
+
+// Test to verify that readiness fails promptly once evaluating it takes longer
+// than the readiness timeout.
+func TestReadinessTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithReadinessTimeout(timeout))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	block := make(chan struct{})
+	defer close(block)
+	err = s.RegisterReadinessCheck("slow", func(context.Context) error {
+		<-block
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	want := "readiness checks timed out after 100ms"
+	if got := getReason(t, readinessPath); got != want {
+		t.Errorf("Got readiness reason %q, want %q", got, want)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Readiness took %v with a %v timeout", d, timeout)
+	}
+
+	if _, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithReadinessTimeout(0)); err == nil {
+		t.Error("NewServer succeeded with a zero readiness timeout")
+	}
+}
+
+// Test to verify that /status answers conditional requests with 304 Not
+// Modified until the proxy's state changes.
+func TestStatusConditional(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	now := time.Unix(1600000000, 0).UnixNano()
+	healthcheck.SetClock(s, func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) })
+
+	get := func(header, value string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:"+testPort+"/status", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Got status code %v instead of %v", resp.StatusCode, http.StatusOK)
+	}
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("Got ETag %q and Last-Modified %q, want both set", etag, lastModified)
+	}
+
+	atomic.AddInt64(&now, int64(time.Minute))
+	if resp := get("If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Got status code %v for an unchanged ETag instead of %v", resp.StatusCode, http.StatusNotModified)
+	}
+	if resp := get("If-Modified-Since", lastModified); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Got status code %v for an unchanged Last-Modified instead of %v", resp.StatusCode, http.StatusNotModified)
+	}
+
+	s.NotifyStarted()
+	resp = get("If-None-Match", etag)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %v after a change instead of %v", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Header.Get("ETag"); got == "" || got == etag {
+		t.Errorf("Got ETag %q after a change, want a new one (was %q)", got, etag)
+	}
+	if resp := get("If-Modified-Since", lastModified); resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %v for a stale Last-Modified instead of %v", resp.StatusCode, http.StatusOK)
+	}
+}
+
+// Test to verify that /readiness describes the failed criteria as JSON to
+// clients that accept it, and keeps the plain text body otherwise.
+func TestReadinessJSON(t *testing.T) {
+	c := &proxy.Client{MaxConnections: 1}
+	s, err := healthcheck.NewServer(c, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+	atomic.StoreUint64(&c.ConnectionsCounter, 1)
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:"+testPort+readinessPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Got Content-Type %q, want application/json", got)
+	}
+	var got struct {
+		Ready           bool            `json:"ready"`
+		Checks          map[string]bool `json:"checks"`
+		MaxConnections  uint64          `json:"maxConnections"`
+		OpenConnections uint64          `json:"openConnections"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode readiness: %v", err)
+	}
+	if got.Ready || !got.Checks["started"] || got.Checks["connections"] || got.MaxConnections != 1 || got.OpenConnections != 1 {
+		t.Errorf("Got readiness %+v, want not ready, started, without connections available, and 1 of 1 connections open", got)
+	}
+
+	if body := getBody(t, readinessPath); body != "error" {
+		t.Errorf("Got plain text body %q, want %q", body, "error")
+	}
+}
+
+// Test to verify that the "connections" readiness criterion fails once open
+// connections reach the readiness threshold, before the limit itself.
+func TestReadinessJSONConnectionsThreshold(t *testing.T) {
+	c := &proxy.Client{MaxConnections: 10}
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithConnectionsThreshold(0.5))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+	atomic.StoreUint64(&c.ConnectionsCounter, 5)
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:"+testPort+readinessPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var got struct {
+		Ready  bool            `json:"ready"`
+		Checks map[string]bool `json:"checks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode readiness: %v", err)
+	}
+	if got.Ready || got.Checks["connections"] {
+		t.Errorf("Got readiness %+v, want not ready and the connections check failing", got)
+	}
+}
+
+// Test to verify that the JSON readiness response describes each instance
+// once and its most recent probe, and that the instance policy decides how
+// many probed instances must be reachable.
+func TestReadinessInstances(t *testing.T) {
+	for _, tc := range []struct {
+		policy healthcheck.InstancePolicy
+		want   int
+	}{
+		{healthcheck.AllInstancesPolicy, http.StatusServiceUnavailable},
+		{healthcheck.AnyInstancePolicy, http.StatusOK},
+	} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			c := &proxy.Client{Instances: []string{"proj:region:c", "proj:region:a"}}
+			s, err := healthcheck.NewServer(c, testPort,
+				healthcheck.WithDialProbe("proj:region:a", "proj:region:b", "proj:region:b"),
+				healthcheck.WithInstancePolicy(tc.policy))
+			if err != nil {
+				t.Fatalf("Could not initialize health check: %v", err)
+			}
+			defer s.Close(context.Background())
+			s.NotifyStarted()
+			healthcheck.SetProbe(s, func(_ context.Context, inst string) error {
+				if inst == "proj:region:b" {
+					return errors.New("connection refused")
+				}
+				return nil
+			})
+
+			req, err := http.NewRequest(http.MethodGet, "http://localhost:"+testPort+readinessPath, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("HTTP GET failed: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Errorf("Got status code %v instead of %v", resp.StatusCode, tc.want)
+			}
+
+			type lastProbe struct {
+				Reachable        bool       `json:"reachable"`
+				Error            string     `json:"error"`
+				UnreachableSince *time.Time `json:"unreachableSince"`
+			}
+			var got struct {
+				Instances []struct {
+					Name      string     `json:"name"`
+					Probed    bool       `json:"probed"`
+					LastProbe *lastProbe `json:"lastProbe"`
+				} `json:"instances"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("Failed to decode readiness: %v", err)
+			}
+			if len(got.Instances) != 3 {
+				t.Fatalf("Got instances %+v, want 3", got.Instances)
+			}
+			a, b, cc := got.Instances[0], got.Instances[1], got.Instances[2]
+			if a.Name != "proj:region:a" || !a.Probed || a.LastProbe == nil || !a.LastProbe.Reachable {
+				t.Errorf("Got instance %+v, want proj:region:a probed and reachable", a)
+			}
+			if b.Name != "proj:region:b" || !b.Probed || b.LastProbe == nil || b.LastProbe.Reachable ||
+				b.LastProbe.Error != "connection refused" || b.LastProbe.UnreachableSince == nil {
+				t.Errorf("Got instance %+v, want proj:region:b probed and unreachable", b)
+			}
+			if cc.Name != "proj:region:c" || cc.Probed || cc.LastProbe != nil {
+				t.Errorf("Got instance %+v, want proj:region:c not probed", cc)
+			}
+		})
+	}
+
+	if _, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithInstancePolicy("most")); err == nil {
+		t.Error("NewServer succeeded with an invalid instance policy")
+	}
+}
+
+// Test to verify that /readiness?instance= reports the readiness of that
+// instance alone, and rejects instances the proxy does not know of.
+func TestReadinessSingleInstance(t *testing.T) {
+	c := &proxy.Client{Instances: []string{"proj:region:a", "proj:region:c"}}
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithDialProbe("proj:region:a", "proj:region:b"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+	healthcheck.SetProbe(s, func(_ context.Context, inst string) error {
+		if inst == "proj:region:b" {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+
+	get := func(inst string, json bool) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:"+testPort+readinessPath+"?instance="+inst, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if json {
+			req.Header.Set("Accept", "application/json")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		return resp
+	}
+
+	for _, tc := range []struct {
+		inst     string
+		wantCode int
+		wantBody string
+	}{
+		{"proj:region:a", http.StatusOK, "ok"},
+		{"proj:region:c", http.StatusOK, "ok"},
+		{"proj:region:b", http.StatusServiceUnavailable, "error"},
+		{"proj:region:d", http.StatusNotFound, `error: unknown instance "proj:region:d"` + "\n"},
+	} {
+		resp := get(tc.inst, false)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Failed to read body: %v", err)
+		}
+		if resp.StatusCode != tc.wantCode || string(body) != tc.wantBody {
+			t.Errorf("Got %v %q for instance %q, want %v %q", resp.StatusCode, body, tc.inst, tc.wantCode, tc.wantBody)
+		}
+	}
+
+	resp := get("proj:region:b", true)
+	defer resp.Body.Close()
+	var got struct {
+		Ready    bool   `json:"ready"`
+		Reason   string `json:"reason"`
+		Instance struct {
+			Name      string `json:"name"`
+			Probed    bool   `json:"probed"`
+			LastProbe *struct {
+				Reachable bool   `json:"reachable"`
+				Error     string `json:"error"`
+			} `json:"lastProbe"`
+		} `json:"instance"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode readiness: %v", err)
+	}
+	inst := got.Instance
+	if got.Ready || got.Reason != `instance "proj:region:b" is unreachable: connection refused` || inst.Name != "proj:region:b" || !inst.Probed ||
+		inst.LastProbe == nil || inst.LastProbe.Reachable || inst.LastProbe.Error != "connection refused" {
+		t.Errorf("Got readiness %+v, want proj:region:b not ready and unreachable", got)
+	}
+}
+
+// Test to verify that /readiness?instance= fails while the proxy as a whole is
+// not ready, and once the readiness timeout expires, counting each failure.
+func TestReadinessSingleInstanceProxyState(t *testing.T) {
+	c := &proxy.Client{Instances: []string{"proj:region:a", "proj:region:slow"}}
+	s, err := healthcheck.NewServer(c, testPort,
+		healthcheck.WithMetrics(),
+		healthcheck.WithReadinessTimeout(50*time.Millisecond),
+		healthcheck.WithDialProbe("proj:region:a", "proj:region:slow"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	healthcheck.SetProbe(s, func(ctx context.Context, inst string) error {
+		if inst == "proj:region:slow" {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+
+	check := func(inst string, wantCode int, wantReason string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:"+testPort+readinessPath+"?instance="+inst, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var got struct {
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatalf("Failed to decode readiness: %v", err)
+		}
+		if resp.StatusCode != wantCode || got.Reason != wantReason {
+			t.Errorf("Got %v %q for instance %q, want %v %q", resp.StatusCode, got.Reason, inst, wantCode, wantReason)
+		}
+	}
+
+	check("proj:region:a", http.StatusServiceUnavailable, "proxy has not finished starting up")
+	s.NotifyStarted()
+	check("proj:region:a", http.StatusOK, "")
+	check("proj:region:slow", http.StatusServiceUnavailable, "readiness checks timed out after 50ms")
+	s.NotifyDraining()
+	check("proj:region:a", http.StatusServiceUnavailable, "proxy is draining")
+
+	want := `cloudsql_proxy_probe_failures_total{probe="readiness"} 3` + "\n"
+	if body := getBody(t, metricsPath); !strings.Contains(body, want) {
+		t.Errorf("Metrics did not contain %q:\n%s", want, body)
+	}
+}
+
+// Test to verify that /connections reports the headroom left under
+// MaxConnections, and -1 when there is no limit.
+func TestConnections(t *testing.T) {
+	tests := []struct {
+		name      string
+		max, open uint64
+		want      int64
+	}{
+		{name: "under limit", max: 10, open: 3, want: 7},
+		{name: "at limit", max: 10, open: 10, want: 0},
+		{name: "over limit", max: 10, open: 12, want: 0},
+		{name: "unlimited", max: 0, open: 3, want: -1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &proxy.Client{MaxConnections: tc.max, TotalConnections: 20, RefusedConnections: 4}
+			atomic.StoreUint64(&c.ConnectionsCounter, tc.open)
+			s, err := healthcheck.NewServer(c, testPort)
+			if err != nil {
+				t.Fatalf("Could not initialize health check: %v", err)
+			}
+			defer s.Close(context.Background())
+
+			var got struct {
+				OpenConnections    uint64 `json:"openConnections"`
+				MaxConnections     uint64 `json:"maxConnections"`
+				Available          int64  `json:"available"`
+				TotalConnections   uint64 `json:"totalConnections"`
+				RefusedConnections uint64 `json:"refusedConnections"`
+			}
+			if err := json.Unmarshal([]byte(getBody(t, "/connections")), &got); err != nil {
+				t.Fatalf("Failed to decode connections: %v", err)
+			}
+			if got.OpenConnections != tc.open || got.MaxConnections != tc.max || got.Available != tc.want {
+				t.Errorf("Got %+v, want %d open, %d max and %d available", got, tc.open, tc.max, tc.want)
+			}
+			if got.TotalConnections != 20 || got.RefusedConnections != 4 {
+				t.Errorf("Got %+v, want 20 total and 4 refused connections", got)
+			}
+		})
+	}
+}
+
+// Test to verify that faults injected on /admin/faults make the probes fail or
+// slow down until they expire, and that injecting them requires the token.
+func TestFaultInjection(t *testing.T) {
+	const token = "secret"
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithFaultInjection(token))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	var now int64
+	healthcheck.SetClock(s, func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) })
+	s.NotifyStarted()
+
+	// POSTs are not retried on a kept-alive connection to a server closed
+	// by an earlier test, so use a client without any.
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+	inject := func(method, auth, query string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://localhost:"+testPort+"/admin/faults?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("HTTP %s failed: %v", method, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	status := func(path string) int {
+		t.Helper()
+		resp, err := http.Get("http://localhost:" + testPort + path)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	rejected := []struct {
+		method, auth, query string
+		want                int
+	}{
+		{http.MethodPost, "", "type=readiness&duration=1m", http.StatusUnauthorized},
+		{http.MethodPost, "wrong", "type=readiness&duration=1m", http.StatusUnauthorized},
+		{http.MethodGet, token, "type=readiness&duration=1m", http.StatusMethodNotAllowed},
+		{http.MethodPost, token, "type=disk&duration=1m", http.StatusBadRequest},
+		{http.MethodPost, token, "type=readiness", http.StatusBadRequest},
+		{http.MethodPost, token, "type=latency&duration=1m", http.StatusBadRequest},
+	}
+	for _, r := range rejected {
+		if got := inject(r.method, r.auth, r.query); got != r.want {
+			t.Errorf("%s %s with token %q returned status code %v instead of %v", r.method, r.query, r.auth, got, r.want)
+		}
+	}
+	if got := status(readinessPath); got != http.StatusOK {
+		t.Fatalf("Readiness returned status code %v after rejected faults instead of %v", got, http.StatusOK)
+	}
+
+	for _, path := range []string{readinessPath, livenessPath} {
+		kind := strings.TrimPrefix(path, "/")
+		if got := inject(http.MethodPost, token, "type="+kind+"&duration=1m"); got != http.StatusOK {
+			t.Fatalf("Injecting %s fault returned status code %v instead of %v", kind, got, http.StatusOK)
+		}
+		if got := status(path); got != http.StatusServiceUnavailable {
+			t.Errorf("%v returned status code %v with an injected fault instead of %v", path, got, http.StatusServiceUnavailable)
+		}
+		atomic.AddInt64(&now, int64(2*time.Minute))
+		if got := status(path); got != http.StatusOK {
+			t.Errorf("%v returned status code %v after the fault expired instead of %v", path, got, http.StatusOK)
+		}
+	}
+
+	const latency = 200 * time.Millisecond
+	if got := inject(http.MethodPost, token, "type=latency&duration=1m&latency="+latency.String()); got != http.StatusOK {
+		t.Fatalf("Injecting latency fault returned status code %v instead of %v", got, http.StatusOK)
+	}
+	start := time.Now()
+	status(livenessPath)
+	if d := time.Since(start); d < latency {
+		t.Errorf("Liveness took %v with injected latency, want at least %v", d, latency)
+	}
+	atomic.AddInt64(&now, int64(2*time.Minute))
+	start = time.Now()
+	status(livenessPath)
+	if d := time.Since(start); d >= latency {
+		t.Errorf("Liveness took %v after the latency fault expired, want under %v", d, latency)
+	}
+}
+
+// Test to verify that faults cannot be injected unless enabled.
+func TestFaultInjectionDisabled(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:"+testPort+"/admin/faults?type=liveness&duration=1m", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("HTTP POST failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+// Test to verify that the health check endpoints can be served on a Unix
+// domain socket, replacing a stale socket and removing it on Close.
+func TestUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix domain sockets are not reliably supported on Windows")
+	}
+	dir, err := ioutil.TempDir("", "healthcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "health.sock")
+
+	// Leave a stale socket behind, as a crashed process would.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s, err := healthcheck.NewServer(&proxy.Client{}, path, healthcheck.WithNetwork("unix"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	s.NotifyStarted()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	defer client.CloseIdleConnections()
+	for _, p := range []string{livenessPath, readinessPath} {
+		resp, err := client.Get("http://unix" + p)
+		if err != nil {
+			t.Fatalf("HTTP GET over the socket failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%v returned status code %v instead of %v", p, resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatalf("Failed to close health check: %v", err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("Socket still exists after Close: %v", err)
+	}
+}
+
+// Test to verify that a file other than a socket at the Unix domain socket
+// path is not removed.
+func TestUnixSocketNotSocket(t *testing.T) {
+	f, err := ioutil.TempFile("", "healthcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if _, err := healthcheck.NewServer(&proxy.Client{}, f.Name(), healthcheck.WithNetwork("unix")); err == nil {
+		t.Fatal("NewServer succeeded on a path holding a regular file, want an error")
+	}
+	if _, err := os.Stat(f.Name()); err != nil {
+		t.Errorf("File was removed: %v", err)
+	}
+}
+
+// Test to verify that the proxy is not ready while an instance is at its own
+// connection limit, even though the global limit has headroom.
+func TestMaxConnectionsPerInstance(t *testing.T) {
+	const inst = "proj:region:limited"
+	c, stop := newInstance(t)
+	defer stop()
+	c.MaxConnections = 10
+	c.MaxConnectionsPerInstance = map[string]uint64{inst: 1}
+	s, err := healthcheck.NewServer(c, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	src := make(chan proxy.Conn)
+	done := make(chan struct{})
+	go func() {
+		c.Run(src)
+		close(done)
+	}()
+	defer func() {
+		close(src)
+		<-done
+	}()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	src <- proxy.Conn{Instance: inst, Conn: local}
+	for deadline := time.Now().Add(time.Second); c.AvailableConnFor(inst); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Connection to the instance was not opened")
+		}
+	}
+
+	want := fmt.Sprintf("instance %q has reached its maximum connections limit (1)", inst)
+	if got := getReason(t, readinessPath); got != want {
+		t.Errorf("Got readiness reason %q, want %q", got, want)
+	}
+}
+
+// Test to verify that a POST to /quitquitquit calls the quit handler once,
+// without waiting for it, and that other methods are rejected.
+func TestQuitQuitQuit(t *testing.T) {
+	var calls int32
+	called, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithQuitHandler(func() {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(called)
+		}
+		// Block as the proxy would while shutting down.
+		<-release
+	}))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	// POSTs are not retried on a kept-alive connection to a server closed
+	// by an earlier test, so use a client without any.
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+	do := func(method string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://localhost:"+testPort+"/quitquitquit", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("HTTP %s failed: %v", method, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := do(http.MethodGet); got != http.StatusMethodNotAllowed {
+		t.Errorf("GET returned status code %v instead of %v", got, http.StatusMethodNotAllowed)
+	}
+	for i := 0; i < 2; i++ {
+		if got := do(http.MethodPost); got != http.StatusOK {
+			t.Errorf("POST #%d returned status code %v instead of %v", i, got, http.StatusOK)
+		}
+	}
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("Quit handler was not called")
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("Quit handler was called %d times, want 1", got)
+	}
+}
+
+// Test to verify that, with a quit token, /quitquitquit rejects requests
+// without it, even with basic auth credentials, and accepts those bearing it.
+func TestQuitToken(t *testing.T) {
+	quit := make(chan struct{}, 1)
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort,
+		healthcheck.WithQuitHandler(func() { quit <- struct{}{} }),
+		healthcheck.WithQuitToken("secret"),
+		healthcheck.WithBasicAuth("user", "pass"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+	post := func(auth func(*http.Request)) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:"+testPort+"/quitquitquit", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth(req)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("HTTP POST failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := post(func(r *http.Request) { r.SetBasicAuth("user", "pass") }); got != http.StatusUnauthorized {
+		t.Errorf("POST with basic auth returned status code %v instead of %v", got, http.StatusUnauthorized)
+	}
+	if got := post(func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }); got != http.StatusUnauthorized {
+		t.Errorf("POST with the wrong token returned status code %v instead of %v", got, http.StatusUnauthorized)
+	}
+	select {
+	case <-quit:
+		t.Fatal("Quit handler was called for an unauthorized request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := post(func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }); got != http.StatusOK {
+		t.Errorf("POST with the token returned status code %v instead of %v", got, http.StatusOK)
+	}
+	select {
+	case <-quit:
+	case <-time.After(time.Second):
+		t.Fatal("Quit handler was not called")
+	}
+
+	if _, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithQuitToken("secret")); err == nil {
+		t.Error("NewServer with a quit token but no quit handler succeeded, want error")
+	}
+}
+
+// writeKeyPair writes cert and its key PEM encoded to files in dir, returning
+// their paths.
+func writeKeyPair(t *testing.T, dir string, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// Test to verify that the health check endpoints are served over HTTPS with a
+// certificate and key loaded from files.
+func TestTLSFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "healthcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey := newCA(t, "test CA")
+	certFile, keyFile := writeKeyPair(t, dir, newLeaf(t, ca, caKey, x509.ExtKeyUsageServerAuth))
+
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithTLSFiles(certFile, keyFile))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	defer c.CloseIdleConnections()
+	resp, err := c.Get("https://localhost:" + testPort + livenessPath)
+	if err != nil {
+		t.Fatalf("HTTPS GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusOK)
+	}
+}
+
+// Test to verify that the health check endpoints are served over HTTPS with a
+// generated self-signed certificate valid for localhost.
+func TestSelfSignedCert(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithSelfSignedCert())
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+
+	conn, err := tls.Dial("tcp", "localhost:"+testPort, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS dial failed: %v", err)
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	conn.Close()
+	if len(certs) != 1 {
+		t.Fatalf("Got %d peer certificates, want 1", len(certs))
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certs[0])
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	defer c.CloseIdleConnections()
+	resp, err := c.Get("https://localhost:" + testPort + livenessPath)
+	if err != nil {
+		t.Fatalf("HTTPS GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %v instead of %v", resp.StatusCode, http.StatusOK)
+	}
+}
+
+// Test to verify that NewServer fails if the TLS certificate and key files
+// cannot be loaded.
+func TestTLSFilesInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "healthcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey := newCA(t, "test CA")
+	certFile, _ := writeKeyPair(t, dir, newLeaf(t, ca, caKey, x509.ExtKeyUsageServerAuth))
+	// A key that does not match the certificate.
+	otherDir := filepath.Join(dir, "other")
+	if err := os.Mkdir(otherDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	_, otherKeyFile := writeKeyPair(t, otherDir, newLeaf(t, ca, caKey, x509.ExtKeyUsageServerAuth))
+
+	tests := []struct {
+		name              string
+		certFile, keyFile string
+	}{
+		{"mismatched key", certFile, otherKeyFile},
+		{"missing key", certFile, filepath.Join(dir, "missing.pem")},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithTLSFiles(tc.certFile, tc.keyFile))
+			if err == nil {
+				s.Close(context.Background())
+				t.Fatal("NewServer succeeded, want an error")
+			}
+		})
+	}
+}
+
+// Test to verify that the proxy is not live when connections are open but it
+// has been inactive for longer than the maximum, and that an idle proxy
+// without connections stays live.
+func TestMaxInactivity(t *testing.T) {
+	c := &proxy.Client{}
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithMaxInactivity(time.Minute))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	now := time.Now().UnixNano()
+	healthcheck.SetClock(s, func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) })
+
+	status := func() int {
+		t.Helper()
+		resp, err := http.Get("http://localhost:" + testPort + livenessPath)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	atomic.AddInt64(&now, int64(time.Hour))
+	if got := status(); got != http.StatusOK {
+		t.Errorf("Got status code %v while idle without connections instead of %v", got, http.StatusOK)
+	}
+
+	atomic.StoreUint64(&c.ConnectionsCounter, 1)
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("Got status code %v while inactive with an open connection instead of %v", got, http.StatusServiceUnavailable)
+	}
+}
+
+// blockingCerts is a proxy.CertSource whose Local blocks until release is
+// closed, and then fails, so a refresh through it stays in progress.
+type blockingCerts struct {
+	release chan struct{}
+}
+
+func (b blockingCerts) Local(string) (tls.Certificate, error) {
+	<-b.release
+	return tls.Certificate{}, errors.New("no certificate available")
+}
+
+func (blockingCerts) Remote(string) (*x509.Certificate, string, string, string, error) {
+	return nil, "", "", "", errors.New("no certificate available")
+}
+
+// Test to verify that the proxy is not live while a certificate refresh has
+// been in progress for longer than the maximum, and is live again once it
+// finishes.
+func TestMaxRefreshDuration(t *testing.T) {
+	certs := blockingCerts{release: make(chan struct{})}
+	c := &proxy.Client{Certs: certs}
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithMaxRefreshDuration(time.Minute))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	now := time.Now().UnixNano()
+	healthcheck.SetClock(s, func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) })
+
+	status := func() int {
+		t.Helper()
+		resp, err := http.Get("http://localhost:" + testPort + livenessPath)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.Dial("proj:region:inst")
+		close(done)
+	}()
+	for c.RefreshStarted().IsZero() {
+		time.Sleep(time.Millisecond)
+	}
+	if got := status(); got != http.StatusOK {
+		t.Errorf("Got status code %v while refreshing briefly instead of %v", got, http.StatusOK)
+	}
+
+	atomic.AddInt64(&now, int64(time.Hour))
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("Got status code %v with a stuck refresh instead of %v", got, http.StatusServiceUnavailable)
+	}
+
+	close(certs.release)
+	<-done
+	if got := status(); got != http.StatusOK {
+		t.Errorf("Got status code %v after the refresh finished instead of %v", got, http.StatusOK)
+	}
+}
+
+// Test to verify that repeated readiness failures for the same reason are
+// logged at most once per interval, and a new reason is logged immediately.
+func TestReadinessLogInterval(t *testing.T) {
+	var mu sync.Mutex
+	var logs []string
+	errorf := logging.Errorf
+	defer func() { logging.Errorf = errorf }()
+	logging.Errorf = func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	logged := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		l := logs
+		logs = nil
+		return l
+	}
+
+	c := &proxy.Client{MaxConnections: 1}
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithReadinessLogInterval(30*time.Second))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	var now int64
+	healthcheck.SetClock(s, func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) })
+	probe := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			resp, err := http.Get("http://localhost:" + testPort + readinessPath)
+			if err != nil {
+				t.Fatalf("HTTP GET failed: %v", err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	probe(5)
+	if got := logged(); len(got) != 1 || !strings.Contains(got[0], "has not finished starting up") {
+		t.Errorf("Got logs %q for repeated failures, want the first one only", got)
+	}
+
+	atomic.AddInt64(&now, int64(time.Minute))
+	probe(1)
+	if got := logged(); len(got) != 1 || !strings.Contains(got[0], "4 more times") {
+		t.Errorf("Got logs %q after the interval, want the failure with 4 suppressed", got)
+	}
+
+	probe(2)
+	s.NotifyStarted()
+	atomic.StoreUint64(&c.ConnectionsCounter, 1)
+	probe(1)
+	got := logged()
+	if len(got) != 2 || !strings.Contains(got[0], "2 more times because proxy has not finished starting up") || !strings.Contains(got[1], "maximum connections limit") {
+		t.Errorf("Got logs %q for a new reason, want a summary of the old one and the new one", got)
+	}
+}
+
+// Test to verify that the proxy is not ready once the client certificate of an
+// instance has expired, and that its upcoming expiry is logged once.
+func TestCertExpiryCheck(t *testing.T) {
+	var mu sync.Mutex
+	var warnings []string
+	errorf := logging.Errorf
+	defer func() { logging.Errorf = errorf }()
+	logging.Errorf = func(format string, args ...interface{}) {
+		if msg := fmt.Sprintf(format, args...); strings.HasPrefix(msg, "Client certificate") {
+			mu.Lock()
+			warnings = append(warnings, msg)
+			mu.Unlock()
+		}
+	}
+
+	const inst = "proj:region:expiring"
+	c, stop := newInstance(t)
+	defer stop()
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithCertExpiryCheck(5*time.Minute))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	conn, err := c.Dial(inst)
+	if err != nil {
+		t.Fatalf("Dial(%q) failed: %v", inst, err)
+	}
+	conn.Close()
+	notAfter := c.CertExpirations()[inst]
+	var now int64
+	healthcheck.SetClock(s, func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) })
+
+	atomic.StoreInt64(&now, notAfter.Add(-time.Minute).UnixNano())
+	for i := 0; i < 2; i++ {
+		if body := getBody(t, readinessPath); body != "ok" {
+			t.Errorf("Got readiness body %q before expiry, want ok", body)
+		}
+	}
+	mu.Lock()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], inst) {
+		t.Errorf("Got warnings %q before expiry, want one for %q", warnings, inst)
+	}
+	mu.Unlock()
+
+	atomic.StoreInt64(&now, notAfter.Add(time.Hour).UnixNano())
+	want := fmt.Sprintf("client certificate for instance %q expired 1h0m0s ago", inst)
+	if got := getReason(t, readinessPath); got != want {
+		t.Errorf("Got readiness reason %q after expiry, want %q", got, want)
+	}
+
+	// The JSON response reports the failed check and when the certificate
+	// expired.
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:"+testPort+readinessPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var got struct {
+		Checks    map[string]bool `json:"checks"`
+		Instances []struct {
+			Name       string     `json:"name"`
+			CertExpiry *time.Time `json:"certExpiry"`
+		} `json:"instances"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode readiness: %v", err)
+	}
+	if certs, ok := got.Checks["certificates"]; !ok || certs {
+		t.Errorf("Got checks %v after expiry, want certificates false", got.Checks)
+	}
+	if len(got.Instances) != 1 || got.Instances[0].Name != inst || got.Instances[0].CertExpiry == nil || !got.Instances[0].CertExpiry.Equal(notAfter) {
+		t.Errorf("Got instances %+v, want %q with certificate expiry %v", got.Instances, inst, notAfter)
+	}
+}
+
+// Test to verify that the proxy is not ready while the client certificate of
+// an instance is valid for less than the minimum validity.
+func TestMinCertValidity(t *testing.T) {
+	const inst = "proj:region:expiring"
+	c, stop := newInstance(t)
+	defer stop()
+	s, err := healthcheck.NewServer(c, testPort, healthcheck.WithMinCertValidity(2*time.Minute))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	conn, err := c.Dial(inst)
+	if err != nil {
+		t.Fatalf("Dial(%q) failed: %v", inst, err)
+	}
+	conn.Close()
+	notAfter := c.CertExpirations()[inst]
+	var now int64
+	healthcheck.SetClock(s, func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) })
+
+	atomic.StoreInt64(&now, notAfter.Add(-3*time.Minute).UnixNano())
+	if body := getBody(t, readinessPath); body != "ok" {
+		t.Errorf("Got readiness body %q with 3m of validity left, want ok", body)
+	}
+	atomic.StoreInt64(&now, notAfter.Add(-time.Minute).UnixNano())
+	want := fmt.Sprintf("client certificate for instance %q expires in 1m0s, less than the minimum of 2m0s; its refresh may be failing", inst)
+	if got := getReason(t, readinessPath); got != want {
+		t.Errorf("Got readiness reason %q with 1m of validity left, want %q", got, want)
+	}
+
+	if _, err := healthcheck.NewServer(c, testPort, healthcheck.WithMinCertValidity(-time.Minute)); err == nil {
+		t.Error("NewServer with a negative minimum certificate validity succeeded, want error")
+	}
+}
+
+// Test to verify that basic auth protects all endpoints but the probes.
+func TestBasicAuth(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithBasicAuth("user", "pass"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+	get := func(path, user, pass string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:"+testPort+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user != "" || pass != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for _, path := range []string{startupPath, livenessPath, readinessPath} {
+		if resp := get(path, "", ""); resp.StatusCode != http.StatusOK {
+			t.Errorf("%v returned status code %v without credentials instead of %v", path, resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	tests := []struct {
+		user, pass string
+		want       int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"user", "wrong", http.StatusUnauthorized},
+		{"wrong", "pass", http.StatusUnauthorized},
+		{"user", "pass", http.StatusOK},
+	}
+	for _, path := range []string{"/connections", statusPath} {
+		for _, tc := range tests {
+			resp := get(path, tc.user, tc.pass)
+			if resp.StatusCode != tc.want {
+				t.Errorf("%v with credentials %q:%q returned status code %v instead of %v", path, tc.user, tc.pass, resp.StatusCode, tc.want)
+			}
+			if tc.want == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Errorf("%v with credentials %q:%q did not set WWW-Authenticate", path, tc.user, tc.pass)
+			}
+		}
+	}
+}
+
+// Test to verify that a bearer token protects all endpoints, including the
+// probes, and cannot be combined with basic auth.
+func TestToken(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithToken("secret"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	s.NotifyStarted()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+	get := func(path, auth string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:"+testPort+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	tests := []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+	for _, path := range []string{startupPath, livenessPath, readinessPath, "/connections", statusPath} {
+		for _, tc := range tests {
+			resp := get(path, tc.auth)
+			if resp.StatusCode != tc.want {
+				t.Errorf("%v with Authorization %q returned status code %v instead of %v", path, tc.auth, resp.StatusCode, tc.want)
+			}
+			if tc.want == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("%v with Authorization %q did not set WWW-Authenticate", path, tc.auth)
+			}
+		}
+	}
+
+	if _, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithToken("secret"), healthcheck.WithBasicAuth("user", "pass")); err == nil {
+		t.Error("NewServer succeeded with both a token and basic auth")
+	}
+}
+
+// Test to verify that the pprof endpoints are only served with WithDebug, and
+// then only to local requests unless authentication is required.
+func TestDebug(t *testing.T) {
+	s, err := healthcheck.NewServer(&proxy.Client{}, testPort)
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	resp, err := http.Get("http://localhost:" + testPort + "/debug/pprof/")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Got status code %v without WithDebug instead of %v", resp.StatusCode, http.StatusNotFound)
+	}
+	s.Close(context.Background())
+
+	s, err = healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithDebug())
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer s.Close(context.Background())
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/heap"} {
+		resp, err := http.Get("http://localhost:" + testPort + path)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%v returned status code %v to a local request instead of %v", path, resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	remote := func(s *healthcheck.Server) int {
+		req := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		healthcheck.Mux(s).ServeHTTP(w, req)
+		return w.Code
+	}
+	if got := remote(s); got != http.StatusForbidden {
+		t.Errorf("Got status code %v for a remote request instead of %v", got, http.StatusForbidden)
+	}
+	authed, err := healthcheck.NewServer(&proxy.Client{}, "8091", healthcheck.WithDebug(), healthcheck.WithToken("secret"))
+	if err != nil {
+		t.Fatalf("Could not initialize health check: %v", err)
+	}
+	defer authed.Close(context.Background())
+	if got := remote(authed); got != http.StatusOK {
+		t.Errorf("Got status code %v for a remote request with a token required instead of %v", got, http.StatusOK)
+	}
+}
+
+// Test to verify that basic auth requires a password.
+func TestBasicAuthEmptyPassword(t *testing.T) {
+	if _, err := healthcheck.NewServer(&proxy.Client{}, testPort, healthcheck.WithBasicAuth("user", "")); err == nil {
+		t.Fatal("NewServer succeeded with an empty basic auth password")
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+)
+
+// InstancePolicy determines how many of the probed instances must be
+// reachable for the proxy to be ready.
+type InstancePolicy string
+
+const (
+	// AllInstancesPolicy requires every probed instance to be reachable.
+	AllInstancesPolicy InstancePolicy = "all"
+	// AnyInstancePolicy requires at least one probed instance to be
+	// reachable.
+	AnyInstancePolicy InstancePolicy = "any"
+)
+
+// probeResult is the outcome of the most recent probe of an instance.
+type probeResult struct {
+	at      time.Time
+	latency time.Duration
+	err     error
+	// failingSince is when the instance started failing its probes, if its
+	// latest probe failed.
+	failingSince time.Time
+}
+
+// probeResults holds the most recent probeResult of each probed instance.
+type probeResults struct {
+	mu sync.Mutex
+	m  map[string]probeResult
+}
+
+// recordingProbe returns a probeFunc that runs probe and records its result.
+func (s *Server) recordingProbe(probe probeFunc) probeFunc {
+	return func(ctx context.Context, instance string) error {
+		start := time.Now()
+		err := probe(ctx, instance)
+		res := probeResult{at: s.now(), latency: time.Since(start), err: err}
+
+		s.probeResults.mu.Lock()
+		defer s.probeResults.mu.Unlock()
+		if err != nil {
+			res.failingSince = res.at
+			if prev, ok := s.probeResults.m[instance]; ok && prev.err != nil {
+				res.failingSince = prev.failingSince
+			}
+		}
+		if s.probeResults.m == nil {
+			s.probeResults.m = make(map[string]probeResult)
+		}
+		s.probeResults.m[instance] = res
+		return err
+	}
+}
+
+// instanceStatus describes an instance in the JSON readiness response.
+type instanceStatus struct {
+	Name string `json:"name"`
+	// Probed is whether the instance is probed when readiness is checked.
+	Probed bool `json:"probed"`
+	// LastProbe is the outcome of its most recent probe, if it has been
+	// probed.
+	LastProbe *lastProbe `json:"lastProbe,omitempty"`
+	// CertExpiry is when the instance's cached client certificate expires,
+	// if it has one.
+	CertExpiry *time.Time `json:"certExpiry,omitempty"`
+}
+
+// lastProbe describes the most recent probe of an instance.
+type lastProbe struct {
+	Time           time.Time `json:"time"`
+	Reachable      bool      `json:"reachable"`
+	Error          string    `json:"error,omitempty"`
+	LatencySeconds float64   `json:"latencySeconds"`
+	// UnreachableSince is when the instance started failing its probes, if
+	// it is unreachable.
+	UnreachableSince *time.Time `json:"unreachableSince,omitempty"`
+}
+
+// instanceStatuses returns the status of the instances c is configured for or
+// has connected to, and of the probed instances, sorted by name.
+func (s *Server) instanceStatuses(c *proxy.Client) []instanceStatus {
+	probed := make(map[string]bool, len(s.probeTargets))
+	for _, inst := range s.probeTargets {
+		probed[inst] = true
+	}
+	var names []string
+	seen := make(map[string]bool)
+	for _, inst := range append(c.InstanceNames(), s.probeTargets...) {
+		if !seen[inst] {
+			seen[inst] = true
+			names = append(names, inst)
+		}
+	}
+	sort.Strings(names)
+	exp := c.CertExpirations()
+
+	s.probeResults.mu.Lock()
+	defer s.probeResults.mu.Unlock()
+	statuses := make([]instanceStatus, 0, len(names))
+	for _, inst := range names {
+		st := instanceStatus{Name: inst, Probed: probed[inst]}
+		if t, ok := exp[inst]; ok {
+			t = t.UTC()
+			st.CertExpiry = &t
+		}
+		if res, ok := s.probeResults.m[inst]; ok {
+			st.LastProbe = &lastProbe{
+				Time:           res.at.UTC(),
+				Reachable:      res.err == nil,
+				LatencySeconds: res.latency.Seconds(),
+			}
+			if res.err != nil {
+				since := res.failingSince.UTC()
+				st.LastProbe.Error = res.err.Error()
+				st.LastProbe.UnreachableSince = &since
+			}
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+// instanceStatus returns the status of inst, if it is among the instances
+// reported by instanceStatuses.
+func (s *Server) instanceStatus(c *proxy.Client, inst string) (instanceStatus, bool) {
+	for _, st := range s.instanceStatuses(c) {
+		if st.Name == inst {
+			return st, true
+		}
+	}
+	return instanceStatus{}, false
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maintenanceWindow is a period during which the proxy reports not ready.
+type maintenanceWindow interface {
+	// contains reports whether t falls within the window.
+	contains(t time.Time) bool
+	String() string
+}
+
+// fixedWindow is a one-off window between two instants.
+type fixedWindow struct {
+	start, end time.Time
+}
+
+func (w fixedWindow) contains(t time.Time) bool {
+	return !t.Before(w.start) && t.Before(w.end)
+}
+
+func (w fixedWindow) String() string {
+	return w.start.Format(time.RFC3339) + "/" + w.end.Format(time.RFC3339)
+}
+
+// dailyWindow is a window recurring every day between two times of day in
+// UTC, given as offsets from midnight. If end is before start, the window
+// spans midnight.
+type dailyWindow struct {
+	start, end time.Duration
+}
+
+func (w dailyWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.start <= w.end {
+		return d >= w.start && d < w.end
+	}
+	return d >= w.start || d < w.end
+}
+
+func (w dailyWindow) String() string {
+	f := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+	}
+	return f(w.start) + "-" + f(w.end)
+}
+
+// parseMaintenanceSchedule parses a comma separated list of maintenance
+// windows. Each window is either a one-off period given as two RFC 3339
+// timestamps separated by a slash, such as
+// "2021-06-01T22:00:00Z/2021-06-02T02:00:00Z", or a daily period given as two
+// UTC times of day separated by a hyphen, such as "22:00-02:00".
+func parseMaintenanceSchedule(spec string) ([]maintenanceWindow, error) {
+	var windows []maintenanceWindow
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		w, err := parseMaintenanceWindow(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance window %q: %v", s, err)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseMaintenanceWindow(s string) (maintenanceWindow, error) {
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		start, err := time.Parse(time.RFC3339, s[:i])
+		if err != nil {
+			return nil, err
+		}
+		end, err := time.Parse(time.RFC3339, s[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		if !end.After(start) {
+			return nil, fmt.Errorf("end must be after start")
+		}
+		return fixedWindow{start: start, end: end}, nil
+	}
+
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf(`want "START/END" timestamps or "HH:MM-HH:MM" times of day`)
+	}
+	var w dailyWindow
+	for i, p := range parts {
+		t, err := time.Parse("15:04", p)
+		if err != nil {
+			return nil, err
+		}
+		d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		if i == 0 {
+			w.start = d
+		} else {
+			w.end = d
+		}
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("start and end must differ")
+	}
+	return w, nil
+}
+
+// inMaintenance returns the maintenance window t falls within, if any.
+func (s *Server) inMaintenance(t time.Time) (maintenanceWindow, bool) {
+	for _, w := range s.maintenance {
+		if w.contains(t) {
+			return w, true
+		}
+	}
+	return nil, false
+}
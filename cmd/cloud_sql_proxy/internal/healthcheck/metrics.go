@@ -0,0 +1,271 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+)
+
+const (
+	metricsPath = "/metrics"
+	// metricsContentType is the content type of the Prometheus text
+	// exposition format.
+	metricsContentType = "text/plain; version=0.0.4"
+)
+
+// labelNameRE matches valid Prometheus label names.
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// label is a name/value pair identifying a sample of a metric.
+type label struct {
+	name, value string
+}
+
+// sample is a single value of a metric. suffix is appended to the metric's
+// name, as for the _bucket, _sum and _count samples of a histogram.
+type sample struct {
+	suffix string
+	labels []label
+	value  float64
+}
+
+// metric is a named collection of samples in the Prometheus data model.
+type metric struct {
+	name, typ, help string
+	samples         []sample
+}
+
+// instanceLabel is the label identifying the instance of per-instance
+// samples.
+const instanceLabel = "instance"
+
+// newLabels validates m and returns its entries as labels sorted by name.
+func newLabels(m map[string]string) ([]label, error) {
+	ls := make([]label, 0, len(m))
+	for k, v := range m {
+		if !labelNameRE.MatchString(k) || strings.HasPrefix(k, "__") {
+			return nil, fmt.Errorf("invalid metric label name %q", k)
+		}
+		if k == instanceLabel || k == transportLabel || k == probeLabel || k == bucketLabel {
+			return nil, fmt.Errorf("metric label name %q is reserved", k)
+		}
+		ls = append(ls, label{name: k, value: v})
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i].name < ls[j].name })
+	return ls, nil
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels returns ls in the Prometheus text exposition format.
+func formatLabels(ls []label) string {
+	if len(ls) == 0 {
+		return ""
+	}
+	parts := make([]string, len(ls))
+	for i, l := range ls {
+		parts[i] = l.name + `="` + labelValueEscaper.Replace(l.value) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// writeMetrics writes ms in the Prometheus text exposition format, adding
+// common to the labels of every sample.
+func writeMetrics(w io.Writer, common []label, ms []metric) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range ms {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for _, s := range m.samples {
+			ls := append(append([]label(nil), common...), s.labels...)
+			fmt.Fprintf(bw, "%s%s%s %s\n", m.name, s.suffix, formatLabels(ls), strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+	return bw.Flush()
+}
+
+// gauge returns a metric of type gauge with a single unlabeled sample.
+func gauge(name, help string, value float64) metric {
+	return metric{name: name, typ: "gauge", help: help, samples: []sample{{value: value}}}
+}
+
+// counter returns a metric of type counter with a single unlabeled sample.
+func counter(name, help string, value float64) metric {
+	return metric{name: name, typ: "counter", help: help, samples: []sample{{value: value}}}
+}
+
+// bucketLabel is the label holding the upper bound of histogram buckets.
+const bucketLabel = "le"
+
+// histogram returns a metric of type histogram describing h, whose buckets
+// are bounded by bounds.
+func histogram(name, help string, bounds []float64, h proxy.LatencyHistogram) metric {
+	m := metric{name: name, typ: "histogram", help: help}
+	for i, n := range h.Buckets {
+		le := strconv.FormatFloat(bounds[i], 'g', -1, 64)
+		m.samples = append(m.samples, sample{suffix: "_bucket", labels: []label{{name: bucketLabel, value: le}}, value: float64(n)})
+	}
+	m.samples = append(m.samples,
+		sample{suffix: "_bucket", labels: []label{{name: bucketLabel, value: "+Inf"}}, value: float64(h.Count)},
+		sample{suffix: "_sum", value: h.Sum},
+		sample{suffix: "_count", value: float64(h.Count)})
+	return m
+}
+
+// instanceCounters returns counters of the bytes read from and written to
+// each instance.
+func instanceCounters(c *proxy.Client) []metric {
+	read := metric{
+		name: "cloudsql_proxy_instance_bytes_read_total",
+		typ:  "counter",
+		help: "Bytes received from the instance through the proxy.",
+	}
+	written := metric{
+		name: "cloudsql_proxy_instance_bytes_written_total",
+		typ:  "counter",
+		help: "Bytes sent to the instance through the proxy.",
+	}
+	bytes := c.BytesTransferred()
+	instances := make([]string, 0, len(bytes))
+	for inst := range bytes {
+		instances = append(instances, inst)
+	}
+	sort.Strings(instances)
+	for _, inst := range instances {
+		ls := []label{{name: instanceLabel, value: inst}}
+		read.samples = append(read.samples, sample{labels: ls, value: float64(bytes[inst].Read)})
+		written.samples = append(written.samples, sample{labels: ls, value: float64(bytes[inst].Written)})
+	}
+	return []metric{read, written}
+}
+
+// transportLabel is the label identifying the transport of per-transport
+// samples.
+const transportLabel = "transport"
+
+// probeLabel is the label identifying the kind of check of per-probe
+// samples.
+const probeLabel = "probe"
+
+// transportGauge returns a gauge of the open connections on each transport.
+func transportGauge(c *proxy.Client) metric {
+	m := metric{
+		name: "cloudsql_proxy_open_connections_by_transport",
+		typ:  "gauge",
+		help: "Number of connections currently open through the proxy, by transport.",
+	}
+	byTransport := c.ConnectionsByTransport()
+	transports := make([]proxy.Transport, 0, len(byTransport))
+	for t := range byTransport {
+		transports = append(transports, t)
+	}
+	sort.Slice(transports, func(i, j int) bool { return transports[i] < transports[j] })
+	for _, t := range transports {
+		ls := []label{{name: transportLabel, value: t.String()}}
+		m.samples = append(m.samples, sample{labels: ls, value: float64(byTransport[t])})
+	}
+	return m
+}
+
+// boolGauge returns a gauge that is 1 if b is true and 0 otherwise.
+func boolGauge(name, help string, b bool) metric {
+	var v float64
+	if b {
+		v = 1
+	}
+	return gauge(name, help, v)
+}
+
+// probeFailures returns a counter of the failed readiness and liveness
+// checks.
+func (s *Server) probeFailures() metric {
+	return metric{
+		name: "cloudsql_proxy_probe_failures_total",
+		typ:  "counter",
+		help: "Readiness and liveness checks that failed.",
+		samples: []sample{
+			{labels: []label{{name: probeLabel, value: "liveness"}}, value: float64(atomic.LoadUint64(&s.livenessFailures))},
+			{labels: []label{{name: probeLabel, value: "readiness"}}, value: float64(atomic.LoadUint64(&s.readinessFailures))},
+		},
+	}
+}
+
+// collectMetrics returns the proxy's current metrics.
+func (s *Server) collectMetrics(c *proxy.Client) []metric {
+	reason, evaluated := s.cachedReadiness()
+	notLive, liveEvaluated := s.cachedLiveness()
+	ratio, _ := c.SuccessRatio()
+	total, refused := c.ConnectionTotals()
+	refreshes, refreshFailures := c.RefreshTotals()
+	ms := []metric{
+		gauge("cloudsql_proxy_open_connections",
+			"Number of connections currently open through the proxy.",
+			float64(atomic.LoadUint64(&c.ConnectionsCounter))),
+		counter("cloudsql_proxy_connections_total",
+			"Connections admitted by the proxy.",
+			float64(total)),
+		counter("cloudsql_proxy_refused_connections_total",
+			"Connections refused because a connection limit was reached.",
+			float64(refused)),
+		gauge("cloudsql_proxy_connection_churn_rate",
+			"Connections per second closed shortly after being opened, averaged over the last minute.",
+			c.ChurnRate()),
+		gauge("cloudsql_proxy_connection_success_ratio",
+			"Fraction of recent connections for which the instance was dialed successfully.",
+			ratio),
+		transportGauge(c),
+		histogram("cloudsql_proxy_dial_latency_seconds",
+			"Time taken to dial an instance for a new connection, including refreshing its certificate.",
+			proxy.DialLatencyBuckets, c.DialLatencies()),
+		counter("cloudsql_proxy_certificate_refreshes_total",
+			"Ephemeral certificate refreshes attempted.",
+			float64(refreshes)),
+		counter("cloudsql_proxy_certificate_refresh_errors_total",
+			"Ephemeral certificate refreshes that failed.",
+			float64(refreshFailures)),
+		gauge("cloudsql_proxy_max_connections",
+			"Maximum number of connections the proxy opens, or 0 if unlimited.",
+			float64(c.MaxConnectionsLimit())),
+		s.probeFailures(),
+		boolGauge("cloudsql_proxy_ready",
+			"Whether the most recent readiness evaluation passed (1) or not (0).",
+			evaluated && reason == ""),
+		boolGauge("cloudsql_proxy_live",
+			"Whether the most recent liveness evaluation passed (1) or not (0).",
+			liveEvaluated && notLive == ""),
+	}
+	return append(ms, instanceCounters(c)...)
+}
+
+// metricsHandler serves the proxy's metrics in the Prometheus text exposition
+// format.
+func (s *Server) metricsHandler(c *proxy.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		if err := writeMetrics(w, s.metricLabels, s.collectMetrics(c)); err != nil {
+			logging.Errorf("Failed to write metrics: %v", err)
+		}
+	}
+}
@@ -0,0 +1,605 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// An Option configures optional behavior of a Server.
+type Option func(*Server)
+
+// WithListenBacklog sets the length of the queue of pending connections on
+// the health check listener. If n is 0, the operating system default is used.
+// Setting the backlog is only supported on Linux.
+func WithListenBacklog(n int) Option {
+	return func(s *Server) {
+		s.backlog = n
+	}
+}
+
+// WithReadinessLogSampling sets the fraction of readiness failures, between 0
+// and 1, for which the proxy state is logged in detail alongside the failure
+// reason. The failure reason is always logged. Defaults to 1.
+func WithReadinessLogSampling(rate float64) Option {
+	return func(s *Server) {
+		s.logSampleRate = rate
+	}
+}
+
+// WithReadinessLogInterval logs readiness failing for the same reason as the
+// last logged failure at most once per d, along with how many failures were
+// not logged since. Failures for a new reason are always logged. By default,
+// every failure is logged.
+func WithReadinessLogInterval(d time.Duration) Option {
+	return func(s *Server) {
+		s.readinessLogInterval = d
+	}
+}
+
+// WithDependencyCheck makes readiness depend on an external HTTP dependency
+// responding successfully, as configured by d.
+func WithDependencyCheck(d DependencyCheck) Option {
+	return func(s *Server) {
+		s.dependencyCfg = &d
+	}
+}
+
+// WithMetrics serves the proxy's metrics in the Prometheus text exposition
+// format on /metrics.
+func WithMetrics() Option {
+	return func(s *Server) {
+		s.metrics = true
+	}
+}
+
+// WithDebug serves the net/http/pprof profiling endpoints under
+// /debug/pprof/. Unless requests must be authenticated with WithToken or
+// WithBasicAuth, they are only served to requests from the local host.
+func WithDebug() Option {
+	return func(s *Server) {
+		s.debug = true
+	}
+}
+
+// WithMaxChurnRate makes the proxy not ready while the rate of connections
+// closed shortly after being opened exceeds perSecond. See
+// proxy.Client.ChurnRate.
+func WithMaxChurnRate(perSecond float64) Option {
+	return func(s *Server) {
+		s.maxChurnRate = perSecond
+	}
+}
+
+// WithAPIQuotaCheck makes the proxy not ready once n or more of the Cloud SQL
+// Admin API calls made in the last minute were rejected for exceeding quota.
+// It has no effect if the proxy's CertSource does not implement
+// proxy.APIUsageReporter.
+func WithAPIQuotaCheck(n uint64) Option {
+	return func(s *Server) {
+		s.maxRateLimited = n
+	}
+}
+
+// WithMetricLabels adds labels to every metric served on /metrics, such as
+// the environment, region or pod the proxy runs in.
+func WithMetricLabels(labels map[string]string) Option {
+	return func(s *Server) {
+		s.metricLabelsCfg = labels
+	}
+}
+
+// WithTLSConfig serves the health check endpoints over HTTPS using cfg, which
+// must provide the server's certificate.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsCfg = cfg
+	}
+}
+
+// WithTLSFiles serves the health check endpoints over HTTPS using the PEM
+// encoded certificate and key in certFile and keyFile. If WithTLSConfig is also
+// used, they replace the certificates of its tls.Config. NewServer returns an
+// error if they cannot be loaded.
+func WithTLSFiles(certFile, keyFile string) Option {
+	return func(s *Server) {
+		s.certFile, s.keyFile = certFile, keyFile
+	}
+}
+
+// WithSelfSignedCert serves the health check endpoints over HTTPS using a
+// self-signed certificate generated by NewServer, for when the transport must
+// be encrypted but clients, such as Kubernetes probes, do not verify the
+// server. A certificate provided with WithTLSConfig or WithTLSFiles is used
+// instead, if any.
+func WithSelfSignedCert() Option {
+	return func(s *Server) {
+		s.selfSigned = true
+	}
+}
+
+// WithClientCA verifies certificates presented by clients against pool. It
+// requires TLS to be enabled. Unless WithRequireClientCert is also used,
+// clients that do not present a certificate are still accepted.
+func WithClientCA(pool *x509.CertPool) Option {
+	return func(s *Server) {
+		s.clientCAs = pool
+	}
+}
+
+// WithRequireClientCert rejects clients that do not present a certificate
+// signed by the CA configured with WithClientCA.
+func WithRequireClientCert() Option {
+	return func(s *Server) {
+		s.requireClientCert = true
+	}
+}
+
+// WithMinSuccessRatio makes the proxy not ready while the fraction of recent
+// connections for which the instance was dialed successfully is below ratio.
+// See proxy.Client.SuccessRatio.
+func WithMinSuccessRatio(ratio float64) Option {
+	return func(s *Server) {
+		s.minSuccessRatio = ratio
+	}
+}
+
+// WithGzipThreshold sets the size, in bytes, from which /status, /metrics and
+// /events responses are gzip compressed for clients that accept it. Defaults
+// to 1024.
+func WithGzipThreshold(n int) Option {
+	return func(s *Server) {
+		s.gzipThreshold = n
+	}
+}
+
+// WithMaintenanceSchedule makes the proxy not ready during the maintenance
+// windows in spec, a comma separated list of one-off windows such as
+// "2021-06-01T22:00:00Z/2021-06-02T02:00:00Z" and daily UTC windows such as
+// "22:00-02:00".
+func WithMaintenanceSchedule(spec string) Option {
+	return func(s *Server) {
+		s.maintenanceSpec = spec
+	}
+}
+
+// WithDialProbe makes the proxy not ready unless any of instances, or each
+// of them under AllInstancesPolicy, can be dialed when readiness is checked.
+func WithDialProbe(instances ...string) Option {
+	return func(s *Server) {
+		s.probeTargets = instances
+	}
+}
+
+// WithInstancePolicy sets how many of the instances probed with
+// WithDialProbe or WithConnCheck must be reachable for the proxy to be ready.
+// Defaults to AnyInstancePolicy.
+func WithInstancePolicy(p InstancePolicy) Option {
+	return func(s *Server) {
+		s.instancePolicy = p
+	}
+}
+
+// WithConnCheck makes the proxy not ready unless instance passes check, run
+// over a connection to it, when readiness is checked.
+func WithConnCheck(instance string, check ConnCheck) Option {
+	return func(s *Server) {
+		if s.connChecks == nil {
+			s.connChecks = make(map[string][]ConnCheck)
+		}
+		s.connChecks[instance] = append(s.connChecks[instance], check)
+	}
+}
+
+// WithBatchedChecks makes the dial probe and ConnChecks of an instance share
+// a single connection to it per readiness evaluation, rather than each
+// opening its own.
+func WithBatchedChecks() Option {
+	return func(s *Server) {
+		s.batchChecks = true
+	}
+}
+
+// WithProbeConcurrency sets how many instances are probed at once. Defaults
+// to 8.
+func WithProbeConcurrency(n int) Option {
+	return func(s *Server) {
+		s.probeConcurrency = n
+	}
+}
+
+// WithProbeTimeout sets how long probing all instances may take before the
+// remaining probes fail. Defaults to 5 seconds.
+func WithProbeTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.probeTimeout = d
+	}
+}
+
+// WithReadinessTimeout sets how long evaluating readiness, including probing
+// instances and running the registered readiness checks, may take before the
+// proxy is reported not ready. Defaults to 10 seconds.
+func WithReadinessTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readinessTimeout = d
+	}
+}
+
+// WithHealthz serves an endpoint at /healthz, and at each of aliases, that
+// responds with 200 only if the proxy is both live and ready.
+func WithHealthz(aliases ...string) Option {
+	return func(s *Server) {
+		s.healthzPaths = append([]string{healthzPath}, aliases...)
+	}
+}
+
+// WithHealthzFailureStatus makes the /healthz endpoint and its aliases respond
+// with code instead of 503 Service Unavailable while the proxy is not both live
+// and ready. code must be a 4xx or 5xx status code.
+func WithHealthzFailureStatus(code int) Option {
+	return func(s *Server) {
+		s.healthzFailure = code
+	}
+}
+
+// WithReadinessFailureStatus makes the readiness endpoint respond with code
+// instead of 503 Service Unavailable while the proxy is not ready, for load
+// balancers that treat status codes differently. code must be a 4xx or 5xx
+// status code.
+func WithReadinessFailureStatus(code int) Option {
+	return func(s *Server) {
+		s.readinessFailure = code
+	}
+}
+
+// WithHealthzBody makes the /healthz endpoint and its aliases respond with ok
+// instead of "ok" while the proxy is healthy, and with failure instead of the
+// reason it is not otherwise, for load balancers that match on the response
+// body. An empty string keeps the default body.
+func WithHealthzBody(ok, failure string) Option {
+	return func(s *Server) {
+		s.healthzOKBody, s.healthzFailureBody = ok, failure
+	}
+}
+
+// WithLivenessPath serves the liveness endpoint at path instead of /liveness.
+func WithLivenessPath(path string) Option {
+	return func(s *Server) {
+		s.livenessPath = path
+	}
+}
+
+// WithReadinessPath serves the readiness endpoint at path instead of
+// /readiness.
+func WithReadinessPath(path string) Option {
+	return func(s *Server) {
+		s.readinessPath = path
+	}
+}
+
+// WithMinTLSVersion sets the minimum TLS version, such as tls.VersionTLS13,
+// accepted by the health check server. Defaults to TLS 1.2. It requires TLS to
+// be enabled with WithTLSConfig, WithTLSFiles or WithSelfSignedCert.
+func WithMinTLSVersion(version uint16) Option {
+	return func(s *Server) {
+		s.minTLSVersion = version
+	}
+}
+
+// WithCipherSuites sets the cipher suites the health check server negotiates
+// for TLS 1.2 and earlier. Only the suites listed by tls.CipherSuites are
+// accepted. It requires TLS to be enabled with WithTLSConfig, WithTLSFiles or
+// WithSelfSignedCert.
+func WithCipherSuites(ids ...uint16) Option {
+	return func(s *Server) {
+		s.cipherSuites = ids
+	}
+}
+
+// WithMetricsPush periodically pushes the proxy's metrics to a Prometheus
+// Pushgateway until the Server is closed.
+func WithMetricsPush(cfg MetricsPush) Option {
+	return func(s *Server) {
+		s.pushCfg = &cfg
+	}
+}
+
+// WithMetricsExportReadiness makes the proxy not ready while the most recent
+// metrics push failed. It requires WithMetricsPush.
+func WithMetricsExportReadiness() Option {
+	return func(s *Server) {
+		s.pushReadiness = true
+	}
+}
+
+// WithDeferredServing makes NewServer bind the health check port without
+// serving requests on it until BeginServing is called. Requests made in the
+// meantime wait to be served.
+func WithDeferredServing() Option {
+	return func(s *Server) {
+		s.deferServing = true
+	}
+}
+
+// WithRequiredEnv makes the proxy not ready unless each of the environment
+// variables named is set and non-empty, to catch misconfigured deployments.
+func WithRequiredEnv(names ...string) Option {
+	return func(s *Server) {
+		s.requiredEnv = append(s.requiredEnv, names...)
+	}
+}
+
+// WithNamedPipe also serves the health check endpoints on the Windows named
+// pipe at path, such as \\.\pipe\cloudsql-proxy-health, for deployments
+// without Unix sockets. It is only supported on Windows.
+func WithNamedPipe(path string) Option {
+	return func(s *Server) {
+		s.pipePath = path
+	}
+}
+
+// WithMinUptime makes the proxy not ready until its process has been up for
+// d, even once it has finished starting up, so that pods crash-looping
+// shortly after startup are not briefly added to rotation.
+func WithMinUptime(d time.Duration) Option {
+	return func(s *Server) {
+		s.minUptime = d
+	}
+}
+
+// WithReadinessGracePeriod makes the proxy not ready for d after it finishes
+// starting up, or until an instance is dialed successfully, for a new
+// connection or a probe, if that comes first. This keeps traffic away while
+// the listeners are open but client certificates are still being fetched.
+func WithReadinessGracePeriod(d time.Duration) Option {
+	return func(s *Server) {
+		s.readinessGrace = d
+	}
+}
+
+// WithMaxChecks sets how many custom readiness and liveness checks may be
+// registered in total. Defaults to DefaultMaxChecks.
+func WithMaxChecks(n int) Option {
+	return func(s *Server) {
+		s.maxChecks = n
+	}
+}
+
+// WithDeregisterer makes Close deregister the proxy from a service discovery
+// backend with d when it starts draining, after PreDrain hooks have run. A
+// failure to deregister is logged and does not stop draining.
+func WithDeregisterer(d Deregisterer) Option {
+	return func(s *Server) {
+		s.deregisterer = d
+	}
+}
+
+// WithCredentialsCheck makes the proxy not ready while a valid access token
+// cannot be obtained from the credentials it fetches ephemeral certificates
+// with, such as when the metadata server is unreachable, instead of only once
+// the current certificates expire. Tokens are reused until they expire, so
+// checking does not add to token refreshes.
+func WithCredentialsCheck() Option {
+	return func(s *Server) {
+		s.credentialsCheck = true
+	}
+}
+
+// WithCertChainCheck makes the proxy not ready while the ephemeral client
+// certificate of any instance does not chain to the instance's CA, as
+// verified with the proxy.Client's CertVerifier.
+func WithCertChainCheck() Option {
+	return func(s *Server) {
+		s.certChainCheck = true
+	}
+}
+
+// WithCertExpiryCheck makes the proxy not ready while the ephemeral client
+// certificate of any instance has expired, which happens when rotation falls
+// behind. A warning is logged when one expires within warning.
+func WithCertExpiryCheck(warning time.Duration) Option {
+	return func(s *Server) {
+		s.certExpiryCheck = true
+		s.certExpiryWarning = warning
+	}
+}
+
+// WithMinCertValidity makes the proxy not ready while the ephemeral client
+// certificate of any instance is valid for less than d, so that it is taken
+// out of rotation while refreshes are failing, before connections break. It
+// implies WithCertExpiryCheck. As certificates are refreshed 5 minutes before
+// they expire, d should be well below that, such as 2 minutes.
+func WithMinCertValidity(d time.Duration) Option {
+	return func(s *Server) {
+		s.certExpiryCheck = true
+		s.minCertValidity = d
+	}
+}
+
+// WithConnectionsThreshold makes the proxy not ready once its open
+// connections reach threshold, a fraction of MaxConnections such as 0.9, so
+// that load shifts to other replicas before connections are refused. It has
+// no effect without MaxConnections, and like the limit itself it is relaxed
+// by WithSoftStart.
+func WithConnectionsThreshold(threshold float64) Option {
+	return func(s *Server) {
+		s.readyConnsThreshold = threshold
+	}
+}
+
+// WithSoftStart relaxes the MaxConnections readiness check for d after
+// NotifyStarted is first called, logging rather than failing when the limit
+// is reached, so that connection bursts right after startup do not cause a
+// restart storm.
+func WithSoftStart(d time.Duration) Option {
+	return func(s *Server) {
+		s.softStart = d
+	}
+}
+
+// WithDNSCache makes the active health checks reuse the addresses a hostname
+// resolved to for ttl rather than resolving it on every connection. It applies
+// to the dependency check unless its DependencyCheck sets a Client.
+func WithDNSCache(ttl time.Duration) Option {
+	return func(s *Server) {
+		s.dnsTTL = ttl
+	}
+}
+
+// WithLogBufferCheck makes the proxy not ready while the buffer of b, the
+// proxy's log sink, is full and logs are being dropped.
+func WithLogBufferCheck(b *logging.BufferedWriter) Option {
+	return func(s *Server) {
+		s.logBuffer = b
+	}
+}
+
+// WithFaultInjection serves /admin/faults, on which POST requests authorized
+// with the bearer token may make the proxy fail readiness or liveness probes,
+// or delay them, for a while. It is meant for chaos testing and is disabled
+// by default.
+func WithFaultInjection(token string) Option {
+	return func(s *Server) {
+		s.faultsToken = token
+	}
+}
+
+// WithHost binds the health check endpoints to host, a host name or IP address,
+// instead of all interfaces, so that they are not exposed on every interface
+// of a multi-homed host. It cannot be used with WithNetwork("unix").
+func WithHost(host string) Option {
+	return func(s *Server) {
+		s.host = host
+	}
+}
+
+// WithNetwork sets the network the health check endpoints are served on, "tcp"
+// (the default) or "unix". With "unix", the port passed to NewServer is the
+// path of the socket, which is removed by Close.
+func WithNetwork(network string) Option {
+	return func(s *Server) {
+		s.network = network
+	}
+}
+
+// WithStartedCallback makes NotifyStarted call fn, the first time it is
+// called, with the time between the Server being created and the proxy
+// finishing startup. fn is called synchronously, after the ReadyEvent is
+// logged, and should not block.
+func WithStartedCallback(fn func(startup time.Duration)) Option {
+	return func(s *Server) {
+		s.onStarted = fn
+	}
+}
+
+// WithQuitHandler serves /quitquitquit, on which a POST request makes the
+// Server call quit, from a new goroutine, to shut the proxy down gracefully.
+// quit is called at most once. As anyone able to reach the health check port
+// can shut the proxy down, it is disabled by default.
+func WithQuitHandler(quit func()) Option {
+	return func(s *Server) {
+		s.quit = quit
+	}
+}
+
+// WithQuitToken requires requests to /quitquitquit, served with
+// WithQuitHandler, to be authorized with token as a bearer token, as in
+// "Authorization: Bearer <token>". The endpoint is then exempt from
+// WithBasicAuth.
+func WithQuitToken(token string) Option {
+	return func(s *Server) {
+		s.quitToken = token
+	}
+}
+
+// WithMaxInactivity makes the proxy not live, so that it is restarted, when
+// connections are open but it has neither accepted a connection nor proxied
+// any bytes for longer than d. A proxy without open connections is never
+// considered inactive. d should exceed how long clients keep connections open
+// without using them.
+func WithMaxInactivity(d time.Duration) Option {
+	return func(s *Server) {
+		s.maxInactivity = d
+	}
+}
+
+// WithMaxRefreshDuration makes the proxy not live, so that it is restarted,
+// when a certificate refresh has been in progress for longer than d. As
+// refreshes run one at a time, a stuck refresh blocks all later ones, and so
+// every new connection to an instance whose certificate needs refreshing.
+func WithMaxRefreshDuration(d time.Duration) Option {
+	return func(s *Server) {
+		s.maxRefresh = d
+	}
+}
+
+// WithBasicAuth requires HTTP basic authentication with username and password
+// on the health check endpoints. Requests without them are rejected with 401
+// Unauthorized. The startup, liveness, readiness and healthz endpoints stay
+// unauthenticated so that Kubernetes probes keep working, as does the fault
+// injection endpoint, which is authorized with its own token. To use a token
+// instead, pass it as the password.
+func WithBasicAuth(username, password string) Option {
+	return func(s *Server) {
+		s.authUser, s.authPassword = username, password
+		s.authSet = true
+	}
+}
+
+// WithToken requires every request to the health check endpoints, including
+// the startup, liveness, readiness and healthz probes, to be authorized with
+// token as a bearer token, as in "Authorization: Bearer <token>", for when the
+// endpoints are exposed beyond localhost. Requests without it are rejected
+// with 401 Unauthorized. The fault injection endpoint, and /quitquitquit with
+// WithQuitToken, are authorized with their own tokens instead. It cannot be
+// combined with WithBasicAuth, which uses the same header.
+func WithToken(token string) Option {
+	return func(s *Server) {
+		s.token = token
+	}
+}
+
+// WithAccessLog logs the path, remote address, status code and duration of
+// every request to the health check endpoints. Requests for the probe
+// endpoints, which Kubernetes sends every few seconds, are logged verbosely;
+// others are logged at info level. It is disabled by default.
+func WithAccessLog() Option {
+	return func(s *Server) {
+		s.accessLog = true
+	}
+}
+
+// WithVersion sets the proxy version and git commit served on /version. Either
+// may be empty if unknown.
+func WithVersion(version, commit string) Option {
+	return func(s *Server) {
+		s.version, s.commit = version, commit
+	}
+}
+
+// WithGRPC also serves the gRPC Health Checking Protocol (grpc.health.v1.Health)
+// on port, for environments that probe with gRPC. The empty service name is
+// serving only if the proxy is both live and ready; the "liveness" and
+// "readiness" services report each on its own. It uses the TLS configuration
+// of the HTTP endpoints, if any.
+func WithGRPC(port string) Option {
+	return func(s *Server) {
+		s.grpcPort = port
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProbeConcurrency = 8
+	defaultProbeTimeout     = 5 * time.Second
+)
+
+// probeFunc checks whether an instance is reachable.
+type probeFunc func(ctx context.Context, instance string) error
+
+// ConnCheck checks the health of an instance over conn, an established
+// connection to it, such as by pinging the database.
+type ConnCheck func(ctx context.Context, conn net.Conn) error
+
+// checkInstance is the default probeFunc. It dials instance and runs its
+// ConnChecks. Unless checks are batched, each check gets a connection of its
+// own.
+func (s *Server) checkInstance(ctx context.Context, instance string) error {
+	checks := s.connChecks[instance]
+	if s.batchChecks {
+		return s.dialAndCheck(ctx, instance, checks...)
+	}
+	if err := s.dialAndCheck(ctx, instance); err != nil {
+		return err
+	}
+	for _, check := range checks {
+		if err := s.dialAndCheck(ctx, instance, check); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dialAndCheck dials instance and runs checks, in order, over the
+// connection.
+func (s *Server) dialAndCheck(ctx context.Context, instance string, checks ...ConnCheck) error {
+	conn, err := s.dial(ctx, instance)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, check := range checks {
+		if err := check(ctx, conn); err != nil {
+			return fmt.Errorf("check failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// withCheckedInstances returns a copy of targets followed by the instances
+// with checks that are not already among them, in sorted order.
+func withCheckedInstances(targets []string, checks map[string][]ConnCheck) []string {
+	seen := make(map[string]bool, len(targets))
+	for _, inst := range targets {
+		seen[inst] = true
+	}
+	var extra []string
+	for inst := range checks {
+		if !seen[inst] {
+			extra = append(extra, inst)
+		}
+	}
+	sort.Strings(extra)
+	// Copy targets so that the caller's backing array is not written to.
+	return append(append([]string(nil), targets...), extra...)
+}
+
+// probeInstances runs probe against each of instances, at most concurrency at
+// a time, and returns the error for each instance that failed. Instances not
+// probed before ctx is done fail with the context's error.
+func probeInstances(ctx context.Context, instances []string, concurrency int, probe probeFunc) map[string]error {
+	if concurrency > len(instances) {
+		concurrency = len(instances)
+	}
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs = make(map[string]error)
+	)
+	work := make(chan string)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for inst := range work {
+				err := ctx.Err()
+				if err == nil {
+					err = probe(ctx, inst)
+				}
+				if err != nil {
+					mu.Lock()
+					errs[inst] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, inst := range instances {
+		work <- inst
+	}
+	close(work)
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+const defaultMetricsPushInterval = 15 * time.Second
+
+// MetricsPush configures periodically pushing the proxy's metrics to a
+// Prometheus Pushgateway. Only URL is required.
+type MetricsPush struct {
+	// URL is the Pushgateway grouping key URL metrics are PUT to, such as
+	// "http://pushgateway:9091/metrics/job/cloudsql-proxy".
+	URL string
+	// Interval is how often metrics are pushed. If not set, it defaults to
+	// 15 seconds. It must not be negative.
+	Interval time.Duration
+	// Client is used to push metrics. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// metricsPusher pushes metrics and tracks whether the last push succeeded.
+type metricsPusher struct {
+	cfg     MetricsPush
+	collect func() []metric
+	labels  []label
+
+	// mu protects err.
+	mu sync.Mutex
+	// err is the error from the most recent push, if it failed.
+	err error
+}
+
+func newMetricsPusher(cfg MetricsPush, collect func() []metric, labels []label) (*metricsPusher, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("metrics push requires a URL")
+	}
+	if cfg.Interval < 0 {
+		return nil, fmt.Errorf("invalid metrics push interval %v", cfg.Interval)
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultMetricsPushInterval
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	return &metricsPusher{cfg: cfg, collect: collect, labels: labels}, nil
+}
+
+// run pushes metrics every interval until ctx is done.
+func (p *metricsPusher) run(ctx context.Context) {
+	t := time.NewTicker(p.cfg.Interval)
+	defer t.Stop()
+	for {
+		err := p.push(ctx)
+		if err != nil && ctx.Err() == nil {
+			logging.Errorf("Failed to push metrics: %v", err)
+		}
+		p.mu.Lock()
+		p.err = err
+		p.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// push sends the current metrics to the Pushgateway.
+func (p *metricsPusher) push(ctx context.Context) error {
+	var body bytes.Buffer
+	if err := writeMetrics(&body, p.labels, p.collect()); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, p.cfg.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", metricsContentType)
+	resp, err := p.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("PUT %s returned status %d", p.cfg.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+// lastErr returns the error from the most recent push, or nil if it succeeded
+// or no push has completed yet.
+func (p *metricsPusher) lastErr() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// start pushes metrics in the background until s is closed.
+func (p *metricsPusher) start(s *Server) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.run(ctx)
+	}()
+	s.shutdown = append(s.shutdown, func(context.Context) error {
+		cancel()
+		<-done
+		return nil
+	})
+}
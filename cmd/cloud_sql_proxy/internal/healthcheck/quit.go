@@ -0,0 +1,43 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+const quitPath = "/quitquitquit"
+
+// quitHandler calls s.quit, once and from a new goroutine so that the response
+// is sent before the proxy shuts down, on POST requests. If s.quitToken is set,
+// requests must be authorized with it as a bearer token.
+func (s *Server) quitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.quitToken != "" && !hasBearerToken(r, s.quitToken) {
+		logging.Errorf("Rejected unauthorized shutdown request on %s%s", quitPath, requestIDSuffix(r.Context()))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	logging.Infof("Received shutdown request on %s%s", quitPath, requestIDSuffix(r.Context()))
+	s.quitOnce.Do(func() { go s.quit() })
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,174 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+)
+
+// readinessResult describes a readiness evaluation, served as JSON on
+// /readiness to clients that accept it.
+type readinessResult struct {
+	Ready bool `json:"ready"`
+	// Reason is why the proxy is not ready, if it is not.
+	Reason string `json:"reason,omitempty"`
+	// Checks is whether each of the basic readiness criteria holds, keyed by
+	// "started", "connections", which holds unless a connection limit or the
+	// readiness threshold below it is reached, and "certificates", which holds
+	// unless a cached client certificate has expired.
+	Checks          map[string]bool `json:"checks"`
+	MaxConnections  uint64          `json:"maxConnections"`
+	OpenConnections uint64          `json:"openConnections"`
+	// Instances describes each instance the proxy is configured for or has
+	// connected to, and each probed instance.
+	Instances []instanceStatus `json:"instances,omitempty"`
+	// CustomChecks is the most recent result of each registered readiness
+	// check.
+	CustomChecks []checkStatus `json:"customChecks,omitempty"`
+}
+
+// acceptsJSON reports whether r's Accept header asks for application/json.
+func acceptsJSON(r *http.Request) bool {
+	for _, t := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(t); err == nil && mt == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeReadiness responds to a readiness request r with reason, why the proxy
+// is not ready or empty if it is. The body is JSON, including reason, if r
+// accepts it and otherwise plain text: "ok" or "error", as older clients
+// expect.
+func (s *Server) writeReadiness(w http.ResponseWriter, r *http.Request, c *proxy.Client, reason string) {
+	status := http.StatusOK
+	if reason != "" {
+		// Not being ready is usually transient, so ask clients to retry
+		// shortly.
+		w.Header().Set("Retry-After", retryAfterSeconds)
+		status = s.readinessFailure
+	}
+
+	if !acceptsJSON(r) {
+		w.WriteHeader(status)
+		if reason != "" {
+			w.Write([]byte("error"))
+			return
+		}
+		w.Write([]byte("ok"))
+		return
+	}
+
+	res := readinessResult{
+		Ready:  reason == "",
+		Reason: reason,
+		Checks: map[string]bool{
+			"started":      s.proxyStarted(),
+			"connections":  s.connLimitReason(c) == "",
+			"certificates": s.certsFresh(c),
+		},
+		MaxConnections:  c.MaxConnectionsLimit(),
+		OpenConnections: atomic.LoadUint64(&c.ConnectionsCounter),
+		Instances:       s.instanceStatuses(c),
+		CustomChecks:    s.readinessCheckStatuses(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		logging.Errorf("Failed to write readiness: %v", err)
+	}
+}
+
+// instanceReadiness describes the readiness of a single instance, served as
+// JSON on /readiness?instance= to clients that accept it.
+type instanceReadiness struct {
+	Ready bool `json:"ready"`
+	// Reason is why the instance is not ready, if it is not.
+	Reason   string         `json:"reason,omitempty"`
+	Instance instanceStatus `json:"instance"`
+}
+
+// instanceNotReadyReason returns why inst is not ready, or an empty string if
+// it is ready. The proxy-wide conditions of proxyReason are checked first,
+// then whether inst's client certificate has expired or it cannot be reached
+// with s.probe.
+func (s *Server) instanceNotReadyReason(ctx context.Context, c *proxy.Client, inst string) string {
+	if reason := s.proxyReason(c); reason != "" {
+		return reason
+	}
+	if exp, ok := c.CertExpirations()[inst]; ok {
+		if left := exp.Sub(s.now()); left <= 0 {
+			return fmt.Sprintf("client certificate for instance %q expired %v ago", inst, -left.Round(time.Second))
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.probeTimeout)
+	defer cancel()
+	if err := s.recordingProbe(s.probe)(ctx, inst); err != nil {
+		return fmt.Sprintf("instance %q is unreachable: %v", inst, err)
+	}
+	return ""
+}
+
+// writeInstanceReadiness responds to a readiness request r for the single
+// instance inst, which must be one c is configured for or has connected to,
+// or a probed instance, so that requests cannot make the proxy dial arbitrary
+// instances. The body is JSON if r accepts it and plain text, "ok" or
+// "error", otherwise.
+func (s *Server) writeInstanceReadiness(w http.ResponseWriter, r *http.Request, c *proxy.Client, inst string) {
+	if _, ok := s.instanceStatus(c, inst); !ok {
+		http.Error(w, fmt.Sprintf("error: unknown instance %q", inst), http.StatusNotFound)
+		return
+	}
+
+	reason := s.withReadinessTimeout(r.Context(), func(ctx context.Context) string {
+		return s.instanceNotReadyReason(ctx, c, inst)
+	})
+	status := http.StatusOK
+	if reason != "" {
+		s.logReadinessFailure(r.Context(), c, reason)
+		w.Header().Set("Retry-After", retryAfterSeconds)
+		status = s.readinessFailure
+	}
+
+	if !acceptsJSON(r) {
+		w.WriteHeader(status)
+		if reason != "" {
+			w.Write([]byte("error"))
+			return
+		}
+		w.Write([]byte("ok"))
+		return
+	}
+
+	// Look the instance up again to report the probe just run.
+	st, _ := s.instanceStatus(c, inst)
+	res := instanceReadiness{Ready: reason == "", Reason: reason, Instance: st}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		logging.Errorf("Failed to write instance readiness: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// ReadyEventPrefix starts the log line of the ReadyEvent, which is followed
+// by a space and the event encoded as JSON on the same line.
+const ReadyEventPrefix = "cloudsql-proxy event:"
+
+// ReadyEventName is the Event of a ReadyEvent.
+const ReadyEventName = "ready_for_connections"
+
+// ReadyEvent is logged once, the first time NotifyStarted is called, so that
+// external tooling can detect the proxy is ready without matching free text.
+type ReadyEvent struct {
+	// Event is always ReadyEventName.
+	Event string `json:"event"`
+	// Time is when the proxy finished starting up.
+	Time time.Time `json:"time"`
+	// StartupSeconds is the time between the health check Server being
+	// created and the proxy finishing startup.
+	StartupSeconds float64 `json:"startupSeconds"`
+	// HealthCheckAddr is the address the health check Server listens on.
+	HealthCheckAddr string `json:"healthCheckAddr"`
+}
+
+// logReadyEvent logs the ReadyEvent for s.
+func (s *Server) logReadyEvent() {
+	now := s.startedAt
+	_, ln := s.httpServer()
+	b, err := json.Marshal(ReadyEvent{
+		Event:           ReadyEventName,
+		Time:            now.UTC(),
+		StartupSeconds:  now.Sub(s.created).Seconds(),
+		HealthCheckAddr: ln.Addr().String(),
+	})
+	if err != nil {
+		logging.Errorf("Failed to encode ready event: %v", err)
+		return
+	}
+	logging.Infof("%s %s", ReadyEventPrefix, b)
+}
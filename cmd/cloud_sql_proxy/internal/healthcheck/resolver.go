@@ -0,0 +1,94 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// dnsCache holds the addresses hostnames resolved to for the health checks'
+// dialer, so that active checks do not look them up on every request.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+// dnsEntry is the addresses a hostname resolved to and when they expire.
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// lookupHost returns the addresses of host, resolving it with s.resolve only
+// if it was not resolved within the last dnsTTL. Failed lookups are not
+// cached.
+func (s *Server) lookupHost(ctx context.Context, host string) ([]string, error) {
+	now := s.now()
+	s.dnsCache.mu.Lock()
+	e, ok := s.dnsCache.entries[host]
+	s.dnsCache.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.addrs, nil
+	}
+
+	addrs, err := s.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	s.dnsCache.mu.Lock()
+	if s.dnsCache.entries == nil {
+		s.dnsCache.entries = make(map[string]dnsEntry)
+	}
+	s.dnsCache.entries[host] = dnsEntry{addrs: addrs, expires: now.Add(s.dnsTTL)}
+	s.dnsCache.mu.Unlock()
+	return addrs, nil
+}
+
+// dialCached connects to addr, resolving its host with lookupHost and trying
+// each of its addresses in turn.
+func (s *Server) dialCached(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	addrs, err := s.lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, network, net.JoinHostPort(a, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no addresses", Name: host}
+	}
+	return nil, err
+}
+
+// cachedDNSClient returns an HTTP client that resolves hostnames with
+// lookupHost.
+func (s *Server) cachedDNSClient() *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = s.dialCached
+	return &http.Client{Transport: t}
+}
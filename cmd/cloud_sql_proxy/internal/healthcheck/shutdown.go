@@ -0,0 +1,82 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"context"
+	"errors"
+)
+
+// A ShutdownPhase identifies the point during Close at which a shutdown hook
+// runs.
+type ShutdownPhase int
+
+const (
+	// PreDrain hooks run first, while the health check endpoints are still
+	// being served.
+	PreDrain ShutdownPhase = iota
+	// PostDrain hooks run once the health check server has stopped accepting
+	// requests and in-flight requests have completed.
+	PostDrain
+	// PreClose hooks run after PostDrain hooks, immediately before the
+	// Server's remaining resources are released.
+	PreClose
+	numShutdownPhases
+)
+
+// RegisterShutdownHook registers hook to be run by Close during the given
+// phase. Hooks within a phase run in the order they were registered, and
+// receive the context passed to Close. An error from a hook does not prevent
+// later hooks or shutdown steps from running; it is included in the error
+// returned by Close.
+func (s *Server) RegisterShutdownHook(phase ShutdownPhase, hook func(context.Context) error) error {
+	if phase < 0 || phase >= numShutdownPhases {
+		return errors.New("invalid shutdown phase")
+	}
+	s.hooksL.Lock()
+	defer s.hooksL.Unlock()
+	s.hooks[phase] = append(s.hooks[phase], hook)
+	return nil
+}
+
+// phaseHooks returns the hooks registered for phase.
+func (s *Server) phaseHooks(phase ShutdownPhase) []func(context.Context) error {
+	s.hooksL.Lock()
+	defer s.hooksL.Unlock()
+	return append([]func(context.Context) error(nil), s.hooks[phase]...)
+}
+
+// Close gracefully shuts down the HTTP server belonging to the Server along
+// with any other resources it holds, running registered shutdown hooks at
+// their phases. The returned error joins the errors of every hook and
+// shutdown step that failed.
+func (s *Server) Close(ctx context.Context) error {
+	s.closingOnce.Do(func() { close(s.closing) })
+	var errs []error
+	run := func(steps []func(context.Context) error) {
+		for _, step := range steps {
+			if err := step(ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	run(s.phaseHooks(PreDrain))
+	s.deregister(ctx)
+	run(s.drain)
+	run(s.phaseHooks(PostDrain))
+	run(s.phaseHooks(PreClose))
+	run(s.shutdown)
+	return joinErrors(errs)
+}
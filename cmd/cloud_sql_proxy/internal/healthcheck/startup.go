@@ -0,0 +1,128 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+)
+
+// maxPendingListed is how many instances still being initialized the startup
+// endpoint names.
+const maxPendingListed = 5
+
+// startupProgress tracks which configured instances have been initialized
+// while the proxy starts up.
+type startupProgress struct {
+	mu          sync.Mutex
+	initialized map[string]bool
+}
+
+// add records that instance has been initialized.
+func (p *startupProgress) add(instance string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.initialized == nil {
+		p.initialized = make(map[string]bool)
+	}
+	p.initialized[instance] = true
+}
+
+// describe returns how many of instances have been initialized, naming some
+// of those that have not, or an empty string if there are no instances.
+func (p *startupProgress) describe(instances []string) string {
+	if len(instances) == 0 {
+		return ""
+	}
+	p.mu.Lock()
+	var pending []string
+	for _, inst := range instances {
+		if !p.initialized[inst] {
+			pending = append(pending, inst)
+		}
+	}
+	p.mu.Unlock()
+	desc := fmt.Sprintf("%d of %d instances initialized", len(instances)-len(pending), len(instances))
+	if len(pending) > maxPendingListed {
+		return fmt.Sprintf("%s, waiting for %s and %d more", desc, strings.Join(pending[:maxPendingListed], ", "), len(pending)-maxPendingListed)
+	}
+	if len(pending) > 0 {
+		return fmt.Sprintf("%s, waiting for %s", desc, strings.Join(pending, ", "))
+	}
+	return desc
+}
+
+// NotifyInstanceInitialized tells the Server that instance, one of the
+// proxy.Client's Instances, is ready to accept connections. Until
+// NotifyStarted is called, the startup endpoint reports how many instances
+// have been initialized.
+func (s *Server) NotifyInstanceInitialized(instance string) {
+	s.startup.add(instance)
+}
+
+// startupHandler responds with http.StatusOK once NotifyStarted has been
+// called, and otherwise with the progress of initializing the instances. It
+// does not depend on readiness, so that a startup probe is not failed by a
+// proxy that started but is briefly not ready.
+func (s *Server) startupHandler(w http.ResponseWriter, _ *http.Request) {
+	if s.proxyStarted() {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+		return
+	}
+	body := "error: proxy has not finished starting up"
+	if progress := s.startup.describe(s.client.Instances); progress != "" {
+		body += " (" + progress + ")"
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(body))
+}
+
+// graceReason returns why the proxy is still within the readiness grace
+// period after startup, or an empty string once it has ended, readinessGrace
+// after startup finished or as soon as an instance has been dialed
+// successfully, whichever comes first. Once ended, it does not resume.
+func (s *Server) graceReason(c *proxy.Client) string {
+	if s.readinessGrace == 0 || atomic.LoadInt32(&s.graceOver) == 1 {
+		return ""
+	}
+	if left := s.readinessGrace - s.now().Sub(s.startedAt); left > 0 && !s.dialedInstance(c) {
+		return fmt.Sprintf("readiness grace period after startup has %v left and no instance has been dialed successfully yet", left.Round(time.Second))
+	}
+	atomic.StoreInt32(&s.graceOver, 1)
+	return ""
+}
+
+// dialedInstance reports whether an instance was recently dialed
+// successfully, for a new connection or by a probe.
+func (s *Server) dialedInstance(c *proxy.Client) bool {
+	if ratio, attempts := c.SuccessRatio(); attempts > 0 && ratio > 0 {
+		return true
+	}
+	s.probeResults.mu.Lock()
+	defer s.probeResults.mu.Unlock()
+	for _, res := range s.probeResults.m {
+		if res.err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/cmd/cloud_sql_proxy/internal/healthcheck/healthpb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// HealthState returns a snapshot of the proxy's health, evaluating readiness
+// afresh.
+func (s *Server) HealthState() *healthpb.HealthState {
+	c := s.client
+	reason := s.evaluateReadiness(context.Background(), c)
+	ratio, attempts := c.SuccessRatio()
+	st := &healthpb.HealthState{
+		Started:                s.proxyStarted(),
+		Ready:                  reason == "",
+		Draining:               s.proxyDraining(),
+		NotReadyReason:         reason,
+		OpenConnections:        atomic.LoadUint64(&c.ConnectionsCounter),
+		MaxConnections:         c.MaxConnectionsLimit(),
+		ConnectionChurnRate:    c.ChurnRate(),
+		ConnectionSuccessRatio: ratio,
+		ConnectionAttempts:     attempts,
+		Goroutines:             make(map[string]int64),
+	}
+	for g, n := range c.Goroutines() {
+		st.Goroutines[g.String()] = n
+	}
+	insts := make(map[string]*healthpb.InstanceState)
+	instance := func(name string) *healthpb.InstanceState {
+		is, ok := insts[name]
+		if !ok {
+			is = &healthpb.InstanceState{Name: name}
+			insts[name] = is
+			st.Instances = append(st.Instances, is)
+		}
+		return is
+	}
+	for inst, b := range c.BytesTransferred() {
+		is := instance(inst)
+		is.BytesRead, is.BytesWritten = b.Read, b.Written
+	}
+	for _, status := range s.instanceStatuses(c) {
+		is := instance(status.Name)
+		is.Probed = status.Probed
+		if status.CertExpiry != nil {
+			is.CertExpiry = timestamppb.New(*status.CertExpiry)
+		}
+		if p := status.LastProbe; p != nil {
+			is.LastProbe = &healthpb.ProbeState{
+				Time:      timestamppb.New(p.Time),
+				Reachable: p.Reachable,
+				Error:     p.Error,
+				Latency:   durationpb.New(time.Duration(p.LatencySeconds * float64(time.Second))),
+			}
+			if p.UnreachableSince != nil {
+				is.LastProbe.UnreachableSince = timestamppb.New(*p.UnreachableSince)
+			}
+		}
+	}
+	sort.Slice(st.Instances, func(i, j int) bool { return st.Instances[i].Name < st.Instances[j].Name })
+	return st
+}
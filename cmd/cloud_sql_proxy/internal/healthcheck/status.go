@@ -0,0 +1,141 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+)
+
+const statusPath = "/status"
+
+// status is a snapshot of the proxy's state, served as JSON on /status.
+type status struct {
+	Started         bool   `json:"started"`
+	OpenConnections uint64 `json:"openConnections"`
+	MaxConnections  uint64 `json:"maxConnections"`
+	// SuccessRatio is the fraction of recent connection attempts for which
+	// the instance was dialed successfully, out of ConnectionAttempts.
+	SuccessRatio       float64 `json:"successRatio"`
+	ConnectionAttempts uint64  `json:"connectionAttempts"`
+	// Goroutines is the number of goroutines the proxy is running, keyed by
+	// proxy.GoroutineCategory.
+	Goroutines map[string]int64 `json:"goroutines"`
+	// OpenConnectionsByTransport is the number of open connections keyed by
+	// proxy.Transport.
+	OpenConnectionsByTransport map[string]int64 `json:"openConnectionsByTransport"`
+}
+
+// status returns a snapshot of the proxy's state.
+func (s *Server) status(c *proxy.Client) status {
+	ratio, attempts := c.SuccessRatio()
+	goroutines := make(map[string]int64)
+	for g, n := range c.Goroutines() {
+		goroutines[g.String()] = n
+	}
+	transports := make(map[string]int64)
+	for t, n := range c.ConnectionsByTransport() {
+		transports[t.String()] = n
+	}
+	return status{
+		Started:            s.proxyStarted(),
+		OpenConnections:    atomic.LoadUint64(&c.ConnectionsCounter),
+		MaxConnections:     c.MaxConnectionsLimit(),
+		SuccessRatio:       ratio,
+		ConnectionAttempts: attempts,
+		Goroutines:         goroutines,
+
+		OpenConnectionsByTransport: transports,
+	}
+}
+
+// statusVersion tracks when the status served on /status last changed, for
+// conditional requests.
+type statusVersion struct {
+	mu      sync.Mutex
+	body    []byte
+	changed time.Time
+	// n is incremented on every change, so that changes at the same time
+	// still get distinct ETags.
+	n uint64
+}
+
+// update records body as the current status, returning the ETag and time of
+// its last change.
+func (v *statusVersion) update(body []byte, now time.Time) (etag string, changed time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.changed.IsZero() || !bytes.Equal(body, v.body) {
+		v.body = body
+		v.changed = now
+		v.n++
+	}
+	return fmt.Sprintf(`"%x-%x"`, v.changed.UnixNano(), v.n), v.changed
+}
+
+// notModified reports whether r is a conditional request that the response
+// with etag, last changed at changed, satisfies. As in RFC 7232,
+// If-Modified-Since is ignored when If-None-Match is present.
+func notModified(r *http.Request, etag string, changed time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			if t = strings.TrimSpace(t); t == etag || t == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// Last-Modified has a resolution of one second.
+	return !changed.Truncate(time.Second).After(ims)
+}
+
+// statusHandler serves a snapshot of the proxy's state as JSON. It supports
+// conditional requests, with an ETag and Last-Modified reflecting when the
+// state last changed.
+func (s *Server) statusHandler(c *proxy.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := json.Marshal(s.status(c))
+		if err != nil {
+			logging.Errorf("Failed to encode status: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body = append(body, '\n')
+		etag, changed := s.statusVersion.update(body, s.now())
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", changed.UTC().Format(http.TimeFormat))
+		if notModified(r, etag, changed) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(body); err != nil {
+			logging.Errorf("Failed to write status: %v", err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// defaultMinTLSVersion is the minimum TLS version the health check endpoints
+// are served with when neither WithMinTLSVersion nor the tls.Config passed to
+// WithTLSConfig set one.
+const defaultMinTLSVersion = tls.VersionTLS12
+
+// selfSignedValidity is how long the certificate generated by
+// WithSelfSignedCert is valid for.
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// newSelfSignedCert returns a self-signed certificate for localhost, the
+// loopback addresses and the host name.
+func newSelfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "cloudsql-proxy health check"},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// serverTLSConfig returns the TLS configuration the health check endpoints
+// are served with, or nil if they are served over plain HTTP.
+func (s *Server) serverTLSConfig() (*tls.Config, error) {
+	if s.tlsCfg == nil && s.certFile == "" && s.keyFile == "" && !s.selfSigned {
+		if s.clientCAs != nil || s.requireClientCert {
+			return nil, errors.New("client certificate verification requires TLS to be enabled")
+		}
+		if s.minTLSVersion != 0 || s.cipherSuites != nil {
+			return nil, errors.New("TLS version and cipher suite options require TLS to be enabled")
+		}
+		return nil, nil
+	}
+	cfg := s.tlsCfg.Clone()
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if s.certFile != "" || s.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load health check TLS certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if s.selfSigned && len(cfg.Certificates) == 0 && cfg.GetCertificate == nil {
+		cert, err := newSelfSignedCert()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate health check TLS certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	switch s.minTLSVersion {
+	case 0:
+		if cfg.MinVersion == 0 {
+			cfg.MinVersion = defaultMinTLSVersion
+		}
+	case tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13:
+		cfg.MinVersion = s.minTLSVersion
+	default:
+		return nil, fmt.Errorf("invalid minimum TLS version %#04x", s.minTLSVersion)
+	}
+	if s.cipherSuites != nil {
+		supported := make(map[uint16]bool)
+		for _, cs := range tls.CipherSuites() {
+			supported[cs.ID] = true
+		}
+		for _, id := range s.cipherSuites {
+			if !supported[id] {
+				return nil, fmt.Errorf("unsupported or insecure cipher suite %s", tls.CipherSuiteName(id))
+			}
+		}
+		cfg.CipherSuites = s.cipherSuites
+	}
+	if s.clientCAs != nil {
+		cfg.ClientCAs = s.clientCAs
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if s.requireClientCert {
+		if cfg.ClientCAs == nil {
+			return nil, errors.New("requiring client certificates requires a client CA")
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+const versionPath = "/version"
+
+// versionInfo identifies the build of the proxy, served as JSON on /version.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"goVersion"`
+}
+
+// versionHandler serves the proxy's version, git commit and Go runtime
+// version as JSON.
+func (s *Server) versionHandler(w http.ResponseWriter, _ *http.Request) {
+	v := versionInfo{
+		Version:   s.version,
+		Commit:    s.commit,
+		GoVersion: runtime.Version(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Errorf("Failed to write version: %v", err)
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -38,7 +39,9 @@ import (
 // local connections.  Values received from the updates channel are
 // interpretted as a comma-separated list of instances.  The set of sockets in
 // 'dir' is the union of 'instances' and the most recent list from 'updates'.
-func WatchInstances(dir string, cfgs []instanceConfig, updates <-chan string, cl *http.Client) (<-chan proxy.Conn, error) {
+// If set, onListen is called with each instance in cfgs once its socket is
+// open.
+func WatchInstances(dir string, cfgs []instanceConfig, updates <-chan string, cl *http.Client, onListen func(instance string)) (<-chan proxy.Conn, error) {
 	ch := make(chan proxy.Conn, 1)
 
 	// Instances specified statically (e.g. as flags to the binary) will always
@@ -51,6 +54,9 @@ func WatchInstances(dir string, cfgs []instanceConfig, updates <-chan string, cl
 			return nil, err
 		}
 		staticInstances[v.Instance] = l
+		if onListen != nil {
+			onListen(v.Instance)
+		}
 	}
 
 	if updates != nil {
@@ -330,6 +336,91 @@ func parseInstanceConfigs(dir string, instances []string, cl *http.Client, skipF
 	return cfg, err
 }
 
+// portUser is a listener, or planned listener, on a TCP port.
+type portUser struct {
+	desc string
+	host string
+	port int
+}
+
+// overlaps reports whether u and v cannot both listen on their address.
+func (u portUser) overlaps(v portUser) bool {
+	if u.port != v.port {
+		return false
+	}
+	wildcard := func(host string) bool {
+		ip := net.ParseIP(host)
+		return host == "" || ip != nil && ip.IsUnspecified()
+	}
+	return u.host == v.host || wildcard(u.host) || wildcard(v.host)
+}
+
+// splitHealthCheckAddress returns the host and port the health check server
+// binds to given addr, a host or host:port, and the port used if addr has none.
+// An empty addr binds port on all interfaces.
+func splitHealthCheckAddress(addr, port string) (string, string, error) {
+	if addr == "" {
+		return "", port, nil
+	}
+	host, p, err := net.SplitHostPort(addr)
+	if err == nil {
+		return host, p, nil
+	}
+	// addr may be a host without a port, including a bare IPv6 address.
+	if h := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"); net.ParseIP(h) != nil {
+		return h, port, nil
+	}
+	if !strings.Contains(addr, ":") {
+		return addr, port, nil
+	}
+	return "", "", fmt.Errorf("invalid health check address %q: %v", addr, err)
+}
+
+// checkPortCollisions returns an error if any two of the health check port on
+// healthCheckHost, the application port and the TCP addresses in cfgs would
+// listen on the same port. An empty healthCheckPort or zero appPort is not
+// checked.
+func checkPortCollisions(healthCheckHost, healthCheckPort string, appPort int, cfgs []instanceConfig) error {
+	var users []portUser
+	if healthCheckPort != "" {
+		p, err := strconv.Atoi(healthCheckPort)
+		if err != nil {
+			return fmt.Errorf("invalid health check port %q: %v", healthCheckPort, err)
+		}
+		users = append(users, portUser{desc: "the health check server", host: healthCheckHost, port: p})
+	}
+	if appPort != 0 {
+		users = append(users, portUser{desc: "the application", port: appPort})
+	}
+	for _, cfg := range cfgs {
+		if !strings.HasPrefix(cfg.Network, "tcp") {
+			continue
+		}
+		host, port, err := net.SplitHostPort(cfg.Address)
+		if err != nil {
+			return fmt.Errorf("invalid address %q for %q: %v", cfg.Address, cfg.Instance, err)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return fmt.Errorf("invalid port in address %q for %q: %v", cfg.Address, cfg.Instance, err)
+		}
+		if p == 0 {
+			// The operating system picks an unused port.
+			continue
+		}
+		users = append(users, portUser{desc: fmt.Sprintf("the listener for %q", cfg.Instance), host: host, port: p})
+	}
+
+	for i, u := range users {
+		for _, v := range users[:i] {
+			if u.overlaps(v) {
+				return fmt.Errorf("port %d is used by both %s and %s; configure different ports", u.port, v.desc, u.desc)
+			}
+		}
+	}
+	return nil
+}
+
 // CreateInstanceConfigs verifies that the parameters passed to it are valid
 // for the proxy for the platform and system and then returns a slice of valid
 // instanceConfig. It is possible for the instanceConfig to be empty if no valid
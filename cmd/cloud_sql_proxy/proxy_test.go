@@ -22,6 +22,7 @@ import (
 	"net/http"
 	"os"
 	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -209,3 +210,128 @@ func TestParseInstanceConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitHealthCheckAddress(t *testing.T) {
+	tcs := []struct {
+		addr     string
+		wantHost string
+		wantPort string
+	}{
+		{"", "", "8090"},
+		{"127.0.0.1:9090", "127.0.0.1", "9090"},
+		{"127.0.0.1", "127.0.0.1", "8090"},
+		{"localhost", "localhost", "8090"},
+		{"[::1]:9090", "::1", "9090"},
+		{"[::1]", "::1", "8090"},
+		{"::1", "::1", "8090"},
+		{":9090", "", "9090"},
+	}
+	for _, tc := range tcs {
+		host, port, err := splitHealthCheckAddress(tc.addr, "8090")
+		if err != nil {
+			t.Errorf("splitHealthCheckAddress(%q) returned error: %v", tc.addr, err)
+			continue
+		}
+		if host != tc.wantHost || port != tc.wantPort {
+			t.Errorf("splitHealthCheckAddress(%q) = %q, %q, want %q, %q", tc.addr, host, port, tc.wantHost, tc.wantPort)
+		}
+	}
+	if _, _, err := splitHealthCheckAddress("a:b:c", "8090"); err == nil {
+		t.Error("splitHealthCheckAddress(\"a:b:c\") succeeded, want error")
+	}
+}
+
+func TestCheckPortCollisions(t *testing.T) {
+	tcs := []struct {
+		desc            string
+		healthCheckHost string
+		healthCheckPort string
+		appPort         int
+		cfgs            []instanceConfig
+		wantErr         string
+	}{
+		{
+			desc:            "no collision",
+			healthCheckPort: "8090",
+			appPort:         8080,
+			cfgs: []instanceConfig{
+				{"proj:reg:a", "tcp", "127.0.0.1:5432"},
+				{"proj:reg:b", "tcp", "127.0.0.1:5433"},
+				{"proj:reg:c", "unix", "/x/proj:reg:c"},
+			},
+		},
+		{
+			desc:    "same port on different hosts",
+			appPort: 8080,
+			cfgs: []instanceConfig{
+				{"proj:reg:a", "tcp", "127.0.0.1:5432"},
+				{"proj:reg:b", "tcp", "127.0.0.2:5432"},
+			},
+		},
+		{
+			desc:            "health check and application",
+			healthCheckPort: "8080",
+			appPort:         8080,
+			wantErr:         "port 8080 is used by both the health check server and the application",
+		},
+		{
+			desc:    "application and instance",
+			appPort: 5432,
+			cfgs:    []instanceConfig{{"proj:reg:a", "tcp", "127.0.0.1:5432"}},
+			wantErr: `port 5432 is used by both the application and the listener for "proj:reg:a"`,
+		},
+		{
+			desc:            "health check and instance",
+			healthCheckPort: "8090",
+			cfgs:            []instanceConfig{{"proj:reg:a", "tcp", "[::1]:8090"}},
+			wantErr:         `port 8090 is used by both the health check server and the listener for "proj:reg:a"`,
+		},
+		{
+			desc:            "health check and instance on different hosts",
+			healthCheckHost: "127.0.0.1",
+			healthCheckPort: "8090",
+			cfgs:            []instanceConfig{{"proj:reg:a", "tcp", "127.0.0.2:8090"}},
+		},
+		{
+			desc:            "health check and instance on the same host",
+			healthCheckHost: "127.0.0.1",
+			healthCheckPort: "8090",
+			cfgs:            []instanceConfig{{"proj:reg:a", "tcp", "127.0.0.1:8090"}},
+			wantErr:         `port 8090 is used by both the health check server and the listener for "proj:reg:a"`,
+		},
+		{
+			desc:            "health check on one host and instance on all interfaces",
+			healthCheckHost: "::1",
+			healthCheckPort: "8090",
+			cfgs:            []instanceConfig{{"proj:reg:a", "tcp", "0.0.0.0:8090"}},
+			wantErr:         `port 8090 is used by both the health check server and the listener for "proj:reg:a"`,
+		},
+		{
+			desc:            "health check on one host and application",
+			healthCheckHost: "127.0.0.1",
+			healthCheckPort: "8080",
+			appPort:         8080,
+			wantErr:         "port 8080 is used by both the health check server and the application",
+		},
+		{
+			desc: "two instances",
+			cfgs: []instanceConfig{
+				{"proj:reg:a", "tcp", "0.0.0.0:5432"},
+				{"proj:reg:b", "tcp", "127.0.0.1:5432"},
+			},
+			wantErr: `port 5432 is used by both the listener for "proj:reg:a" and the listener for "proj:reg:b"`,
+		},
+	}
+	for _, tc := range tcs {
+		err := checkPortCollisions(tc.healthCheckHost, tc.healthCheckPort, tc.appPort, tc.cfgs)
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("checkPortCollisions with %s returned error: %v", tc.desc, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("checkPortCollisions with %s = %v, want error containing %q", tc.desc, err, tc.wantErr)
+		}
+	}
+}
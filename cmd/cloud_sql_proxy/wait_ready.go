@@ -0,0 +1,182 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file contains the wait-ready subcommand, which blocks until a running
+// proxy reports that it is ready. It doubles as an exec probe for a health
+// check server listening on a Unix domain socket, which HTTP probes cannot
+// reach.
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const waitReadyCmd = "wait-ready"
+
+// waitReadyMain runs the wait-ready subcommand with args and returns its exit
+// code: 0 if the proxy became ready, 1 if it did not before the timeout and 2
+// if args are invalid.
+func waitReadyMain(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet(waitReadyCmd, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	timeout := fs.Duration("timeout", 30*time.Second, "How long to wait for the proxy to become ready.")
+	interval := fs.Duration("interval", time.Second, "How long to wait between readiness checks.")
+	srv := addHealthServerFlags(fs)
+	path := fs.String("path", "/readiness", "The health check endpoint to request, such as /liveness.")
+	token := fs.String("token", "", "The bearer token the proxy's health check server requires, as set with -health_check_token.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	client, url, err := srv.client(*path)
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid health check server flags: %v\n", err)
+		return 2
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if reason, err := waitReady(ctx, client, url, *token, *interval); err != nil {
+		fmt.Fprintf(stderr, "The proxy is not ready after %v: %s\n", *timeout, reason)
+		return 1
+	}
+	return 0
+}
+
+// healthServer locates a proxy's health check server. Its fields are set by
+// the flags that addHealthServerFlags defines, which the health and
+// wait-ready subcommands share.
+type healthServer struct {
+	addr     string
+	socket   string
+	tls      bool
+	caFile   string
+	insecure bool
+}
+
+// addHealthServerFlags defines the flags that locate a proxy's health check
+// server in fs and returns the healthServer they set.
+func addHealthServerFlags(fs *flag.FlagSet) *healthServer {
+	s := &healthServer{}
+	fs.StringVar(&s.addr, "health-addr", "localhost:8090", "The host:port the proxy's health check server listens on.")
+	fs.StringVar(&s.socket, "health-socket", "", "The path of the Unix domain socket the proxy's health check server listens on, if it does not listen on -health-addr.")
+	fs.BoolVar(&s.tls, "tls", false, "Connect to the proxy's health check server over HTTPS, as set with -health_check_tls or -health_check_tls_cert.")
+	fs.StringVar(&s.caFile, "ca-file", "", "The PEM encoded CA certificates to verify the health check server's certificate with instead of the system's. Implies -tls.")
+	fs.BoolVar(&s.insecure, "insecure-skip-verify", false, "Do not verify the health check server's certificate, such as the self-signed one generated with -health_check_tls. Implies -tls.")
+	return s
+}
+
+// client returns an HTTP client that reaches the health check server and the
+// URL of path on it. Requests are sent over the Unix domain socket, if set,
+// whatever the host of the URL.
+func (s *healthServer) client(path string) (*http.Client, string, error) {
+	scheme, host := "http", s.addr
+	t := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if s.socket != "" {
+		// The host is only used to verify the server's certificate, which
+		// the self-signed one is valid for.
+		host = "localhost"
+		t.Proxy = nil
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", s.socket)
+		}
+	}
+	if s.tls || s.caFile != "" || s.insecure {
+		scheme = "https"
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: s.insecure}
+		if s.caFile != "" {
+			pem, err := ioutil.ReadFile(s.caFile)
+			if err != nil {
+				return nil, "", err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, "", fmt.Errorf("no certificates found in %s", s.caFile)
+			}
+			t.TLSClientConfig.RootCAs = pool
+		}
+	}
+	return &http.Client{Transport: t}, scheme + "://" + host + path, nil
+}
+
+// waitReady polls url, authorized with the bearer token if set, every
+// interval until it responds with http.StatusOK, returning nil, or until ctx
+// is done, returning ctx's error and the reason the last check failed.
+func waitReady(ctx context.Context, client *http.Client, url, token string, interval time.Duration) (reason string, err error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		ok, r := checkReady(ctx, client, url, token)
+		if ok {
+			return "", nil
+		}
+		// Keep the reason from the previous check if this one was cut short
+		// by the deadline.
+		if ctx.Err() == nil || reason == "" {
+			reason = r
+		}
+		select {
+		case <-ctx.Done():
+			return reason, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// checkReady requests url once, authorized with the bearer token if set,
+// returning whether it responded with http.StatusOK and, if not, why.
+func checkReady(ctx context.Context, client *http.Client, url, token string) (bool, string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false, err.Error()
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err.Error()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return true, ""
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return false, fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// runSubcommand runs the subcommand named by os.Args[1], if any, and exits.
+func runSubcommand() {
+	if len(os.Args) < 2 {
+		return
+	}
+	switch os.Args[1] {
+	case waitReadyCmd:
+		os.Exit(waitReadyMain(os.Args[2:], os.Stderr))
+	case healthCmd:
+		os.Exit(healthMain(os.Args[2:], os.Stderr))
+	}
+}
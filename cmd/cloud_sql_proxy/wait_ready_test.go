@@ -0,0 +1,165 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWaitReady(t *testing.T) {
+	var checks int32
+	ready := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if atomic.AddInt32(&checks, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("error"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ready.Close()
+	never := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("error: proxy has not finished starting up"))
+	}))
+	defer never.Close()
+
+	tcs := []struct {
+		desc       string
+		addr       string
+		wantCode   int
+		wantStderr string
+	}{
+		{"ready", ready.Listener.Addr().String(), 0, ""},
+		{"never ready", never.Listener.Addr().String(), 1, "503 Service Unavailable: error: proxy has not finished starting up"},
+	}
+	for _, tc := range tcs {
+		var stderr bytes.Buffer
+		code := waitReadyMain([]string{"--health-addr", tc.addr, "--interval", "10ms", "--timeout", "200ms"}, &stderr)
+		if code != tc.wantCode {
+			t.Errorf("%s: got exit code %d, want %d (stderr %q)", tc.desc, code, tc.wantCode, stderr.String())
+		}
+		if !strings.Contains(stderr.String(), tc.wantStderr) {
+			t.Errorf("%s: got stderr %q, want it to contain %q", tc.desc, stderr.String(), tc.wantStderr)
+		}
+	}
+
+	if code := waitReadyMain([]string{"--timeout", "soon"}, &bytes.Buffer{}); code != 2 {
+		t.Errorf("Got exit code %d for invalid flags, want 2", code)
+	}
+}
+
+func TestWaitReadyUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix domain sockets are not supported on Windows")
+	}
+	dir, err := ioutil.TempDir("", "wait-ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "health.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/liveness" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("error: proxy has not finished starting up"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	var stderr bytes.Buffer
+	if code := waitReadyMain([]string{"--health-socket", socket, "--path", "/liveness", "--timeout", "200ms"}, &stderr); code != 0 {
+		t.Errorf("Got exit code %d for /liveness, want 0 (stderr %q)", code, stderr.String())
+	}
+	stderr.Reset()
+	if code := waitReadyMain([]string{"--health-socket", socket, "--interval", "10ms", "--timeout", "200ms"}, &stderr); code != 1 {
+		t.Errorf("Got exit code %d for /readiness, want 1 (stderr %q)", code, stderr.String())
+	}
+}
+
+func TestWaitReadyToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	var stderr bytes.Buffer
+	if code := waitReadyMain([]string{"--health-addr", addr, "--token", "secret", "--timeout", "200ms"}, &stderr); code != 0 {
+		t.Errorf("Got exit code %d with the token, want 0 (stderr %q)", code, stderr.String())
+	}
+	stderr.Reset()
+	if code := waitReadyMain([]string{"--health-addr", addr, "--interval", "10ms", "--timeout", "200ms"}, &stderr); code != 1 {
+		t.Errorf("Got exit code %d without the token, want 1 (stderr %q)", code, stderr.String())
+	}
+}
+
+func TestWaitReadyTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	tcs := []struct {
+		desc     string
+		args     []string
+		wantCode int
+	}{
+		{"CA file", []string{"--ca-file", f.Name()}, 0},
+		{"insecure", []string{"--insecure-skip-verify"}, 0},
+		{"unverified", []string{"--tls"}, 1},
+		{"plain HTTP", nil, 1},
+		{"missing CA file", []string{"--ca-file", f.Name() + ".missing"}, 2},
+	}
+	for _, tc := range tcs {
+		var stderr bytes.Buffer
+		args := append([]string{"--health-addr", addr, "--interval", "10ms", "--timeout", "200ms"}, tc.args...)
+		if code := waitReadyMain(args, &stderr); code != tc.wantCode {
+			t.Errorf("%s: got exit code %d, want %d (stderr %q)", tc.desc, code, tc.wantCode, stderr.String())
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// BufferedWriter writes logs to an underlying writer asynchronously, through a
+// fixed-size buffer, so that a slow sink does not block the proxy. Writes made
+// while the buffer is full are dropped. It can be installed with, for
+// example, log.SetOutput.
+type BufferedWriter struct {
+	// dropped is accessed atomically, so it comes first to keep it 64-bit
+	// aligned.
+	dropped uint64
+
+	w         io.Writer
+	buf       chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewBufferedWriter returns a BufferedWriter that buffers up to size writes to
+// w. It must be closed to flush the buffer.
+func NewBufferedWriter(w io.Writer, size int) *BufferedWriter {
+	b := &BufferedWriter{
+		w:    w,
+		buf:  make(chan []byte, size),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(b.done)
+		for p := range b.buf {
+			b.w.Write(p)
+		}
+	}()
+	return b
+}
+
+// Write queues p to be written, dropping it if the buffer is full. It never
+// fails.
+func (b *BufferedWriter) Write(p []byte) (int, error) {
+	q := make([]byte, len(p))
+	copy(q, p)
+	select {
+	case b.buf <- q:
+	default:
+		atomic.AddUint64(&b.dropped, 1)
+	}
+	return len(p), nil
+}
+
+// Saturated reports whether the buffer is full, so that further writes are
+// dropped until the underlying writer catches up.
+func (b *BufferedWriter) Saturated() bool {
+	return len(b.buf) == cap(b.buf)
+}
+
+// Dropped returns the number of writes dropped because the buffer was full.
+func (b *BufferedWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// Close writes the buffered logs to the underlying writer and returns once
+// they are written. It must not be called concurrently with Write.
+func (b *BufferedWriter) Close() error {
+	b.closeOnce.Do(func() { close(b.buf) })
+	<-b.done
+	return nil
+}
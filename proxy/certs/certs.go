@@ -16,6 +16,7 @@
 package certs
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -150,6 +151,13 @@ type RemoteCertSource struct {
 	EnableIAMLogin bool
 	// token source for the token information used in cert creation
 	TokenSource oauth2.TokenSource
+	// usage tracks recent calls to the Cloud SQL Admin API.
+	usage apiUsage
+	// credsOnce is used to create creds lazily. creds reuses the tokens
+	// TokenSource returns until they expire, so that CheckCredentials does
+	// not refresh them more often than necessary.
+	credsOnce sync.Once
+	creds     oauth2.TokenSource
 }
 
 // Constants for backoffAPIRetry. These cause the retry logic to scale the
@@ -236,6 +244,7 @@ func (s *RemoteCertSource) Local(instance string) (tls.Certificate, error) {
 	var data *sqladmin.SslCert
 	err = backoffAPIRetry("createEphemeral for", instance, func() error {
 		data, err = req.Do()
+		s.usage.record(err)
 		return err
 	})
 	if err != nil {
@@ -302,6 +311,44 @@ func (s *RemoteCertSource) findIPAddr(data *sqladmin.DatabaseInstance, instance
 	return "", fmt.Errorf("User input IP address type %v does not match the instance %v, the instance's IP addresses are %v ", ipAddrTypeOfUser, instance, ipAddrTypesOfInstance)
 }
 
+// APIUsage returns the number of calls made to the Cloud SQL Admin API in the
+// last minute and how many of those were rejected for exceeding quota.
+func (s *RemoteCertSource) APIUsage() (calls, rateLimited uint64) {
+	return s.usage.counts()
+}
+
+// CheckCredentials returns an error if a valid access token cannot be obtained
+// from TokenSource before ctx is done. Tokens are reused until they expire. If
+// TokenSource is not set, there is nothing to check and it returns nil.
+func (s *RemoteCertSource) CheckCredentials(ctx context.Context) error {
+	if s.TokenSource == nil {
+		return nil
+	}
+	s.credsOnce.Do(func() { s.creds = oauth2.ReuseTokenSource(nil, s.TokenSource) })
+
+	type result struct {
+		tok *oauth2.Token
+		err error
+	}
+	res := make(chan result, 1)
+	go func() {
+		tok, err := s.creds.Token()
+		res <- result{tok, err}
+	}()
+	select {
+	case r := <-res:
+		if r.err != nil {
+			return r.err
+		}
+		if !r.tok.Valid() {
+			return errors.New("access token is invalid or expired")
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out obtaining access token: %v", ctx.Err())
+	}
+}
+
 // Remote returns the specified instance's CA certificate, address, and name.
 func (s *RemoteCertSource) Remote(instance string) (cert *x509.Certificate, addr, name, version string, err error) {
 	p, region, n := util.SplitName(instance)
@@ -311,6 +358,7 @@ func (s *RemoteCertSource) Remote(instance string) (cert *x509.Certificate, addr
 	var data *sqladmin.DatabaseInstance
 	err = backoffAPIRetry("get instance", instance, func() error {
 		data, err = req.Do()
+		s.usage.record(err)
 		return err
 	})
 	if err != nil {
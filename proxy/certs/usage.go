@@ -0,0 +1,67 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// apiUsageWindow is the period over which API usage is reported.
+const apiUsageWindow = time.Minute
+
+// apiUsage records the times of recent calls to the Cloud SQL Admin API.
+type apiUsage struct {
+	mu sync.Mutex
+	// calls and rateLimited hold the times of calls made within the last
+	// apiUsageWindow, oldest first. rateLimited only holds calls that were
+	// rejected for exceeding quota.
+	calls       []time.Time
+	rateLimited []time.Time
+}
+
+// record notes an API call that returned err.
+func (u *apiUsage) record(err error) {
+	now := time.Now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.calls = append(prune(u.calls, now), now)
+	if gErr, ok := err.(*googleapi.Error); ok && gErr.Code == http.StatusTooManyRequests {
+		u.rateLimited = append(prune(u.rateLimited, now), now)
+	}
+}
+
+// counts returns the number of calls made within the last apiUsageWindow and
+// how many of those were rate limited.
+func (u *apiUsage) counts() (calls, rateLimited uint64) {
+	now := time.Now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.calls = prune(u.calls, now)
+	u.rateLimited = prune(u.rateLimited, now)
+	return uint64(len(u.calls)), uint64(len(u.rateLimited))
+}
+
+// prune removes the times older than apiUsageWindow from ts.
+func prune(ts []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(ts) && now.Sub(ts[i]) >= apiUsageWindow {
+		i++
+	}
+	return ts[i:]
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// recordActivity records that the Client made progress, by accepting a
+// connection or proxying bytes, now.
+func (c *Client) recordActivity() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// LastActivity returns when the Client last made progress, by accepting a
+// connection or proxying bytes, or the zero time if it has not yet.
+func (c *Client) LastActivity() time.Time {
+	n := atomic.LoadInt64(&c.lastActivity)
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// trackRefresh records that a certificate refresh started now, and returns a
+// function that records that it finished.
+func (c *Client) trackRefresh() func() {
+	atomic.StoreInt64(&c.refreshStarted, time.Now().UnixNano())
+	return func() { atomic.StoreInt64(&c.refreshStarted, 0) }
+}
+
+// RefreshStarted returns when the certificate refresh in progress started, or
+// the zero time if none is. As refreshes run one at a time, a refresh that has
+// been in progress for long is stuck and blocks all others.
+func (c *Client) RefreshStarted() time.Time {
+	n := atomic.LoadInt64(&c.refreshStarted)
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
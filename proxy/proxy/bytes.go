@@ -0,0 +1,116 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// DefaultMaxByteCountedInstances is the number of instances for which a
+	// Client counts bytes separately when MaxByteCountedInstances is not set.
+	DefaultMaxByteCountedInstances = 100
+	// OtherInstances is the key BytesTransferred reports the bytes of
+	// instances over the MaxByteCountedInstances limit under.
+	OtherInstances = "other"
+)
+
+// InstanceBytes is the number of bytes proxied for an instance.
+type InstanceBytes struct {
+	// Read is the number of bytes received from the instance.
+	Read uint64
+	// Written is the number of bytes sent to the instance.
+	Written uint64
+}
+
+// byteCounters holds an InstanceBytes per instance, updated atomically.
+type byteCounters struct {
+	mu sync.Mutex
+	m  map[string]*InstanceBytes
+}
+
+// get returns the counters for instance, creating them if fewer than max
+// instances have counters. Otherwise the counters for OtherInstances are
+// returned.
+func (b *byteCounters) get(instance string, max int) *InstanceBytes {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.m == nil {
+		b.m = make(map[string]*InstanceBytes)
+	}
+	if ib, ok := b.m[instance]; ok {
+		return ib
+	}
+	if len(b.m) >= max {
+		instance = OtherInstances
+		if ib, ok := b.m[instance]; ok {
+			return ib
+		}
+	}
+	ib := &InstanceBytes{}
+	b.m[instance] = ib
+	return ib
+}
+
+func (c *Client) maxByteCountedInstances() int {
+	if c.MaxByteCountedInstances > 0 {
+		return c.MaxByteCountedInstances
+	}
+	return DefaultMaxByteCountedInstances
+}
+
+// BytesTransferred returns the number of bytes proxied for each instance
+// since the Client started. Once MaxByteCountedInstances instances have been
+// counted, the bytes of any other instance are added under OtherInstances.
+func (c *Client) BytesTransferred() map[string]InstanceBytes {
+	c.bytes.mu.Lock()
+	defer c.bytes.mu.Unlock()
+	m := make(map[string]InstanceBytes, len(c.bytes.m))
+	for inst, ib := range c.bytes.m {
+		m[inst] = InstanceBytes{
+			Read:    atomic.LoadUint64(&ib.Read),
+			Written: atomic.LoadUint64(&ib.Written),
+		}
+	}
+	return m
+}
+
+// countingConn counts the bytes read from and written to the connection to
+// an instance, recording them as activity of client.
+type countingConn struct {
+	io.ReadWriteCloser
+	bytes  *InstanceBytes
+	client *Client
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		atomic.AddUint64(&c.bytes.Read, uint64(n))
+		c.client.recordActivity()
+	}
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		atomic.AddUint64(&c.bytes.Written, uint64(n))
+		c.client.recordActivity()
+	}
+	return n, err
+}
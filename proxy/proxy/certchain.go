@@ -0,0 +1,74 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/x509"
+	"time"
+)
+
+// CertVerifier verifies that cert, the ephemeral client certificate of an
+// instance, chains to roots, the instance's CA certificates. It may also check
+// that cert has not been revoked, where CRL or OCSP information is available.
+type CertVerifier func(cert *x509.Certificate, roots *x509.CertPool) error
+
+// verifyCertChain is the CertVerifier used when Client.CertVerifier is nil.
+func verifyCertChain(cert *x509.Certificate, roots *x509.CertPool) error {
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// CertChainErrors verifies the client certificate of each instance with a
+// cached configuration, returning the error for each instance whose
+// certificate is invalid.
+func (c *Client) CertChainErrors() map[string]error {
+	verify := c.CertVerifier
+	if verify == nil {
+		verify = verifyCertChain
+	}
+	c.cacheL.RLock()
+	cfgs := make(map[string]cacheEntry, len(c.cfgCache))
+	for inst, e := range c.cfgCache {
+		if isValid(e) {
+			cfgs[inst] = e
+		}
+	}
+	c.cacheL.RUnlock()
+
+	errs := make(map[string]error)
+	for inst, e := range cfgs {
+		if err := verify(e.cfg.Certificates[0].Leaf, e.cfg.RootCAs); err != nil {
+			errs[inst] = err
+		}
+	}
+	return errs
+}
+
+// CertExpirations returns when the client certificate of each instance with a
+// cached configuration expires.
+func (c *Client) CertExpirations() map[string]time.Time {
+	c.cacheL.RLock()
+	defer c.cacheL.RUnlock()
+	exp := make(map[string]time.Time, len(c.cfgCache))
+	for inst, e := range c.cfgCache {
+		if isValid(e) {
+			exp[inst] = e.cfg.Certificates[0].Leaf.NotAfter
+		}
+	}
+	return exp
+}
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -74,15 +75,90 @@ type CertSource interface {
 	Remote(instance string) (cert *x509.Certificate, addr, name, version string, err error)
 }
 
+// APIUsageReporter is implemented by CertSources that track their recent use
+// of the Cloud SQL Admin API, such as certs.RemoteCertSource.
+type APIUsageReporter interface {
+	// APIUsage returns the number of API calls made in the last minute and
+	// how many of those were rejected for exceeding quota.
+	APIUsage() (calls, rateLimited uint64)
+}
+
+// CredentialsChecker is implemented by CertSources that can check whether the
+// credentials they obtain certificates with are available, such as
+// certs.RemoteCertSource.
+type CredentialsChecker interface {
+	// CheckCredentials returns an error if a valid access token cannot be
+	// obtained before ctx is done.
+	CheckCredentials(ctx context.Context) error
+}
+
 // Client is a type to handle connecting to a Server. All fields are required
 // unless otherwise specified.
 type Client struct {
 	// ConnectionsCounter is used to enforce the optional maxConnections limit
 	ConnectionsCounter uint64
+	// goroutines counts the goroutines started by the client, indexed by
+	// GoroutineCategory. It follows ConnectionsCounter to keep it 64-bit
+	// aligned for atomic access.
+	goroutines [numGoroutineCategories]int64
+	// transports counts the open connections, indexed by Transport.
+	transports [numTransports]int64
+	// lastActivity is when, in Unix nanoseconds, the client last accepted a
+	// connection or proxied bytes.
+	lastActivity int64
+	// refreshStarted is when, in Unix nanoseconds, the certificate refresh
+	// in progress started, or 0 if none is.
+	refreshStarted int64
+	// TotalConnections counts the connections admitted, and
+	// RefusedConnections those rejected for exceeding MaxConnections or
+	// MaxConnectionsPerInstance, since the Client was created. They are
+	// accessed atomically, and follow refreshStarted to keep them 64-bit
+	// aligned.
+	TotalConnections   uint64
+	RefusedConnections uint64
+	// refreshes counts the certificate refreshes attempted, and
+	// refreshFailures those that failed, since the Client was created. They
+	// are accessed atomically, and follow RefusedConnections to keep them
+	// 64-bit aligned.
+	refreshes       uint64
+	refreshFailures uint64
 
 	// MaxConnections is the maximum number of connections to establish
-	// before refusing new connections. 0 means no limit.
+	// before refusing new connections. 0 means no limit. It follows
+	// refreshFailures to keep it 64-bit aligned, as once the Client is in use it
+	// may only be changed with SetMaxConnections and read with
+	// MaxConnectionsLimit.
 	MaxConnections uint64
+	// MaxConnectionsPolicy determines how new connections are handled once
+	// MaxConnections is reached. If not set, it defaults to RejectPolicy.
+	MaxConnectionsPolicy LimitPolicy
+	// MaxConnectionsQueueSize is the number of new connections that may wait
+	// for a slot under QueuePolicy.
+	MaxConnectionsQueueSize int
+	// MaxConnectionsQueueTimeout is how long a new connection waits for a
+	// slot under QueuePolicy. If not set, it defaults to
+	// DefaultMaxConnectionsQueueTimeout.
+	MaxConnectionsQueueTimeout time.Duration
+	// slots tracks the connections waiting for a slot under QueuePolicy.
+	slots connSlots
+	// MaxConnectionsPerInstance is the maximum number of connections to
+	// establish to each instance, keyed by instance connection name, before
+	// refusing new connections to it. Instances without an entry are only
+	// limited by MaxConnections, which also applies to those with one. New
+	// connections over an instance's limit are rejected, or accepted under
+	// DegradePolicy.
+	MaxConnectionsPerInstance map[string]uint64
+	// instanceConns counts the open connections to each instance in
+	// MaxConnectionsPerInstance.
+	instanceConns instanceConns
+	// MaxConnectionsWarnThreshold is the fraction of MaxConnections, such as
+	// 0.8, at which a warning is logged that the limit is approaching, and
+	// below which the recovery is logged. 0 disables the warning, which is
+	// also never logged without MaxConnections.
+	MaxConnectionsWarnThreshold float64
+	// connsWarned is 1 while open connections are at or above the warning
+	// threshold, accessed atomically.
+	connsWarned int32
 
 	// Port designates which remote port should be used when connecting to
 	// instances. This value is defined by the server-side code, but for now it
@@ -100,6 +176,40 @@ type Client struct {
 	// Dialer should return a new connection to the provided address. It will be used only if ContextDialer is nil.
 	Dialer func(net, addr string) (net.Conn, error)
 
+	// ConnEventsSize is the number of recent connection events retained for
+	// ConnEvents. If not set, it defaults to DefaultConnEventsSize.
+	ConnEventsSize int
+	// connEvents holds the recent connection events.
+	connEvents eventRing
+
+	// ShortLivedConnThreshold is the lifetime under which a closed connection
+	// counts towards ChurnRate. If not set, it defaults to
+	// DefaultShortLivedConnThreshold.
+	ShortLivedConnThreshold time.Duration
+	// churn counts recently closed short-lived connections.
+	churn windowCounter
+
+	// SuccessRatioWindow is the period over which SuccessRatio is computed.
+	// If not set, it defaults to DefaultSuccessRatioWindow.
+	SuccessRatioWindow time.Duration
+	// dialSuccesses and dialFailures count the outcomes of recent attempts to
+	// dial an instance for a new connection.
+	dialSuccesses windowCounter
+	dialFailures  windowCounter
+	// dialLatency is the distribution of how long those attempts took.
+	dialLatency latencyHistogram
+
+	// Instances optionally lists the connection names of the instances the
+	// Client is configured to connect to, as reported by InstanceNames.
+	Instances []string
+
+	// MaxByteCountedInstances is the number of instances BytesTransferred
+	// reports separately. If not set, it defaults to
+	// DefaultMaxByteCountedInstances.
+	MaxByteCountedInstances int
+	// bytes counts the bytes proxied for each instance.
+	bytes byteCounters
+
 	// The cfgCache holds the most recent connection configuration keyed by
 	// instance. Relevant functions are refreshCfg and cachedCfg. It is
 	// protected by cacheL.
@@ -123,6 +233,11 @@ type Client struct {
 	// to attempt to refresh it. If not set, it defaults to 5 minutes. When IAM
 	// Login is enabled, this value should be set to IAMLoginRefreshCfgBuffer.
 	RefreshCfgBuffer time.Duration
+
+	// CertVerifier is used by CertChainErrors to verify the client
+	// certificates of instances. If nil, a certificate is only verified to
+	// chain to the instance's CA.
+	CertVerifier CertVerifier
 }
 
 type cacheEntry struct {
@@ -150,26 +265,47 @@ func (c *Client) Run(connSrc <-chan Conn) {
 }
 
 func (c *Client) handleConn(conn Conn) {
-	active := atomic.AddUint64(&c.ConnectionsCounter, 1)
+	defer c.trackGoroutine(ConnHandlerGoroutine)()
 
+	if !c.acquireConn() {
+		logging.Errorf("too many open connections (max %d)", c.MaxConnectionsLimit())
+		atomic.AddUint64(&c.RefusedConnections, 1)
+		c.recordConnEvent(ConnRejected, conn.Instance)
+		conn.Conn.Close()
+		return
+	}
 	// Deferred decrement of ConnectionsCounter upon connection closing
-	defer atomic.AddUint64(&c.ConnectionsCounter, ^uint64(0))
-
-	if c.MaxConnections > 0 && active > c.MaxConnections {
-		logging.Errorf("too many open connections (max %d)", c.MaxConnections)
+	defer c.ReleaseConn()
+	if !c.acquireInstanceConn(conn.Instance) {
+		logging.Errorf("too many open connections to %q (max %d)", conn.Instance, c.MaxConnectionsPerInstance[conn.Instance])
+		atomic.AddUint64(&c.RefusedConnections, 1)
+		c.recordConnEvent(ConnRejected, conn.Instance)
 		conn.Conn.Close()
 		return
 	}
+	defer c.releaseInstanceConn(conn.Instance)
+	defer c.trackTransport(conn.Conn)()
+
+	atomic.AddUint64(&c.TotalConnections, 1)
+	c.recordConnEvent(ConnAccepted, conn.Instance)
+	c.recordActivity()
+	start := time.Now()
+	defer c.recordConnEvent(ConnClosed, conn.Instance)
 
 	server, err := c.Dial(conn.Instance)
+	c.dialLatency.observe(time.Since(start))
+	c.recordDial(err)
 	if err != nil {
 		logging.Errorf("couldn't connect to %q: %v", conn.Instance, err)
 		conn.Conn.Close()
 		return
 	}
+	// Only connections that were established count towards the churn rate.
+	defer func() { c.recordConnLifetime(time.Since(start)) }()
 
 	c.Conns.Add(conn.Instance, conn.Conn)
-	copyThenClose(server, conn.Conn, conn.Instance, "local connection on "+conn.Conn.LocalAddr().String())
+	counted := countingConn{server, c.bytes.get(conn.Instance, c.maxByteCountedInstances()), c}
+	copyThenClose(counted, conn.Conn, conn.Instance, "local connection on "+conn.Conn.LocalAddr().String())
 
 	if err := c.Conns.Remove(conn.Instance, conn.Conn); err != nil {
 		logging.Errorf("%s", err)
@@ -183,6 +319,13 @@ func (c *Client) handleConn(conn Conn) {
 func (c *Client) refreshCfg(instance string) (addr string, cfg *tls.Config, version string, err error) {
 	c.refreshCfgL.Lock()
 	defer c.refreshCfgL.Unlock()
+	defer c.trackRefresh()()
+	atomic.AddUint64(&c.refreshes, 1)
+	defer func() {
+		if err != nil {
+			atomic.AddUint64(&c.refreshFailures, 1)
+		}
+	}()
 	logging.Verbosef("refreshing ephemeral certificate for instance %s", instance)
 
 	mycert, err := c.Certs.Local(instance)
@@ -217,6 +360,7 @@ func (c *Client) refreshCfg(instance string) (addr string, cfg *tls.Config, vers
 
 // refreshCertAfter refreshes the epehemeral certificate of the instance after timeToRefresh.
 func (c *Client) refreshCertAfter(instance string, timeToRefresh time.Duration) {
+	defer c.trackGoroutine(RefreshSchedulerGoroutine)()
 	<-time.After(timeToRefresh)
 	logging.Verbosef("ephemeral certificate for instance %s will expire soon, refreshing now.", instance)
 	if _, _, _, err := c.cachedCfg(context.Background(), instance); err != nil {
@@ -262,6 +406,7 @@ func isExpired(cfg *tls.Config) bool {
 func (c *Client) startRefresh(instance string, refreshCfgBuffer time.Duration) chan struct{} {
 	done := make(chan struct{})
 	go func() {
+		defer c.trackGoroutine(RefreshGoroutine)()
 		defer close(done)
 		addr, cfg, ver, err := c.refreshCfg(instance)
 
@@ -539,28 +684,109 @@ func ParseInstanceConnectionName(instance string) (string, string, string, []str
 	return proj, region, name, args, nil
 }
 
+// InstanceNames returns the connection names of the instances in Instances
+// and of those the Client has connected to, sorted and without duplicates.
+func (c *Client) InstanceNames() []string {
+	seen := make(map[string]bool, len(c.Instances))
+	var names []string
+	add := func(inst string) {
+		if !seen[inst] {
+			seen[inst] = true
+			names = append(names, inst)
+		}
+	}
+	for _, inst := range c.Instances {
+		add(inst)
+	}
+	c.cacheL.RLock()
+	for inst := range c.cfgCache {
+		add(inst)
+	}
+	c.cacheL.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// ConnectionTotals returns the number of connections admitted and refused
+// because of a connection limit since the Client was created.
+func (c *Client) ConnectionTotals() (total, refused uint64) {
+	return atomic.LoadUint64(&c.TotalConnections), atomic.LoadUint64(&c.RefusedConnections)
+}
+
+// RefreshTotals returns the number of certificate refreshes attempted and of
+// those that failed since the Client was created.
+func (c *Client) RefreshTotals() (total, failed uint64) {
+	return atomic.LoadUint64(&c.refreshes), atomic.LoadUint64(&c.refreshFailures)
+}
+
 // AvailableConn returns false if MaxConnections has been reached, true otherwise.
-// When MaxConnections is 0, there is no limit.
+// When MaxConnections is 0, there is no limit. Under QueuePolicy, connections
+// remain available until the queue is also full.
 func (c *Client) AvailableConn() bool {
-	return c.MaxConnections == 0 || atomic.LoadUint64(&c.ConnectionsCounter) < c.MaxConnections
+	if max := c.MaxConnectionsLimit(); max == 0 || atomic.LoadUint64(&c.ConnectionsCounter) < max {
+		return true
+	}
+	return c.MaxConnectionsPolicy == QueuePolicy && !c.slots.full(c.MaxConnectionsQueueSize)
 }
 
-// Shutdown waits up to a given amount of time for all active connections to
-// close. Returns an error if there are still active connections after waiting
-// for the whole length of the timeout.
-func (c *Client) Shutdown(termTimeout time.Duration) error {
-	term, ticker := time.After(termTimeout), time.NewTicker(100*time.Millisecond)
+// APIUsage returns the number of Cloud SQL Admin API calls made by the
+// Client's CertSource in the last minute and how many of those were rejected
+// for exceeding quota. ok is false if the CertSource does not report its API
+// usage.
+func (c *Client) APIUsage() (calls, rateLimited uint64, ok bool) {
+	r, ok := c.Certs.(APIUsageReporter)
+	if !ok {
+		return 0, 0, false
+	}
+	calls, rateLimited = r.APIUsage()
+	return calls, rateLimited, true
+}
+
+// ErrCredentialsCheckUnsupported is returned by CheckCredentials if the
+// Client's CertSource does not implement CredentialsChecker.
+var ErrCredentialsCheckUnsupported = errors.New("certificate source cannot check its credentials")
+
+// CheckCredentials returns an error if the Client's CertSource cannot obtain a
+// valid access token before ctx is done, or ErrCredentialsCheckUnsupported if
+// it cannot check.
+func (c *Client) CheckCredentials(ctx context.Context) error {
+	cc, ok := c.Certs.(CredentialsChecker)
+	if !ok {
+		return ErrCredentialsCheckUnsupported
+	}
+	return cc.CheckCredentials(ctx)
+}
+
+// connectionsPollInterval is how often WaitForConnectionsToClose checks
+// whether the connections have closed.
+const connectionsPollInterval = 100 * time.Millisecond
+
+// WaitForConnectionsToClose blocks until ConnectionsCounter reaches zero or ctx
+// is done. In the latter case, it returns an error wrapping ctx's error, so
+// that callers can force the remaining connections closed.
+func (c *Client) WaitForConnectionsToClose(ctx context.Context) error {
+	ticker := time.NewTicker(connectionsPollInterval)
 	defer ticker.Stop()
 	for {
+		active := atomic.LoadUint64(&c.ConnectionsCounter)
+		if active == 0 {
+			return nil
+		}
 		select {
 		case <-ticker.C:
-			if atomic.LoadUint64(&c.ConnectionsCounter) > 0 {
-				continue
-			}
-		case <-term:
+		case <-ctx.Done():
+			return fmt.Errorf("%d active connections still exist: %w", active, ctx.Err())
 		}
-		break
 	}
+}
+
+// Shutdown waits up to a given amount of time for all active connections to
+// close. Returns an error if there are still active connections after waiting
+// for the whole length of the timeout.
+func (c *Client) Shutdown(termTimeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), termTimeout)
+	defer cancel()
+	c.WaitForConnectionsToClose(ctx)
 
 	active := atomic.LoadUint64(&c.ConnectionsCounter)
 	if active == 0 {
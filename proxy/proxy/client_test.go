@@ -20,13 +20,20 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 	"unsafe"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
 )
 
 const instance = "instance-name"
@@ -174,6 +181,33 @@ func TestConcurrentRefresh(t *testing.T) {
 	b.Unlock()
 }
 
+func TestRefreshStarted(t *testing.T) {
+	b := &fakeCerts{}
+	c := newClient(newCertSource(b, forever))
+	if got := c.RefreshStarted(); !got.IsZero() {
+		t.Errorf("RefreshStarted() = %v before refreshing, want the zero time", got)
+	}
+
+	// Block the refresh in the cert source until it is seen in progress.
+	b.Lock()
+	ch := make(chan error)
+	go func() {
+		_, err := c.Dial(instance)
+		ch <- err
+	}()
+	for c.RefreshStarted().IsZero() {
+		time.Sleep(time.Millisecond)
+	}
+	b.Unlock()
+
+	if err := <-ch; err != sentinelError {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got := c.RefreshStarted(); !got.IsZero() {
+		t.Errorf("RefreshStarted() = %v after refreshing, want the zero time", got)
+	}
+}
+
 func TestMaximumConnectionsCount(t *testing.T) {
 	certSource := &blockingCertSource{
 		values:     map[string]*fakeCerts{},
@@ -296,6 +330,33 @@ func TestSyncAtomicAlignment(t *testing.T) {
 	if a := unsafe.Offsetof(c.ConnectionsCounter); a%64 != 0 {
 		t.Errorf("Client.ConnectionsCounter is not aligned: want %v, got %v", 0, a)
 	}
+	if a := unsafe.Offsetof(c.goroutines); a%8 != 0 {
+		t.Errorf("Client.goroutines is not aligned: want a multiple of 8, got %v", a)
+	}
+	if a := unsafe.Offsetof(c.transports); a%8 != 0 {
+		t.Errorf("Client.transports is not aligned: want a multiple of 8, got %v", a)
+	}
+	if a := unsafe.Offsetof(c.lastActivity); a%8 != 0 {
+		t.Errorf("Client.lastActivity is not aligned: want a multiple of 8, got %v", a)
+	}
+	if a := unsafe.Offsetof(c.refreshStarted); a%8 != 0 {
+		t.Errorf("Client.refreshStarted is not aligned: want a multiple of 8, got %v", a)
+	}
+	if a := unsafe.Offsetof(c.TotalConnections); a%8 != 0 {
+		t.Errorf("Client.TotalConnections is not aligned: want a multiple of 8, got %v", a)
+	}
+	if a := unsafe.Offsetof(c.RefusedConnections); a%8 != 0 {
+		t.Errorf("Client.RefusedConnections is not aligned: want a multiple of 8, got %v", a)
+	}
+	if a := unsafe.Offsetof(c.refreshes); a%8 != 0 {
+		t.Errorf("Client.refreshes is not aligned: want a multiple of 8, got %v", a)
+	}
+	if a := unsafe.Offsetof(c.refreshFailures); a%8 != 0 {
+		t.Errorf("Client.refreshFailures is not aligned: want a multiple of 8, got %v", a)
+	}
+	if a := unsafe.Offsetof(c.MaxConnections); a%8 != 0 {
+		t.Errorf("Client.MaxConnections is not aligned: want a multiple of 8, got %v", a)
+	}
 }
 
 type invalidRemoteCertSource struct{}
@@ -318,6 +379,35 @@ func TestRemoteCertError(t *testing.T) {
 
 }
 
+func TestRefreshTotals(t *testing.T) {
+	b := &fakeCerts{}
+	c := newClient(newCertSource(b, forever))
+	if _, err := c.Dial(instance); err != sentinelError {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := c.Dial("unknown:region:instance"); err == nil {
+		t.Error("Dial of an unknown instance succeeded")
+	}
+	if total, failed := c.RefreshTotals(); total != 2 || failed != 1 {
+		t.Errorf("RefreshTotals() = %d, %d, want 2, 1", total, failed)
+	}
+}
+
+func TestDialLatencies(t *testing.T) {
+	c := &Client{}
+	for _, d := range []time.Duration{time.Millisecond, 20 * time.Millisecond, 3 * time.Second, time.Minute} {
+		c.dialLatency.observe(d)
+	}
+	got := c.DialLatencies()
+	if got.Count != 4 || got.Sum < 63 || got.Sum > 63.03 {
+		t.Errorf("DialLatencies() count %d and sum %v, want 4 and 63.021", got.Count, got.Sum)
+	}
+	want := []uint64{1, 1, 2, 2, 2, 2, 2, 2, 2, 3, 3}
+	if !reflect.DeepEqual(got.Buckets, want) {
+		t.Errorf("DialLatencies() buckets %v, want %v", got.Buckets, want)
+	}
+}
+
 func TestParseInstanceConnectionName(t *testing.T) {
 	// SplitName has its own tests and is not specifically tested here.
 	table := []struct {
@@ -341,3 +431,529 @@ func TestParseInstanceConnectionName(t *testing.T) {
 		}
 	}
 }
+
+func TestConnEventsEvictOldest(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	c.ConnEventsSize = 3
+	c.MaxConnections = 1
+	c.ConnectionsCounter = 1 // Reject every connection without dialing.
+
+	for i := 0; i < 5; i++ {
+		c.handleConn(Conn{Instance: fmt.Sprintf("%s-%d", instance, i), Conn: &dummyConn{}})
+	}
+
+	events := c.ConnEvents()
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want 3", len(events))
+	}
+	for i, e := range events {
+		want := fmt.Sprintf("%s-%d", instance, i+2)
+		if e.Instance != want || e.Type != ConnRejected {
+			t.Errorf("events[%d] = %v %q, want %v %q", i, e.Type, e.Instance, ConnRejected, want)
+		}
+	}
+}
+
+func TestConnectionTotals(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	c.MaxConnections = 1
+
+	// Dials fail immediately, so each connection is closed once admitted.
+	for i := 0; i < 3; i++ {
+		c.handleConn(Conn{Instance: instance, Conn: &dummyConn{}})
+	}
+	c.ConnectionsCounter = 1 // Reject every connection without dialing.
+	for i := 0; i < 2; i++ {
+		c.handleConn(Conn{Instance: instance, Conn: &dummyConn{}})
+	}
+
+	if total, refused := c.ConnectionTotals(); total != 3 || refused != 2 {
+		t.Errorf("ConnectionTotals() = %d, %d, want 3, 2", total, refused)
+	}
+}
+
+func TestInstanceNames(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	c.Instances = []string{"proj:region:b", "proj:region:a"}
+	c.cfgCache = map[string]cacheEntry{"proj:region:c": {}, "proj:region:a": {}}
+
+	want := []string{"proj:region:a", "proj:region:b", "proj:region:c"}
+	if got := c.InstanceNames(); !reflect.DeepEqual(got, want) {
+		t.Errorf("InstanceNames() = %v, want %v", got, want)
+	}
+}
+
+func TestChurnRate(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	c.ShortLivedConnThreshold = time.Hour
+
+	// Dials fail immediately, so no connection is established to count.
+	for i := 0; i < 6; i++ {
+		c.handleConn(Conn{Instance: instance, Conn: &dummyConn{}})
+	}
+	if got := c.ChurnRate(); got != 0 {
+		t.Errorf("ChurnRate() = %v after failed dials, want 0", got)
+	}
+
+	for i := 0; i < 6; i++ {
+		c.recordConnLifetime(time.Millisecond)
+	}
+	if got, want := c.ChurnRate(), 6/churnWindow.Seconds(); got != want {
+		t.Errorf("ChurnRate() = %v, want %v", got, want)
+	}
+}
+
+func TestSuccessRatio(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+
+	if ratio, attempts := c.SuccessRatio(); ratio != 1 || attempts != 0 {
+		t.Errorf("SuccessRatio() = %v, %v before any attempts, want 1, 0", ratio, attempts)
+	}
+
+	c.recordDial(nil)
+	c.recordDial(nil)
+	c.recordDial(nil)
+	c.recordDial(sentinelError)
+	if ratio, attempts := c.SuccessRatio(); ratio != 0.75 || attempts != 4 {
+		t.Errorf("SuccessRatio() = %v, %v, want 0.75, 4", ratio, attempts)
+	}
+}
+
+func TestGoroutines(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+
+	const n = 3
+	var started, done sync.WaitGroup
+	release := make(chan struct{})
+	started.Add(n)
+	done.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer done.Done()
+			defer c.trackGoroutine(ConnHandlerGoroutine)()
+			started.Done()
+			<-release
+		}()
+	}
+	started.Wait()
+
+	got := c.Goroutines()
+	if got[ConnHandlerGoroutine] != n {
+		t.Errorf("Goroutines()[%v] = %d, want %d", ConnHandlerGoroutine, got[ConnHandlerGoroutine], n)
+	}
+	if got[RefreshGoroutine] != 0 {
+		t.Errorf("Goroutines()[%v] = %d, want 0", RefreshGoroutine, got[RefreshGoroutine])
+	}
+
+	close(release)
+	done.Wait()
+	if got := c.Goroutines()[ConnHandlerGoroutine]; got != 0 {
+		t.Errorf("Goroutines()[%v] = %d after handlers returned, want 0", ConnHandlerGoroutine, got)
+	}
+}
+
+func TestBytesTransferred(t *testing.T) {
+	c := &Client{MaxByteCountedInstances: 2}
+	if got := c.LastActivity(); !got.IsZero() {
+		t.Errorf("LastActivity() = %v before proxying, want the zero time", got)
+	}
+	appLocal, appRemote := net.Pipe()
+	instLocal, instRemote := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		copyThenClose(countingConn{instLocal, c.bytes.get("inst", c.maxByteCountedInstances()), c}, appLocal, "inst", "app")
+		close(done)
+	}()
+
+	// Send 10 bytes to the instance and receive 25 back.
+	go appRemote.Write(make([]byte, 10))
+	if _, err := io.ReadFull(instRemote, make([]byte, 10)); err != nil {
+		t.Fatalf("Reading at the instance failed: %v", err)
+	}
+	go instRemote.Write(make([]byte, 25))
+	if _, err := io.ReadFull(appRemote, make([]byte, 25)); err != nil {
+		t.Fatalf("Reading at the app failed: %v", err)
+	}
+	appRemote.Close()
+	<-done
+
+	want := InstanceBytes{Read: 25, Written: 10}
+	if got := c.BytesTransferred()["inst"]; got != want {
+		t.Errorf("BytesTransferred()[%q] = %+v, want %+v", "inst", got, want)
+	}
+	if c.LastActivity().IsZero() {
+		t.Error("LastActivity() is zero after proxying bytes, want when they were proxied")
+	}
+
+	c.bytes.get("inst2", c.maxByteCountedInstances())
+	c.bytes.get("inst3", c.maxByteCountedInstances())
+	got := c.BytesTransferred()
+	if _, ok := got["inst3"]; ok || len(got) != 3 {
+		t.Errorf("BytesTransferred() = %v, want inst3 counted under %q", got, OtherInstances)
+	}
+	if _, ok := got[OtherInstances]; !ok {
+		t.Errorf("BytesTransferred() = %v, want an entry for %q", got, OtherInstances)
+	}
+}
+
+// acceptOne returns both ends of a new connection on l.
+func acceptOne(t *testing.T, l net.Listener) (local, remote net.Conn) {
+	t.Helper()
+	remote, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dialing %v failed: %v", l.Addr(), err)
+	}
+	local, err = l.Accept()
+	if err != nil {
+		t.Fatalf("Accepting on %v failed: %v", l.Addr(), err)
+	}
+	return local, remote
+}
+
+func TestConnectionsByTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	unix, err := net.Listen("unix", filepath.Join(dir, "proxy.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+
+	c := &Client{}
+	var release []func()
+	for _, l := range []net.Listener{tcp, unix, unix} {
+		local, remote := acceptOne(t, l)
+		defer local.Close()
+		defer remote.Close()
+		release = append(release, c.trackTransport(local))
+	}
+
+	want := map[Transport]int64{TCPTransport: 1, UnixTransport: 2}
+	if got := c.ConnectionsByTransport(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ConnectionsByTransport() = %v, want %v", got, want)
+	}
+	for _, r := range release {
+		r()
+	}
+	want = map[Transport]int64{TCPTransport: 0, UnixTransport: 0}
+	if got := c.ConnectionsByTransport(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ConnectionsByTransport() = %v after closing, want %v", got, want)
+	}
+}
+
+func TestRejectPolicy(t *testing.T) {
+	c := &Client{MaxConnections: 1}
+	if !c.acquireConn() {
+		t.Fatal("acquireConn() = false under the limit, want true")
+	}
+	if c.acquireConn() {
+		t.Error("acquireConn() = true at the limit, want false")
+	}
+	if c.AvailableConn() {
+		t.Error("AvailableConn() = true at the limit, want false")
+	}
+	c.ReleaseConn()
+	if !c.AvailableConn() {
+		t.Error("AvailableConn() = false after releasing, want true")
+	}
+}
+
+func TestTryReserveConnConcurrent(t *testing.T) {
+	const max, workers = 5, 50
+	c := &Client{MaxConnections: max}
+	var (
+		wg       sync.WaitGroup
+		reserved uint64
+		peak     uint64
+	)
+	start := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for j := 0; j < 100; j++ {
+				if !c.TryReserveConn() {
+					continue
+				}
+				n := atomic.AddUint64(&reserved, 1)
+				for {
+					p := atomic.LoadUint64(&peak)
+					if n <= p || atomic.CompareAndSwapUint64(&peak, p, n) {
+						break
+					}
+				}
+				if got := atomic.LoadUint64(&c.ConnectionsCounter); got > max {
+					t.Errorf("ConnectionsCounter = %d, want at most %d", got, max)
+				}
+				atomic.AddUint64(&reserved, ^uint64(0))
+				c.ReleaseConn()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if peak > max {
+		t.Errorf("%d connections reserved at once, want at most %d", peak, max)
+	}
+	if got := atomic.LoadUint64(&c.ConnectionsCounter); got != 0 {
+		t.Errorf("ConnectionsCounter = %d after releasing, want 0", got)
+	}
+
+	for i := 0; i < max; i++ {
+		if !c.TryReserveConn() {
+			t.Fatalf("TryReserveConn() #%d = false under the limit, want true", i)
+		}
+	}
+	if c.TryReserveConn() {
+		t.Error("TryReserveConn() = true at the limit, want false")
+	}
+	if c.AvailableConn() {
+		t.Error("AvailableConn() = true when TryReserveConn fails, want false")
+	}
+}
+
+func TestSetMaxConnections(t *testing.T) {
+	c := &Client{MaxConnections: 3}
+	for i := 0; i < 3; i++ {
+		if !c.TryReserveConn() {
+			t.Fatalf("TryReserveConn() #%d = false under the limit, want true", i)
+		}
+	}
+
+	c.SetMaxConnections(1)
+	if c.AvailableConn() || c.TryReserveConn() {
+		t.Error("Connection available over a lowered limit, want none")
+	}
+	c.ReleaseConn()
+	c.ReleaseConn()
+	if c.AvailableConn() {
+		t.Error("AvailableConn() = true at a lowered limit, want false")
+	}
+	c.ReleaseConn()
+	if !c.AvailableConn() {
+		t.Error("AvailableConn() = false under a lowered limit, want true")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := uint64(1); n <= 100; n++ {
+			c.SetMaxConnections(n)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if c.TryReserveConn() {
+			c.ReleaseConn()
+		}
+	}
+	wg.Wait()
+	if got := c.MaxConnectionsLimit(); got != 100 {
+		t.Errorf("MaxConnectionsLimit() = %d, want 100", got)
+	}
+}
+
+func TestMaxConnectionsWarnThreshold(t *testing.T) {
+	var logs []string
+	errorf, infof := logging.Errorf, logging.Infof
+	defer func() { logging.Errorf, logging.Infof = errorf, infof }()
+	logging.Errorf = func(format string, args ...interface{}) {
+		logs = append(logs, "warn")
+	}
+	logging.Infof = func(format string, args ...interface{}) {
+		logs = append(logs, "recover")
+	}
+
+	c := &Client{MaxConnections: 10, MaxConnectionsWarnThreshold: 0.8}
+	for i := 0; i < 7; i++ {
+		c.acquireConn()
+	}
+	if len(logs) != 0 {
+		t.Fatalf("Got logs %q below the threshold, want none", logs)
+	}
+	c.acquireConn()
+	c.acquireConn()
+	c.ReleaseConn()
+	if want := []string{"warn"}; !reflect.DeepEqual(logs, want) {
+		t.Fatalf("Got logs %q at the threshold, want %q", logs, want)
+	}
+	c.ReleaseConn()
+	c.ReleaseConn()
+	if want := []string{"warn", "recover"}; !reflect.DeepEqual(logs, want) {
+		t.Fatalf("Got logs %q after dropping below the threshold, want %q", logs, want)
+	}
+	c.acquireConn()
+	c.acquireConn()
+	if want := []string{"warn", "recover", "warn"}; !reflect.DeepEqual(logs, want) {
+		t.Errorf("Got logs %q after crossing the threshold again, want %q", logs, want)
+	}
+
+	logs = nil
+	unlimited := &Client{MaxConnectionsWarnThreshold: 0.8}
+	for i := 0; i < 10; i++ {
+		unlimited.acquireConn()
+	}
+	if len(logs) != 0 {
+		t.Errorf("Got logs %q without MaxConnections, want none", logs)
+	}
+}
+
+func TestQueuePolicy(t *testing.T) {
+	c := &Client{
+		MaxConnections:             1,
+		MaxConnectionsPolicy:       QueuePolicy,
+		MaxConnectionsQueueSize:    1,
+		MaxConnectionsQueueTimeout: time.Minute,
+	}
+	if !c.acquireConn() {
+		t.Fatal("acquireConn() = false under the limit, want true")
+	}
+	if !c.AvailableConn() {
+		t.Error("AvailableConn() = false with an empty queue, want true")
+	}
+
+	queued := make(chan bool)
+	go func() { queued <- c.acquireConn() }()
+	for c.AvailableConn() {
+		time.Sleep(time.Millisecond)
+	}
+	if c.acquireConn() {
+		t.Error("acquireConn() = true with a full queue, want false")
+	}
+
+	c.ReleaseConn()
+	select {
+	case ok := <-queued:
+		if !ok {
+			t.Error("queued acquireConn() = false after a slot was released, want true")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued acquireConn() did not return after a slot was released")
+	}
+
+	c.MaxConnectionsQueueTimeout = 10 * time.Millisecond
+	if c.acquireConn() {
+		t.Error("acquireConn() = true after the queue timeout, want false")
+	}
+}
+
+func TestDegradePolicy(t *testing.T) {
+	c := &Client{MaxConnections: 1, MaxConnectionsPolicy: DegradePolicy}
+	for i := 0; i < 2; i++ {
+		if !c.acquireConn() {
+			t.Fatalf("acquireConn() #%d = false, want true", i)
+		}
+	}
+	if got := atomic.LoadUint64(&c.ConnectionsCounter); got != 2 {
+		t.Errorf("ConnectionsCounter = %d, want 2", got)
+	}
+	if c.AvailableConn() {
+		t.Error("AvailableConn() = true over the limit, want false")
+	}
+}
+
+func TestCertChainErrors(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	if _, err := c.Dial(instance); err != sentinelError {
+		t.Fatalf("Dial(%q) = %v, want %v", instance, err, sentinelError)
+	}
+
+	var verified int
+	c.CertVerifier = func(cert *x509.Certificate, roots *x509.CertPool) error {
+		verified++
+		if cert == nil || roots == nil {
+			t.Errorf("CertVerifier called with cert %v and roots %v, want both set", cert, roots)
+		}
+		return sentinelError
+	}
+	got := c.CertChainErrors()
+	if verified != 1 || len(got) != 1 || got[instance] != sentinelError {
+		t.Errorf("CertChainErrors() = %v after %d verifications, want %v for %q after 1", got, verified, sentinelError, instance)
+	}
+
+	c.CertVerifier = func(*x509.Certificate, *x509.CertPool) error { return nil }
+	if got := c.CertChainErrors(); len(got) != 0 {
+		t.Errorf("CertChainErrors() = %v, want none", got)
+	}
+}
+
+func TestMaxConnectionsPerInstance(t *testing.T) {
+	c := &Client{
+		MaxConnections:            2,
+		MaxConnectionsPerInstance: map[string]uint64{"limited": 1},
+	}
+	if !c.acquireInstanceConn("limited") {
+		t.Fatal("acquireInstanceConn(limited) = false under its limit, want true")
+	}
+	if c.acquireInstanceConn("limited") {
+		t.Error("acquireInstanceConn(limited) = true at its limit, want false")
+	}
+	if c.AvailableConnFor("limited") {
+		t.Error("AvailableConnFor(limited) = true at its limit, want false")
+	}
+	if !c.AvailableConnFor("other") {
+		t.Error("AvailableConnFor(other) = false without a limit of its own, want true")
+	}
+	if !c.acquireInstanceConn("other") {
+		t.Error("acquireInstanceConn(other) = false without a limit of its own, want true")
+	}
+
+	// MaxConnections still applies to every instance.
+	atomic.StoreUint64(&c.ConnectionsCounter, 2)
+	if c.AvailableConnFor("other") {
+		t.Error("AvailableConnFor(other) = true at MaxConnections, want false")
+	}
+	atomic.StoreUint64(&c.ConnectionsCounter, 0)
+
+	c.releaseInstanceConn("limited")
+	if !c.AvailableConnFor("limited") {
+		t.Error("AvailableConnFor(limited) = false after releasing, want true")
+	}
+}
+
+func TestWaitForConnectionsToClose(t *testing.T) {
+	c := &Client{}
+	atomic.StoreUint64(&c.ConnectionsCounter, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.WaitForConnectionsToClose(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitForConnectionsToClose() with an open connection = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- c.WaitForConnectionsToClose(context.Background()) }()
+	c.ReleaseConn()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("WaitForConnectionsToClose() after the connection closed = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForConnectionsToClose() did not return after the connection closed")
+	}
+}
+
+func TestCertExpirations(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	if got := c.CertExpirations(); len(got) != 0 {
+		t.Errorf("CertExpirations() = %v before any dial, want none", got)
+	}
+	if _, err := c.Dial(instance); err != sentinelError {
+		t.Fatalf("Dial(%q) = %v, want %v", instance, err, sentinelError)
+	}
+	got := c.CertExpirations()
+	if len(got) != 1 || !got[instance].Equal(forever) {
+		t.Errorf("CertExpirations() = %v, want %v for %q", got, forever, instance)
+	}
+}
@@ -30,6 +30,10 @@ func (c dummyConn) Close() error {
 	return nil
 }
 
+func (c dummyConn) LocalAddr() net.Addr {
+	return nil
+}
+
 func TestConnSetAdd(t *testing.T) {
 	s := NewConnSet()
 
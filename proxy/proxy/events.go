@@ -0,0 +1,95 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultConnEventsSize is the number of connection events retained by a
+// Client when ConnEventsSize is not set.
+const DefaultConnEventsSize = 100
+
+// ConnEventType describes a change in a connection's lifecycle.
+type ConnEventType string
+
+const (
+	// ConnAccepted is recorded when a new connection is admitted.
+	ConnAccepted ConnEventType = "accepted"
+	// ConnClosed is recorded when an admitted connection is closed.
+	ConnClosed ConnEventType = "closed"
+	// ConnRejected is recorded when a new connection is refused because the
+	// MaxConnections limit has been reached.
+	ConnRejected ConnEventType = "rejected"
+)
+
+// ConnEvent is a single entry in a Client's connection event history.
+type ConnEvent struct {
+	Type     ConnEventType `json:"type"`
+	Instance string        `json:"instance"`
+	Time     time.Time     `json:"time"`
+}
+
+// eventRing is a fixed size buffer of ConnEvents. Once full, recording a new
+// event overwrites the oldest one.
+type eventRing struct {
+	mu     sync.Mutex
+	events []ConnEvent
+	// next is the index the next event will be written to.
+	next int
+	full bool
+}
+
+func (r *eventRing) add(size int, e ConnEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.events == nil {
+		r.events = make([]ConnEvent, size)
+	}
+	r.events[r.next] = e
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns the recorded events, oldest first.
+func (r *eventRing) list() []ConnEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]ConnEvent{}, r.events[:r.next]...)
+	}
+	ret := make([]ConnEvent, 0, len(r.events))
+	ret = append(ret, r.events[r.next:]...)
+	return append(ret, r.events[:r.next]...)
+}
+
+// recordConnEvent adds an event of type t for instance to the Client's
+// connection event history.
+func (c *Client) recordConnEvent(t ConnEventType, instance string) {
+	size := c.ConnEventsSize
+	if size <= 0 {
+		size = DefaultConnEventsSize
+	}
+	c.connEvents.add(size, ConnEvent{Type: t, Instance: instance, Time: time.Now()})
+}
+
+// ConnEvents returns the most recent connection events, oldest first. At most
+// ConnEventsSize events are retained.
+func (c *Client) ConnEvents() []ConnEvent {
+	return c.connEvents.list()
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import "sync/atomic"
+
+// GoroutineCategory identifies the kind of work a goroutine started by a
+// Client is doing.
+type GoroutineCategory int
+
+const (
+	// ConnHandlerGoroutine handles a single proxied connection.
+	ConnHandlerGoroutine GoroutineCategory = iota
+	// RefreshGoroutine refreshes an instance's ephemeral certificate.
+	RefreshGoroutine
+	// RefreshSchedulerGoroutine waits to refresh an instance's ephemeral
+	// certificate before it expires.
+	RefreshSchedulerGoroutine
+
+	numGoroutineCategories
+)
+
+func (g GoroutineCategory) String() string {
+	switch g {
+	case ConnHandlerGoroutine:
+		return "conn_handler"
+	case RefreshGoroutine:
+		return "refresh"
+	case RefreshSchedulerGoroutine:
+		return "refresh_scheduler"
+	}
+	return "unknown"
+}
+
+// trackGoroutine counts the calling goroutine towards category until the
+// returned func is called, typically as
+//
+//	defer c.trackGoroutine(category)()
+func (c *Client) trackGoroutine(category GoroutineCategory) func() {
+	atomic.AddInt64(&c.goroutines[category], 1)
+	return func() {
+		atomic.AddInt64(&c.goroutines[category], -1)
+	}
+}
+
+// Goroutines returns the number of goroutines the Client is currently running
+// in each category.
+func (c *Client) Goroutines() map[GoroutineCategory]int64 {
+	m := make(map[GoroutineCategory]int64, numGoroutineCategories)
+	for g := GoroutineCategory(0); g < numGoroutineCategories; g++ {
+		m[g] = atomic.LoadInt64(&c.goroutines[g])
+	}
+	return m
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DialLatencyBuckets are the upper bounds, in seconds, of the buckets
+// DialLatencies counts dials in.
+var DialLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// LatencyHistogram describes the distribution of a latency.
+type LatencyHistogram struct {
+	// Buckets[i] is the number of observations of at most
+	// DialLatencyBuckets[i] seconds.
+	Buckets []uint64
+	// Count is the number of observations, and Sum their total in seconds.
+	Count uint64
+	Sum   float64
+}
+
+// latencyHistogram counts latencies in the buckets of DialLatencyBuckets.
+type latencyHistogram struct {
+	mu sync.Mutex
+	// counts[i] is the number of observations in the bucket bounded by
+	// DialLatencyBuckets[i], and the last element those above every bound.
+	counts []uint64
+	sum    float64
+}
+
+// observe counts a latency of d.
+func (h *latencyHistogram) observe(d time.Duration) {
+	secs := d.Seconds()
+	i := sort.SearchFloat64s(DialLatencyBuckets, secs)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(DialLatencyBuckets)+1)
+	}
+	h.counts[i]++
+	h.sum += secs
+}
+
+// snapshot returns the cumulative distribution of the observed latencies.
+func (h *latencyHistogram) snapshot() LatencyHistogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res := LatencyHistogram{Buckets: make([]uint64, len(DialLatencyBuckets)), Sum: h.sum}
+	for i, n := range h.counts {
+		res.Count += n
+		if i < len(res.Buckets) {
+			res.Buckets[i] = res.Count
+		}
+	}
+	return res
+}
+
+// DialLatencies returns the distribution of how long dialing an instance for
+// a new connection took, including refreshing its certificate if needed,
+// since the Client was created.
+func (c *Client) DialLatencies() LatencyHistogram {
+	return c.dialLatency.snapshot()
+}
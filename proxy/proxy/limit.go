@@ -0,0 +1,268 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// DefaultMaxConnectionsQueueTimeout is how long a connection waits for a
+// slot under QueuePolicy when MaxConnectionsQueueTimeout is not set.
+const DefaultMaxConnectionsQueueTimeout = 10 * time.Second
+
+// LimitPolicy determines how a Client handles new connections once
+// MaxConnections connections are open.
+type LimitPolicy string
+
+const (
+	// RejectPolicy closes new connections while at the limit.
+	RejectPolicy LimitPolicy = "reject"
+	// QueuePolicy holds new connections until a slot frees up, rejecting
+	// them if the queue is full or they wait longer than the queue timeout.
+	QueuePolicy LimitPolicy = "queue"
+	// DegradePolicy accepts new connections over the limit, but reports no
+	// available connections so that the proxy is not ready.
+	DegradePolicy LimitPolicy = "degrade"
+)
+
+// connSlots tracks connections waiting for a slot under QueuePolicy.
+type connSlots struct {
+	mu sync.Mutex
+	// queued is the number of connections waiting for a slot.
+	queued int
+	// released is closed, and replaced, whenever a connection is released.
+	released chan struct{}
+}
+
+// wait registers the caller as waiting for a slot and returns a channel
+// closed when a connection is next released. It returns false if size
+// connections are already waiting.
+func (s *connSlots) wait(size int) (<-chan struct{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queued >= size {
+		return nil, false
+	}
+	s.queued++
+	if s.released == nil {
+		s.released = make(chan struct{})
+	}
+	return s.released, true
+}
+
+// done undoes a successful call to wait.
+func (s *connSlots) done() {
+	s.mu.Lock()
+	s.queued--
+	s.mu.Unlock()
+}
+
+// release wakes up the connections waiting for a slot.
+func (s *connSlots) release() {
+	s.mu.Lock()
+	if s.released != nil {
+		close(s.released)
+		s.released = nil
+	}
+	s.mu.Unlock()
+}
+
+// full reports whether size connections are waiting for a slot.
+func (s *connSlots) full(size int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queued >= size
+}
+
+func (c *Client) queueTimeout() time.Duration {
+	if c.MaxConnectionsQueueTimeout > 0 {
+		return c.MaxConnectionsQueueTimeout
+	}
+	return DefaultMaxConnectionsQueueTimeout
+}
+
+// MaxConnectionsLimit returns MaxConnections, which may be changed by
+// SetMaxConnections while the Client is in use.
+func (c *Client) MaxConnectionsLimit() uint64 {
+	return atomic.LoadUint64(&c.MaxConnections)
+}
+
+// SetMaxConnections changes MaxConnections to n, which may be 0 for no limit,
+// while the Client is in use. Connections already open over a lowered limit
+// are not closed, but no more are admitted, nor is a connection available,
+// until enough of them close.
+func (c *Client) SetMaxConnections(n uint64) {
+	atomic.StoreUint64(&c.MaxConnections, n)
+	// Connections waiting for a slot may fit under a raised limit.
+	c.slots.release()
+	c.checkConnsWarnThreshold()
+}
+
+// TryReserveConn atomically increments ConnectionsCounter if it is below
+// MaxConnections, or if there is no limit, and reports whether it did. This is
+// the check AvailableConn reports on, so connections reserved concurrently
+// never exceed MaxConnections. Each successful call must be matched by a call
+// to ReleaseConn.
+func (c *Client) TryReserveConn() bool {
+	for {
+		max := c.MaxConnectionsLimit()
+		if max == 0 {
+			atomic.AddUint64(&c.ConnectionsCounter, 1)
+			return true
+		}
+		n := atomic.LoadUint64(&c.ConnectionsCounter)
+		if n >= max {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&c.ConnectionsCounter, n, n+1) {
+			return true
+		}
+	}
+}
+
+// acquireConn counts a new connection towards MaxConnections according to
+// MaxConnectionsPolicy. If it returns false, the connection must be rejected;
+// otherwise ReleaseConn must be called once it is closed.
+func (c *Client) acquireConn() bool {
+	if !c.reserveConn() {
+		return false
+	}
+	c.checkConnsWarnThreshold()
+	return true
+}
+
+// reserveConn implements acquireConn.
+func (c *Client) reserveConn() bool {
+	if c.MaxConnectionsLimit() == 0 || c.MaxConnectionsPolicy == DegradePolicy {
+		atomic.AddUint64(&c.ConnectionsCounter, 1)
+		return true
+	}
+	if c.TryReserveConn() {
+		return true
+	}
+	if c.MaxConnectionsPolicy != QueuePolicy {
+		return false
+	}
+
+	timeout := time.NewTimer(c.queueTimeout())
+	defer timeout.Stop()
+	for {
+		released, ok := c.slots.wait(c.MaxConnectionsQueueSize)
+		if !ok {
+			return false
+		}
+		// A slot may have been released before we started waiting.
+		if c.TryReserveConn() {
+			c.slots.done()
+			return true
+		}
+		select {
+		case <-released:
+			c.slots.done()
+			if c.TryReserveConn() {
+				return true
+			}
+		case <-timeout.C:
+			c.slots.done()
+			return false
+		}
+	}
+}
+
+// ReleaseConn undoes a successful call to TryReserveConn or acquireConn,
+// waking up a connection waiting for a slot under QueuePolicy.
+func (c *Client) ReleaseConn() {
+	atomic.AddUint64(&c.ConnectionsCounter, ^uint64(0))
+	c.slots.release()
+	c.checkConnsWarnThreshold()
+}
+
+// checkConnsWarnThreshold logs a warning when the open connections reach
+// MaxConnectionsWarnThreshold of MaxConnections, and that they recovered when
+// they drop back below it. Each is logged once per crossing.
+func (c *Client) checkConnsWarnThreshold() {
+	max := c.MaxConnectionsLimit()
+	if max == 0 || c.MaxConnectionsWarnThreshold <= 0 {
+		return
+	}
+	open := atomic.LoadUint64(&c.ConnectionsCounter)
+	pct := c.MaxConnectionsWarnThreshold * 100
+	if float64(open) >= c.MaxConnectionsWarnThreshold*float64(max) {
+		if atomic.CompareAndSwapInt32(&c.connsWarned, 0, 1) {
+			logging.Errorf("Warning: %d open connections have reached %.0f%% of the maximum connections limit (%d)", open, pct, max)
+		}
+	} else if atomic.CompareAndSwapInt32(&c.connsWarned, 1, 0) {
+		logging.Infof("Open connections (%d) are back below %.0f%% of the maximum connections limit (%d)", open, pct, max)
+	}
+}
+
+// instanceConns counts the open connections to each instance with a limit in
+// MaxConnectionsPerInstance.
+type instanceConns struct {
+	mu sync.Mutex
+	n  map[string]uint64
+}
+
+// acquireInstanceConn counts a new connection to instance towards its limit
+// in MaxConnectionsPerInstance, if it has one. If it returns false, the
+// connection must be rejected; otherwise releaseInstanceConn must be called
+// once it is closed.
+func (c *Client) acquireInstanceConn(instance string) bool {
+	max, ok := c.MaxConnectionsPerInstance[instance]
+	if !ok {
+		return true
+	}
+	c.instanceConns.mu.Lock()
+	defer c.instanceConns.mu.Unlock()
+	if c.instanceConns.n[instance] >= max && c.MaxConnectionsPolicy != DegradePolicy {
+		return false
+	}
+	if c.instanceConns.n == nil {
+		c.instanceConns.n = make(map[string]uint64)
+	}
+	c.instanceConns.n[instance]++
+	return true
+}
+
+// releaseInstanceConn undoes a successful call to acquireInstanceConn.
+func (c *Client) releaseInstanceConn(instance string) {
+	if _, ok := c.MaxConnectionsPerInstance[instance]; !ok {
+		return
+	}
+	c.instanceConns.mu.Lock()
+	defer c.instanceConns.mu.Unlock()
+	if c.instanceConns.n[instance]--; c.instanceConns.n[instance] == 0 {
+		delete(c.instanceConns.n, instance)
+	}
+}
+
+// AvailableConnFor returns false if instance has reached its limit in
+// MaxConnectionsPerInstance, or if AvailableConn returns false, and true
+// otherwise.
+func (c *Client) AvailableConnFor(instance string) bool {
+	if max, ok := c.MaxConnectionsPerInstance[instance]; ok {
+		c.instanceConns.mu.Lock()
+		n := c.instanceConns.n[instance]
+		c.instanceConns.mu.Unlock()
+		if n >= max {
+			return false
+		}
+	}
+	return c.AvailableConn()
+}
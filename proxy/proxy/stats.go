@@ -0,0 +1,132 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultShortLivedConnThreshold is the lifetime under which a closed
+	// connection counts towards the churn rate when ShortLivedConnThreshold is
+	// not set.
+	DefaultShortLivedConnThreshold = time.Second
+	// DefaultSuccessRatioWindow is the period over which SuccessRatio is
+	// computed when SuccessRatioWindow is not set.
+	DefaultSuccessRatioWindow = 5 * time.Minute
+	// churnWindow is the period the churn rate is averaged over.
+	churnWindow = time.Minute
+	// windowBuckets is the number of buckets a windowCounter divides its
+	// window into.
+	windowBuckets = 60
+)
+
+// windowCounter counts events over a sliding window of time, using
+// windowBuckets buckets that each cover an equal part of the window.
+type windowCounter struct {
+	mu sync.Mutex
+	// counts[i] holds the number of events in the bucket numbered ids[i].
+	// Buckets are numbered by the number of bucket widths since the epoch.
+	counts [windowBuckets]uint64
+	ids    [windowBuckets]int64
+}
+
+// bucketWidth returns the length of time covered by each bucket of a window.
+func bucketWidth(window time.Duration) int64 {
+	if w := int64(window / windowBuckets); w > 0 {
+		return w
+	}
+	return 1
+}
+
+// add counts an event at now in a window of the given length.
+func (wc *windowCounter) add(now time.Time, window time.Duration) {
+	id := now.UnixNano() / bucketWidth(window)
+	i := id % windowBuckets
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	if wc.ids[i] != id {
+		wc.ids[i] = id
+		wc.counts[i] = 0
+	}
+	wc.counts[i]++
+}
+
+// sum returns the number of events in the window of the given length ending
+// at now.
+func (wc *windowCounter) sum(now time.Time, window time.Duration) uint64 {
+	id := now.UnixNano() / bucketWidth(window)
+	var total uint64
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	for i, bid := range wc.ids {
+		if id-bid < windowBuckets {
+			total += wc.counts[i]
+		}
+	}
+	return total
+}
+
+// recordConnLifetime counts a connection that was open for d towards the
+// churn rate if d is below the short-lived connection threshold.
+func (c *Client) recordConnLifetime(d time.Duration) {
+	threshold := c.ShortLivedConnThreshold
+	if threshold == 0 {
+		threshold = DefaultShortLivedConnThreshold
+	}
+	if d < threshold {
+		c.churn.add(time.Now(), churnWindow)
+	}
+}
+
+// ChurnRate returns the number of connections per second that were closed
+// within ShortLivedConnThreshold of being opened, averaged over the last
+// minute.
+func (c *Client) ChurnRate() float64 {
+	return float64(c.churn.sum(time.Now(), churnWindow)) / churnWindow.Seconds()
+}
+
+// successRatioWindow returns the period over which SuccessRatio is computed.
+func (c *Client) successRatioWindow() time.Duration {
+	if c.SuccessRatioWindow == 0 {
+		return DefaultSuccessRatioWindow
+	}
+	return c.SuccessRatioWindow
+}
+
+// recordDial counts the outcome of dialing an instance for a new connection
+// towards the success ratio.
+func (c *Client) recordDial(err error) {
+	if err != nil {
+		c.dialFailures.add(time.Now(), c.successRatioWindow())
+		return
+	}
+	c.dialSuccesses.add(time.Now(), c.successRatioWindow())
+}
+
+// SuccessRatio returns the fraction of new connections over the last
+// SuccessRatioWindow for which the instance was dialed successfully, along
+// with the number of connections attempted. If no connections were attempted,
+// the ratio is 1.
+func (c *Client) SuccessRatio() (ratio float64, attempts uint64) {
+	now, window := time.Now(), c.successRatioWindow()
+	successes := c.dialSuccesses.sum(now, window)
+	attempts = successes + c.dialFailures.sum(now, window)
+	if attempts == 0 {
+		return 1, 0
+	}
+	return float64(successes) / float64(attempts), attempts
+}
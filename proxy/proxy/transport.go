@@ -0,0 +1,73 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Transport identifies how a local client connected to the proxy.
+type Transport int
+
+const (
+	// TCPTransport is a connection accepted on a TCP listener.
+	TCPTransport Transport = iota
+	// UnixTransport is a connection accepted on a Unix socket.
+	UnixTransport
+
+	numTransports
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TCPTransport:
+		return "tcp"
+	case UnixTransport:
+		return "unix"
+	}
+	return "unknown"
+}
+
+// transportOf returns the Transport conn was accepted on. Connections on
+// anything but a Unix socket are counted as TCP.
+func transportOf(conn net.Conn) Transport {
+	if a := conn.LocalAddr(); a != nil && a.Network() == "unix" {
+		return UnixTransport
+	}
+	return TCPTransport
+}
+
+// trackTransport counts conn towards the open connections of its Transport
+// until the returned func is called, typically as
+//
+//	defer c.trackTransport(conn)()
+func (c *Client) trackTransport(conn net.Conn) func() {
+	t := transportOf(conn)
+	atomic.AddInt64(&c.transports[t], 1)
+	return func() {
+		atomic.AddInt64(&c.transports[t], -1)
+	}
+}
+
+// ConnectionsByTransport returns the number of connections currently open
+// through the Client on each Transport.
+func (c *Client) ConnectionsByTransport() map[Transport]int64 {
+	m := make(map[Transport]int64, numTransports)
+	for t := Transport(0); t < numTransports; t++ {
+		m[t] = atomic.LoadInt64(&c.transports[t])
+	}
+	return m
+}